@@ -0,0 +1,168 @@
+package kt
+
+import (
+	"context"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/opentracing/opentracing-go"
+)
+
+// The administration RPCs below act on the whole database, or on the
+// server itself. They are not subject to rate limits, and like every
+// operation they must complete within the deadline of their context or,
+// without one, the timeout of the Conn. Synchronizing or vacuuming large
+// databases may need a longer deadline.
+//
+// Their errors carry the status code returned by KT: 450 when the
+// operation failed on the server, 400 for invalid arguments and 501 when
+// the server does not support it, for instance listing update logs on a
+// server started without them.
+
+// SyncOptions configures Synchronize.
+type SyncOptions struct {
+	// Hard synchronizes the database files with the storage device,
+	// rather than only with the file system.
+	Hard bool
+	// Command is the name of a postprocessing command run by the server
+	// for each database file once synchronized. It is looked up in the
+	// directory given to ktserver -cmd.
+	Command string
+}
+
+// ReplicationOptions configures TuneReplication.
+type ReplicationOptions struct {
+	// Host and Port of the master to replicate from. An empty Host
+	// stops replication.
+	Host string
+	Port int
+	// Timestamp of the last update already replicated, in the units of
+	// the update logs. Zero leaves it unchanged, unless FromNow is set
+	// to skip all the updates made so far.
+	Timestamp uint64
+	FromNow   bool
+	// Interval between replication operations. Zero leaves it
+	// unchanged.
+	Interval time.Duration
+}
+
+// UpdateLog describes an update log file of the server.
+type UpdateLog struct {
+	Path string
+	Size int64
+	// Timestamp of the last update in the file.
+	Timestamp uint64
+}
+
+// adminRPC calls an administration RPC and returns its output.
+func (c *Conn) adminRPC(ctx context.Context, name, path string, vals []KV) ([]KV, error) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "ktrpc "+name)
+	defer span.Finish()
+	span.SetTag("url", path)
+
+	code, m, err := c.doRPC(ctx, "", path, vals)
+	if err != nil {
+		span.SetTag("status", err)
+		return nil, err
+	}
+	if code != 200 {
+		span.SetTag("status", code)
+		err := makeError(m).(*Error)
+		err.Code = code
+		return nil, err
+	}
+	return m, nil
+}
+
+// Clear removes all the records of the database.
+func (c *Conn) Clear(ctx context.Context) error {
+	_, err := c.adminRPC(ctx, "Clear", "/rpc/clear", nil)
+	return err
+}
+
+// Synchronize writes the database to disk.
+func (c *Conn) Synchronize(ctx context.Context, opts SyncOptions) error {
+	var vals []KV
+	if opts.Hard {
+		vals = append(vals, KV{"hard", nil})
+	}
+	if opts.Command != "" {
+		vals = append(vals, KV{"command", []byte(opts.Command)})
+	}
+	_, err := c.adminRPC(ctx, "Synchronize", "/rpc/synchronize", vals)
+	return err
+}
+
+// Vacuum reclaims the space of removed records. It does so in steps
+// units of work if steps is positive, or over the whole database
+// otherwise.
+func (c *Conn) Vacuum(ctx context.Context, steps int64) error {
+	var vals []KV
+	if steps > 0 {
+		vals = append(vals, KV{"step", []byte(strconv.FormatInt(steps, 10))})
+	}
+	_, err := c.adminRPC(ctx, "Vacuum", "/rpc/vacuum", vals)
+	return err
+}
+
+// TuneReplication changes the master the server replicates from.
+func (c *Conn) TuneReplication(ctx context.Context, opts ReplicationOptions) error {
+	var vals []KV
+	if opts.Host != "" {
+		vals = append(vals, KV{"host", []byte(opts.Host)})
+		if opts.Port != 0 {
+			vals = append(vals, KV{"port", []byte(strconv.Itoa(opts.Port))})
+		}
+	}
+	switch {
+	case opts.FromNow:
+		vals = append(vals, KV{"ts", []byte("now")})
+	case opts.Timestamp != 0:
+		vals = append(vals, KV{"ts", []byte(strconv.FormatUint(opts.Timestamp, 10))})
+	}
+	if opts.Interval > 0 {
+		vals = append(vals, KV{"iv", []byte(strconv.FormatFloat(opts.Interval.Seconds(), 'f', -1, 64))})
+	}
+	_, err := c.adminRPC(ctx, "TuneReplication", "/rpc/tune_replication", vals)
+	return err
+}
+
+// UpdateLogs lists the update log files of the server, sorted by path.
+func (c *Conn) UpdateLogs(ctx context.Context) ([]UpdateLog, error) {
+	m, err := c.adminRPC(ctx, "UpdateLogs", "/rpc/ulog_list", nil)
+	if err != nil {
+		return nil, err
+	}
+	logs := make([]UpdateLog, 0, len(m))
+	for _, kv := range m {
+		// The value is the size and the timestamp, separated by a colon.
+		size, ts, ok := strings.Cut(string(kv.Value), ":")
+		if !ok {
+			return nil, &Error{Message: "bad update log entry: " + string(kv.Value)}
+		}
+		l := UpdateLog{Path: kv.Key}
+		if l.Size, err = strconv.ParseInt(size, 10, 64); err != nil {
+			return nil, &Error{Message: "bad update log size: " + size}
+		}
+		if l.Timestamp, err = strconv.ParseUint(ts, 10, 64); err != nil {
+			return nil, &Error{Message: "bad update log timestamp: " + ts}
+		}
+		logs = append(logs, l)
+	}
+	sort.Slice(logs, func(i, j int) bool { return logs[i].Path < logs[j].Path })
+	return logs, nil
+}
+
+// RemoveUpdateLogs deletes the update log files holding only updates up
+// to before, a timestamp in the units of the update logs. Zero stands for
+// the current time. Logs still needed by slaves should be kept.
+func (c *Conn) RemoveUpdateLogs(ctx context.Context, before uint64) error {
+	var vals []KV
+	if before != 0 {
+		vals = append(vals, KV{"ts", []byte(strconv.FormatUint(before, 10))})
+	}
+	_, err := c.adminRPC(ctx, "RemoveUpdateLogs", "/rpc/ulog_remove", vals)
+	return err
+}
@@ -0,0 +1,94 @@
+package kt
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestAdminRPCs(t *testing.T) {
+	var got []string
+	host, port := startFakeServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		kvs, err := DecodeValues(body, r.Header.Get("Content-Type"))
+		if err != nil {
+			t.Error(err)
+		}
+		if r.URL.Path == "/rpc/void" {
+			return
+		}
+		desc := r.URL.Path
+		for _, kv := range kvs {
+			desc += " " + kv.Key + "=" + string(kv.Value)
+		}
+		got = append(got, desc)
+
+		var out []KV
+		code := 200
+		switch r.URL.Path {
+		case "/rpc/ulog_list":
+			out = []KV{
+				{"/var/ktserver/ulog/0000000002.ulog", []byte("512:1600000000000000000")},
+				{"/var/ktserver/ulog/0000000001.ulog", []byte("1024:1500000000000000000")},
+			}
+		case "/rpc/vacuum":
+			code, out = 501, []KV{{"ERROR", []byte("not implemented")}}
+		}
+		resp, enc := TSVEncode(out)
+		w.Header().Set("Content-Type", enc.ContentType())
+		w.WriteHeader(code)
+		w.Write(resp)
+	}))
+	db, err := NewConn(host, port, 1, DEFAULT_TIMEOUT)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	if err := db.Clear(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Synchronize(ctx, SyncOptions{Hard: true, Command: "backup"}); err != nil {
+		t.Fatal(err)
+	}
+	err = db.Vacuum(ctx, 10)
+	if e, ok := err.(*Error); !ok || e.Code != 501 || e.Message != "not implemented" {
+		t.Errorf("Vacuum: want a 501 error, got %#v", err)
+	}
+	if err := db.TuneReplication(ctx, ReplicationOptions{Host: "master", Port: 1978, FromNow: true, Interval: 40 * time.Millisecond}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.TuneReplication(ctx, ReplicationOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	logs, err := db.UpdateLogs(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantLogs := []UpdateLog{
+		{"/var/ktserver/ulog/0000000001.ulog", 1024, 1500000000000000000},
+		{"/var/ktserver/ulog/0000000002.ulog", 512, 1600000000000000000},
+	}
+	if !reflect.DeepEqual(logs, wantLogs) {
+		t.Errorf("UpdateLogs: want %v, got %v", wantLogs, logs)
+	}
+	if err := db.RemoveUpdateLogs(ctx, 1500000000000000000); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{
+		"/rpc/clear",
+		"/rpc/synchronize hard= command=backup",
+		"/rpc/vacuum step=10",
+		"/rpc/tune_replication host=master port=1978 ts=now iv=0.04",
+		"/rpc/tune_replication",
+		"/rpc/ulog_list",
+		"/rpc/ulog_remove ts=1500000000000000000",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("calls:\nwant %q\ngot  %q", want, got)
+	}
+}
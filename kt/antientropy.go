@@ -0,0 +1,327 @@
+package kt
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"hash/fnv"
+	"io"
+	"strings"
+)
+
+// DiffKind tells how a record differs between the two servers given to
+// Compare.
+type DiffKind int
+
+const (
+	// DiffMissing records exist on the first server only.
+	DiffMissing DiffKind = iota
+	// DiffExtra records exist on the second server only.
+	DiffExtra
+	// DiffValue records exist on both servers with different values.
+	DiffValue
+)
+
+func (k DiffKind) String() string {
+	switch k {
+	case DiffMissing:
+		return "missing"
+	case DiffExtra:
+		return "extra"
+	case DiffValue:
+		return "differing"
+	}
+	return "unknown"
+}
+
+// Diff is a record that differs between the two servers.
+type Diff struct {
+	Key  string
+	Kind DiffKind
+}
+
+// CompareOptions configures Compare.
+type CompareOptions struct {
+	// Prefix restricts the comparison to the keys starting with it.
+	Prefix string
+	// RangeSize is the average number of records per range in the first
+	// walk. It is rounded down to a power of two. Defaults to 4096.
+	RangeSize int
+	// LeafSize is the number of records under which a range is compared
+	// record by record. Defaults to 64.
+	LeafSize int
+	// Repair makes the second server match the first one: missing and
+	// differing records are copied to it with their expiration time,
+	// extra records are removed from it.
+	Repair bool
+	// OnDiff, if set, is called for every record that differs, after it
+	// was repaired if Repair is set.
+	OnDiff func(Diff)
+}
+
+// CompareStats summarizes the result of Compare.
+type CompareStats struct {
+	Missing, Extra, Differing int64
+	// Walks is the number of ranges walked on each server.
+	Walks int64
+}
+
+// rangeFanout is the factor by which the range size shrinks at each
+// step of the drill-down.
+const rangeFanout = 16
+
+// keySpan is the range of keys from start included to end excluded,
+// within the prefix. An empty end means the end of the prefix.
+type keySpan struct {
+	start, end string
+}
+
+func (s keySpan) contains(prefix, key string) bool {
+	return strings.HasPrefix(key, prefix) && (s.end == "" || key < s.end)
+}
+
+// keyRange is the digest of a range of records.
+type keyRange struct {
+	start string
+	count int
+	sum   [sha256.Size]byte
+}
+
+// Compare reports the records that differ between a and b, typically a
+// master and one of its replicas, without holding either keyspace in
+// memory.
+//
+// Both keyspaces are cut into ranges at the keys whose hash is a
+// multiple of the range size, so that the two servers can be walked
+// independently and still agree on the range boundaries. Ranges whose
+// digests match are skipped; the others are walked again with smaller
+// ranges, until they are small enough to be compared record by record.
+// The cost is one walk of both keyspaces, plus a few walks of the ranges
+// that differ.
+//
+// Expiration times are not compared, as they drift between a master and
+// its replicas. Both servers must use tree databases, as ranges are
+// walked with cursors starting at their first key, see NewCursor.
+func Compare(ctx context.Context, a, b *Conn, opts CompareOptions) (CompareStats, error) {
+	if opts.RangeSize <= 0 {
+		opts.RangeSize = 4096
+	}
+	if opts.LeafSize <= 0 {
+		opts.LeafSize = 64
+	}
+	size := 1
+	for size*2 <= opts.RangeSize {
+		size *= 2
+	}
+	cmp := &comparison{a: a, b: b, opts: opts}
+	err := cmp.drill(ctx, keySpan{start: opts.Prefix}, size)
+	return cmp.stats, err
+}
+
+type comparison struct {
+	a, b  *Conn
+	opts  CompareOptions
+	stats CompareStats
+}
+
+// walk calls fn for the records of c in span.
+func (cmp *comparison) walk(ctx context.Context, c *Conn, span keySpan, fn func(Record)) error {
+	cur := c.NewCursor(cmp.opts.Prefix)
+	defer cur.Close()
+	cur.start = span.start
+	for {
+		rec, err := cur.Next(ctx)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if !span.contains(cmp.opts.Prefix, rec.Key) {
+			return nil
+		}
+		fn(rec)
+	}
+}
+
+// ranges cuts span into ranges at the keys whose hash is a multiple of
+// size and returns their digests. The first range always starts at
+// span.start, even if it is empty.
+func (cmp *comparison) ranges(ctx context.Context, c *Conn, span keySpan, size int) ([]keyRange, error) {
+	ranges := []keyRange{{start: span.start}}
+	h := sha256.New()
+	var lenbuf [binary.MaxVarintLen64]byte
+	err := cmp.walk(ctx, c, span, func(rec Record) {
+		if rec.Key != span.start && isBoundary(rec.Key, size) {
+			h.Sum(ranges[len(ranges)-1].sum[:0])
+			h.Reset()
+			ranges = append(ranges, keyRange{start: rec.Key})
+		}
+		h.Write(lenbuf[:binary.PutUvarint(lenbuf[:], uint64(len(rec.Key)))])
+		h.Write([]byte(rec.Key))
+		h.Write(lenbuf[:binary.PutUvarint(lenbuf[:], uint64(len(rec.Value)))])
+		h.Write(rec.Value)
+		ranges[len(ranges)-1].count++
+	})
+	h.Sum(ranges[len(ranges)-1].sum[:0])
+	return ranges, err
+}
+
+func isBoundary(key string, size int) bool {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	return h.Sum64()&uint64(size-1) == 0
+}
+
+// drill compares the ranges of span on both servers and recurses into
+// the ones that differ.
+func (cmp *comparison) drill(ctx context.Context, span keySpan, size int) error {
+	var ra, rb []keyRange
+	errc := make(chan error, 1)
+	go func() {
+		var err error
+		ra, err = cmp.ranges(ctx, cmp.a, span, size)
+		errc <- err
+	}()
+	rb, err := cmp.ranges(ctx, cmp.b, span, size)
+	if aerr := <-errc; err == nil {
+		err = aerr
+	}
+	if err != nil {
+		return err
+	}
+	cmp.stats.Walks++
+
+	for _, d := range diffRanges(ra, rb, span.end) {
+		if d.count <= cmp.opts.LeafSize || size == 1 {
+			err = cmp.leaf(ctx, d.keySpan)
+		} else {
+			next := size / rangeFanout
+			if next < 1 {
+				next = 1
+			}
+			err = cmp.drill(ctx, d.keySpan, next)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type spanDiff struct {
+	keySpan
+	// count is the largest number of records in the span on either
+	// server.
+	count int
+}
+
+// diffRanges returns the spans of ra and rb that differ. Both lists
+// start with a range at the same key. Since a record found on one server
+// only can be a range boundary there, the spans returned go from a
+// boundary common to both lists to the next one.
+func diffRanges(ra, rb []keyRange, end string) []spanDiff {
+	var diffs []spanDiff
+	i, j := 0, 0
+	for i < len(ra) && j < len(rb) {
+		i2, j2 := i+1, j+1
+		for i2 < len(ra) && j2 < len(rb) && ra[i2].start != rb[j2].start {
+			if ra[i2].start < rb[j2].start {
+				i2++
+			} else {
+				j2++
+			}
+		}
+		next := end
+		if i2 < len(ra) && j2 < len(rb) {
+			next = ra[i2].start
+		} else {
+			i2, j2 = len(ra), len(rb)
+		}
+		if i2 != i+1 || j2 != j+1 || ra[i].sum != rb[j].sum {
+			d := spanDiff{keySpan: keySpan{ra[i].start, next}}
+			ca, cb := 0, 0
+			for _, r := range ra[i:i2] {
+				ca += r.count
+			}
+			for _, r := range rb[j:j2] {
+				cb += r.count
+			}
+			if d.count = ca; cb > ca {
+				d.count = cb
+			}
+			diffs = append(diffs, d)
+		}
+		i, j = i2, j2
+	}
+	return diffs
+}
+
+// leaf compares the records of span one by one.
+func (cmp *comparison) leaf(ctx context.Context, span keySpan) error {
+	var ra, rb []Record
+	if err := cmp.walk(ctx, cmp.a, span, func(rec Record) { ra = append(ra, rec) }); err != nil {
+		return err
+	}
+	if err := cmp.walk(ctx, cmp.b, span, func(rec Record) { rb = append(rb, rec) }); err != nil {
+		return err
+	}
+	cmp.stats.Walks++
+
+	i, j := 0, 0
+	for i < len(ra) || j < len(rb) {
+		var err error
+		switch {
+		case j == len(rb) || i < len(ra) && ra[i].Key < rb[j].Key:
+			err = cmp.report(ctx, DiffMissing, ra[i])
+			i++
+		case i == len(ra) || rb[j].Key < ra[i].Key:
+			err = cmp.report(ctx, DiffExtra, rb[j])
+			j++
+		default:
+			if !bytes.Equal(ra[i].Value, rb[j].Value) {
+				err = cmp.report(ctx, DiffValue, ra[i])
+			}
+			i++
+			j++
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// report counts a difference, repairs it if requested and passes it to
+// OnDiff. rec is the record from the first server, or from the second
+// one for DiffExtra.
+func (cmp *comparison) report(ctx context.Context, kind DiffKind, rec Record) error {
+	switch kind {
+	case DiffMissing:
+		cmp.stats.Missing++
+	case DiffExtra:
+		cmp.stats.Extra++
+	case DiffValue:
+		cmp.stats.Differing++
+	}
+	if cmp.opts.Repair {
+		var err error
+		if kind == DiffExtra {
+			_, err = cmp.b.removeBulk(ctx, []string{rec.Key})
+		} else {
+			var xt int64
+			if !rec.Expires.IsZero() {
+				xt = -rec.Expires.Unix()
+			}
+			_, err = cmp.b.doSetBulk(ctx, []KV{{rec.Key, rec.Value}}, xt)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if cmp.opts.OnDiff != nil {
+		cmp.opts.OnDiff(Diff{Key: rec.Key, Kind: kind})
+	}
+	return nil
+}
@@ -0,0 +1,91 @@
+package kt
+
+import (
+	"context"
+	"math/rand"
+	"reflect"
+	"sort"
+	"strconv"
+	"testing"
+)
+
+func TestCompare(t *testing.T) {
+	ctx := context.Background()
+	rng := rand.New(rand.NewSource(1))
+	for round := 0; round < 5; round++ {
+		a, b := newFakeKT(), newFakeKT()
+		for i := 0; i < 500; i++ {
+			k := "k" + strconv.Itoa(rng.Intn(100000))
+			a.put(k, []byte(k), 0)
+			b.put(k, []byte(k), 0)
+		}
+		a.put("other", []byte("1"), 0)
+
+		// Introduce differences, some of which may fall on range
+		// boundaries.
+		want := map[string]DiffKind{}
+		for i := 0; i < 1+round*4; i++ {
+			k := "k" + strconv.Itoa(100000+rng.Intn(100000))
+			switch rng.Intn(3) {
+			case 0:
+				a.put(k, []byte("a"), 0)
+				want[k] = DiffMissing
+			case 1:
+				b.put(k, []byte("b"), 0)
+				want[k] = DiffExtra
+			case 2:
+				a.put(k, []byte("a"), 0)
+				b.put(k, []byte("b"), 0)
+				want[k] = DiffValue
+			}
+		}
+
+		got := map[string]DiffKind{}
+		opts := CompareOptions{
+			Prefix:    "k",
+			RangeSize: 64,
+			LeafSize:  4,
+			Repair:    true,
+			OnDiff:    func(d Diff) { got[d.Key] = d.Kind },
+		}
+		stats, err := Compare(ctx, a.conn(t), b.conn(t), opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("round %d: want %v, got %v", round, want, got)
+		}
+		if n := stats.Missing + stats.Extra + stats.Differing; n != int64(len(want)) {
+			t.Errorf("round %d: stats %+v do not add up to %d", round, stats, len(want))
+		}
+
+		// The repair made b identical to a within the prefix.
+		opts.OnDiff, opts.Repair = nil, false
+		if stats, err = Compare(ctx, a.conn(t), b.conn(t), opts); err != nil {
+			t.Fatal(err)
+		}
+		if stats != (CompareStats{Walks: 1}) {
+			t.Errorf("round %d: after repair: %+v", round, stats)
+		}
+		if _, ok := b.lookup("other"); ok {
+			t.Errorf("round %d: record outside of the prefix was repaired", round)
+		}
+	}
+}
+
+func TestDiffRanges(t *testing.T) {
+	r := func(start string, count int, sum byte) keyRange {
+		return keyRange{start: start, count: count, sum: [32]byte{sum}}
+	}
+	ra := []keyRange{r("", 2, 1), r("c", 3, 2), r("f", 1, 3), r("m", 4, 4)}
+	rb := []keyRange{r("", 2, 1), r("c", 2, 9), r("e", 2, 8), r("f", 1, 3), r("m", 4, 4), r("x", 1, 5)}
+	var got []string
+	for _, d := range diffRanges(ra, rb, "") {
+		got = append(got, d.start+"-"+d.end+":"+strconv.Itoa(d.count))
+	}
+	sort.Strings(got)
+	want := []string{"c-f:4", "m-:5"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("want %v, got %v", want, got)
+	}
+}
@@ -0,0 +1,248 @@
+package kt
+
+import (
+	"context"
+)
+
+// Client is implemented by Conn and by all the wrappers in this package,
+// so that they can be layered on top of each other.
+type Client interface {
+	Count(ctx context.Context) (int, error)
+	Get(ctx context.Context, key string) (string, error)
+	GetBytes(ctx context.Context, key string) ([]byte, error)
+	GetBulk(ctx context.Context, keysAndVals map[string]string) error
+	GetBulkBytes(ctx context.Context, keys map[string][]byte) error
+	Set(ctx context.Context, key string, value []byte) error
+	SetBulk(ctx context.Context, values map[string]string) (int64, error)
+	Remove(ctx context.Context, key string) error
+	RemoveBulk(ctx context.Context, keys []string) (int64, error)
+	MatchPrefix(ctx context.Context, key string, maxrecords int64) ([]string, error)
+}
+
+var (
+	_ Client = (*Conn)(nil)
+	_ Client = (*TrackedConn)(nil)
+	_ Client = (*NamespacedConn)(nil)
+	_ Client = (*DualWriteConn)(nil)
+	_ Client = (*HedgedConn)(nil)
+)
+
+// Operation names, as found in Call.Op and in metric labels.
+const (
+	OpCount         = "COUNT"
+	OpRemove        = "REMOVE"
+	OpGetBulk       = "GETBULK"
+	OpGet           = "GET"
+	OpGetBytes      = "GETBYTES"
+	OpSet           = "SET"
+	OpGetBulkBytes  = "GETBULKBYTES"
+	OpSetBulk       = "SETBULK"
+	OpRemoveBulk    = "REMOVEBULK"
+	OpMatchPrefix   = "MATCHPREFIX"
+	OpMatchRegex    = "MATCHREGEX"
+	OpSeize         = "SEIZE"
+	OpCheck         = "CHECK"
+	OpGetWithExpiry = "GETWITHEXPIRY"
+)
+
+// Set stores the data at key.
+func (c *Conn) Set(ctx context.Context, key string, value []byte) error {
+	return c.set(ctx, key, value)
+}
+
+// SetBulk stores the values in the map and returns the number of
+// records stored.
+func (c *Conn) SetBulk(ctx context.Context, values map[string]string) (int64, error) {
+	return c.setBulk(ctx, values)
+}
+
+// Remove deletes the data at key. ErrNotFound is returned if no such
+// data exists.
+func (c *Conn) Remove(ctx context.Context, key string) error {
+	return c.remove(ctx, key)
+}
+
+// RemoveBulk deletes the given keys and returns the number of records
+// removed.
+func (c *Conn) RemoveBulk(ctx context.Context, keys []string) (int64, error) {
+	return c.removeBulk(ctx, keys)
+}
+
+// Call describes an operation travelling through an interceptor chain.
+type Call struct {
+	// Op is the name of the operation, one of the Op constants.
+	Op string
+	// Keys addressed by the operation. For MatchPrefix this is the
+	// prefix, for Count it is empty.
+	Keys []string
+	// Reply is the map filled in by GetBulk (map[string]string) and
+	// GetBulkBytes (map[string][]byte), nil for other operations.
+	// Interceptors may inspect or modify it after invoking the next
+	// handler.
+	Reply interface{}
+	// Sent and Received are the number of key and value bytes sent to
+	// and received from KT, set by the time the invoker returns.
+	Sent, Received int
+}
+
+// Invoker performs the operation described by call.
+type Invoker func(ctx context.Context, call *Call) error
+
+// Interceptor intercepts the execution of an operation. It is modelled
+// after gRPC unary client interceptors: it may inspect and modify the
+// call, invoke the next handler zero or more times, and change the error
+// it returns.
+type Interceptor func(ctx context.Context, call *Call, invoker Invoker) error
+
+// ChainInterceptors combines interceptors into one. The first interceptor
+// is the outermost, the last one is closest to the client.
+func ChainInterceptors(interceptors ...Interceptor) Interceptor {
+	return func(ctx context.Context, call *Call, invoker Invoker) error {
+		return chainInvoker(interceptors, invoker)(ctx, call)
+	}
+}
+
+func chainInvoker(interceptors []Interceptor, invoker Invoker) Invoker {
+	if len(interceptors) == 0 {
+		return invoker
+	}
+	next := chainInvoker(interceptors[1:], invoker)
+	return func(ctx context.Context, call *Call) error {
+		return interceptors[0](ctx, call, next)
+	}
+}
+
+// Intercept returns a client that runs every operation on c through the
+// interceptors.
+func Intercept(c Client, interceptors ...Interceptor) Client {
+	return &interceptedClient{next: c, intercept: ChainInterceptors(interceptors...)}
+}
+
+type interceptedClient struct {
+	next      Client
+	intercept Interceptor
+}
+
+func (c *interceptedClient) Count(ctx context.Context) (int, error) {
+	var n int
+	err := c.intercept(ctx, &Call{Op: OpCount}, func(ctx context.Context, call *Call) error {
+		var err error
+		n, err = c.next.Count(ctx)
+		return err
+	})
+	return n, err
+}
+
+func (c *interceptedClient) Get(ctx context.Context, key string) (string, error) {
+	var s string
+	call := &Call{Op: OpGet, Keys: []string{key}}
+	err := c.intercept(ctx, call, func(ctx context.Context, call *Call) error {
+		var err error
+		s, err = c.next.Get(ctx, key)
+		call.Sent, call.Received = len(key), len(s)
+		return err
+	})
+	return s, err
+}
+
+func (c *interceptedClient) GetBytes(ctx context.Context, key string) ([]byte, error) {
+	var b []byte
+	call := &Call{Op: OpGetBytes, Keys: []string{key}}
+	err := c.intercept(ctx, call, func(ctx context.Context, call *Call) error {
+		var err error
+		b, err = c.next.GetBytes(ctx, key)
+		call.Sent, call.Received = len(key), len(b)
+		return err
+	})
+	return b, err
+}
+
+func (c *interceptedClient) GetBulk(ctx context.Context, keysAndVals map[string]string) error {
+	call := &Call{Op: OpGetBulk, Keys: make([]string, 0, len(keysAndVals)), Reply: keysAndVals}
+	for k := range keysAndVals {
+		call.Keys = append(call.Keys, k)
+		call.Sent += len(k)
+	}
+	return c.intercept(ctx, call, func(ctx context.Context, call *Call) error {
+		err := c.next.GetBulk(ctx, keysAndVals)
+		call.Received = 0
+		for _, v := range keysAndVals {
+			call.Received += len(v)
+		}
+		return err
+	})
+}
+
+func (c *interceptedClient) GetBulkBytes(ctx context.Context, keys map[string][]byte) error {
+	call := &Call{Op: OpGetBulkBytes, Keys: make([]string, 0, len(keys)), Reply: keys}
+	for k := range keys {
+		call.Keys = append(call.Keys, k)
+		call.Sent += len(k)
+	}
+	return c.intercept(ctx, call, func(ctx context.Context, call *Call) error {
+		err := c.next.GetBulkBytes(ctx, keys)
+		call.Received = 0
+		for _, v := range keys {
+			call.Received += len(v)
+		}
+		return err
+	})
+}
+
+func (c *interceptedClient) Set(ctx context.Context, key string, value []byte) error {
+	call := &Call{Op: OpSet, Keys: []string{key}, Sent: len(key) + len(value)}
+	return c.intercept(ctx, call, func(ctx context.Context, call *Call) error {
+		return c.next.Set(ctx, key, value)
+	})
+}
+
+func (c *interceptedClient) SetBulk(ctx context.Context, values map[string]string) (int64, error) {
+	var n int64
+	call := &Call{Op: OpSetBulk, Keys: make([]string, 0, len(values))}
+	for k, v := range values {
+		call.Keys = append(call.Keys, k)
+		call.Sent += len(k) + len(v)
+	}
+	err := c.intercept(ctx, call, func(ctx context.Context, call *Call) error {
+		var err error
+		n, err = c.next.SetBulk(ctx, values)
+		return err
+	})
+	return n, err
+}
+
+func (c *interceptedClient) Remove(ctx context.Context, key string) error {
+	call := &Call{Op: OpRemove, Keys: []string{key}, Sent: len(key)}
+	return c.intercept(ctx, call, func(ctx context.Context, call *Call) error {
+		return c.next.Remove(ctx, key)
+	})
+}
+
+func (c *interceptedClient) RemoveBulk(ctx context.Context, keys []string) (int64, error) {
+	var n int64
+	call := &Call{Op: OpRemoveBulk, Keys: keys}
+	for _, k := range keys {
+		call.Sent += len(k)
+	}
+	err := c.intercept(ctx, call, func(ctx context.Context, call *Call) error {
+		var err error
+		n, err = c.next.RemoveBulk(ctx, keys)
+		return err
+	})
+	return n, err
+}
+
+func (c *interceptedClient) MatchPrefix(ctx context.Context, key string, maxrecords int64) ([]string, error) {
+	var res []string
+	call := &Call{Op: OpMatchPrefix, Keys: []string{key}, Sent: len(key)}
+	err := c.intercept(ctx, call, func(ctx context.Context, call *Call) error {
+		var err error
+		res, err = c.next.MatchPrefix(ctx, key, maxrecords)
+		call.Received = 0
+		for _, k := range res {
+			call.Received += len(k)
+		}
+		return err
+	})
+	return res, err
+}
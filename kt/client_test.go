@@ -0,0 +1,189 @@
+package kt
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// memClient is an in-memory Client used to test wrappers without a
+// ktserver.
+type memClient struct {
+	mu   sync.Mutex
+	data map[string][]byte
+}
+
+func newMemClient() *memClient {
+	return &memClient{data: make(map[string][]byte)}
+}
+
+func (m *memClient) Count(ctx context.Context) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.data), nil
+}
+
+func (m *memClient) Get(ctx context.Context, key string) (string, error) {
+	b, err := m.GetBytes(ctx, key)
+	return string(b), err
+}
+
+func (m *memClient) GetBytes(ctx context.Context, key string) ([]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	b, ok := m.data[key]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return b, nil
+}
+
+func (m *memClient) GetBulk(ctx context.Context, keysAndVals map[string]string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for k := range keysAndVals {
+		if v, ok := m.data[k]; ok {
+			keysAndVals[k] = string(v)
+		} else {
+			delete(keysAndVals, k)
+		}
+	}
+	return nil
+}
+
+func (m *memClient) GetBulkBytes(ctx context.Context, keys map[string][]byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for k := range keys {
+		if v, ok := m.data[k]; ok {
+			keys[k] = v
+		} else {
+			delete(keys, k)
+		}
+	}
+	return nil
+}
+
+func (m *memClient) Set(ctx context.Context, key string, value []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.data[key] = append([]byte(nil), value...)
+	return nil
+}
+
+func (m *memClient) SetBulk(ctx context.Context, values map[string]string) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for k, v := range values {
+		m.data[k] = []byte(v)
+	}
+	return int64(len(values)), nil
+}
+
+func (m *memClient) Remove(ctx context.Context, key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.data[key]; !ok {
+		return ErrNotFound
+	}
+	delete(m.data, key)
+	return nil
+}
+
+func (m *memClient) RemoveBulk(ctx context.Context, keys []string) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var n int64
+	for _, k := range keys {
+		if _, ok := m.data[k]; ok {
+			delete(m.data, k)
+			n++
+		}
+	}
+	return n, nil
+}
+
+func (m *memClient) MatchPrefix(ctx context.Context, key string, maxrecords int64) ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var res []string
+	for k := range m.data {
+		if strings.HasPrefix(k, key) {
+			res = append(res, k)
+		}
+	}
+	sort.Strings(res)
+	if maxrecords >= 0 && int64(len(res)) > maxrecords {
+		res = res[:maxrecords]
+	}
+	if len(res) == 0 {
+		return nil, ErrSuccess
+	}
+	return res, nil
+}
+
+func TestInterceptorChain(t *testing.T) {
+	ctx := context.Background()
+	var trace []string
+	logger := func(name string) Interceptor {
+		return func(ctx context.Context, call *Call, invoker Invoker) error {
+			trace = append(trace, name+" "+call.Op)
+			err := invoker(ctx, call)
+			trace = append(trace, name+" done")
+			return err
+		}
+	}
+	c := Intercept(newMemClient(), logger("outer"), logger("inner"))
+	if err := c.Set(ctx, "a", []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"outer SET", "inner SET", "inner done", "outer done"}
+	if !reflect.DeepEqual(trace, want) {
+		t.Errorf("trace: want %q, got %q", want, trace)
+	}
+}
+
+func TestInterceptorCall(t *testing.T) {
+	ctx := context.Background()
+	mem := newMemClient()
+	mem.Set(ctx, "a", []byte("value"))
+
+	var last Call
+	record := func(ctx context.Context, call *Call, invoker Invoker) error {
+		err := invoker(ctx, call)
+		last = *call
+		return err
+	}
+	c := Intercept(mem, record)
+
+	if _, err := c.Get(ctx, "a"); err != nil {
+		t.Fatal(err)
+	}
+	if last.Op != OpGet || last.Sent != 1 || last.Received != 5 {
+		t.Errorf("Get call: %+v", last)
+	}
+
+	keys := map[string][]byte{"a": nil, "b": nil}
+	if err := c.GetBulkBytes(ctx, keys); err != nil {
+		t.Fatal(err)
+	}
+	if last.Op != OpGetBulkBytes || len(last.Keys) != 2 || last.Received != 5 {
+		t.Errorf("GetBulkBytes call: %+v", last)
+	}
+
+	// Interceptors can short-circuit and rewrite results.
+	drop := func(ctx context.Context, call *Call, invoker Invoker) error {
+		err := invoker(ctx, call)
+		if m, ok := call.Reply.(map[string][]byte); ok {
+			delete(m, "a")
+		}
+		return err
+	}
+	keys = map[string][]byte{"a": nil}
+	if err := Intercept(mem, drop).GetBulkBytes(ctx, keys); err != nil || len(keys) != 0 {
+		t.Errorf("GetBulkBytes through dropping interceptor: %q, %v", keys, err)
+	}
+}
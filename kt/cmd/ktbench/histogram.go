@@ -0,0 +1,79 @@
+package main
+
+import (
+	"math/bits"
+	"time"
+)
+
+// histogram counts latencies in buckets whose width grows with the
+// latency, so that quantiles are within 1/subBuckets of the true value
+// whatever the range. Latencies are recorded in microseconds.
+type histogram struct {
+	counts [64 * subBuckets]uint64
+	n      uint64
+	max    time.Duration
+}
+
+// subBuckets is the number of buckets per power of two.
+const subBuckets = 16
+
+func bucket(us uint64) int {
+	if us < subBuckets {
+		return int(us)
+	}
+	// The position of the leading bit selects the power of two, the
+	// next log2(subBuckets) bits the bucket within it.
+	exp := bits.Len64(us) - 5
+	return (exp+1)*subBuckets + int(us>>uint(exp)) - subBuckets
+}
+
+// lowerBound returns the smallest latency counted in bucket i.
+func lowerBound(i int) uint64 {
+	if i < subBuckets {
+		return uint64(i)
+	}
+	exp := i/subBuckets - 1
+	return uint64(i%subBuckets+subBuckets) << uint(exp)
+}
+
+func (h *histogram) record(d time.Duration) {
+	h.counts[bucket(uint64(d/time.Microsecond))]++
+	h.n++
+	if d > h.max {
+		h.max = d
+	}
+}
+
+func (h *histogram) merge(o *histogram) {
+	for i, c := range o.counts {
+		h.counts[i] += c
+	}
+	h.n += o.n
+	if o.max > h.max {
+		h.max = o.max
+	}
+}
+
+func (h *histogram) reset() {
+	*h = histogram{}
+}
+
+// quantile returns the latency under which a fraction q of the recorded
+// latencies fall.
+func (h *histogram) quantile(q float64) time.Duration {
+	if h.n == 0 {
+		return 0
+	}
+	rank := uint64(q * float64(h.n))
+	if rank >= h.n {
+		return h.max
+	}
+	var seen uint64
+	for i, c := range h.counts {
+		seen += c
+		if seen > rank {
+			return time.Duration(lowerBound(i)) * time.Microsecond
+		}
+	}
+	return h.max
+}
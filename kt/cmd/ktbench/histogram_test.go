@@ -0,0 +1,49 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBuckets(t *testing.T) {
+	prev := -1
+	for us := uint64(0); us < 1<<20; us++ {
+		b := bucket(us)
+		if b != prev && b != prev+1 {
+			t.Fatalf("bucket(%d) = %d follows %d", us, b, prev)
+		}
+		if b != prev && lowerBound(b) != us {
+			t.Fatalf("lowerBound(%d) = %d, want %d", b, lowerBound(b), us)
+		}
+		prev = b
+	}
+	if b := bucket(1<<64 - 1); b >= len(histogram{}.counts) {
+		t.Errorf("bucket of the largest latency out of range: %d", b)
+	}
+}
+
+func TestQuantile(t *testing.T) {
+	var h, o histogram
+	for i := 1; i <= 1000; i++ {
+		h.record(time.Duration(i) * time.Millisecond)
+	}
+	o.record(5 * time.Second)
+	h.merge(&o)
+	for _, c := range []struct {
+		q    float64
+		want time.Duration
+	}{
+		{0.5, 500 * time.Millisecond},
+		{0.99, 990 * time.Millisecond},
+		{1, 5 * time.Second},
+	} {
+		got := h.quantile(c.q)
+		if got > c.want || float64(c.want-got) > float64(c.want)/subBuckets {
+			t.Errorf("quantile(%v): want about %v, got %v", c.q, c.want, got)
+		}
+	}
+	h.reset()
+	if h.quantile(0.5) != 0 {
+		t.Errorf("quantile of an empty histogram: %v", h.quantile(0.5))
+	}
+}
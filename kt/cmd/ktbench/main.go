@@ -0,0 +1,243 @@
+// Command ktbench drives a configurable workload against a Kyoto Tycoon
+// server through package kt, and reports throughput and latency
+// percentiles over time.
+//
+//	ktbench [flags]
+//
+// For instance, 90% reads of 1KB values over a million keys with a Zipf
+// distribution, from 64 concurrent workers:
+//
+//	ktbench -keys 1000000 -dist zipf -reads 0.9 -value-size 1024 -c 64 -preload
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"math/rand"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/cloudflare/golibs/kt"
+)
+
+func main() {
+	host := flag.String("host", "127.0.0.1", "ktserver host")
+	port := flag.Int("port", 1978, "ktserver port")
+	timeout := flag.Duration("timeout", kt.DEFAULT_TIMEOUT, "timeout of each operation")
+	creds := flag.String("tls", "", "directory holding service.pem, service-key.pem and ca.pem to connect with TLS")
+	duration := flag.Duration("duration", 30*time.Second, "length of the run")
+	interval := flag.Duration("interval", time.Second, "reporting interval")
+	concurrency := flag.Int("c", 16, "number of concurrent workers")
+	reads := flag.Float64("reads", 0.9, "fraction of operations that are reads")
+	nkeys := flag.Uint64("keys", 100000, "number of distinct keys")
+	prefix := flag.String("prefix", "ktbench:", "prefix of the generated keys")
+	dist := flag.String("dist", "uniform", "key distribution: uniform, zipf or trace")
+	zipfS := flag.Float64("zipf-s", 1.1, "exponent of the zipf distribution, greater than 1")
+	trace := flag.String("trace", "", "file of keys to replay, one per line, for -dist trace")
+	valueSize := flag.String("value-size", "100", "size of the written values in bytes, n or min-max")
+	bulk := flag.Int("bulk", 1, "keys per operation; above 1, bulk RPCs are used")
+	preload := flag.Bool("preload", false, "store a value under every key before the run")
+	flag.Parse()
+
+	w := &workload{readRatio: *reads, bulk: *bulk}
+	var err error
+	if w.minValue, w.maxValue, err = parseSize(*valueSize); err != nil {
+		fatal(err)
+	}
+	w.valueBytes = make([]byte, w.maxValue)
+	rand.Read(w.valueBytes)
+
+	var keyList []string
+	switch *dist {
+	case "uniform", "zipf":
+		if *nkeys == 0 {
+			fatal(fmt.Errorf("-keys must be positive"))
+		}
+		if *dist == "uniform" {
+			w.keys = uniformKeys(*prefix, *nkeys)
+		} else if w.keys, err = zipfKeys(*prefix, *nkeys, *zipfS); err != nil {
+			fatal(err)
+		}
+		if *preload {
+			keyList = make([]string, *nkeys)
+			for i := range keyList {
+				keyList[i] = keyName(*prefix, uint64(i))
+			}
+		}
+	case "trace":
+		if *trace == "" {
+			fatal(fmt.Errorf("-dist trace requires -trace"))
+		}
+		if w.keys, keyList, err = traceKeys(*trace); err != nil {
+			fatal(err)
+		}
+	default:
+		fatal(fmt.Errorf("unknown key distribution %q", *dist))
+	}
+
+	var conn *kt.Conn
+	if *creds != "" {
+		conn, err = kt.NewConnTLS(*host, *port, *concurrency, *timeout, *creds, kt.WithPrewarm())
+	} else {
+		conn, err = kt.NewConn(*host, *port, *concurrency, *timeout, kt.WithPrewarm())
+	}
+	if err != nil {
+		fatal(err)
+	}
+	defer conn.Close(context.Background())
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	if *preload {
+		fmt.Fprintf(os.Stderr, "preloading %d keys\n", len(keyList))
+		if err := w.preload(ctx, conn, keyList, 1000); err != nil {
+			fatal(err)
+		}
+	}
+	run(ctx, w, conn, *concurrency, *duration, *interval)
+}
+
+func fatal(err error) {
+	fmt.Fprintf(os.Stderr, "ktbench: %s\n", strings.TrimSpace(err.Error()))
+	os.Exit(1)
+}
+
+// run starts the workers and prints a line of results every interval,
+// then a summary.
+func run(ctx context.Context, w *workload, conn *kt.Conn, concurrency int, duration, interval time.Duration) {
+	ctx, cancel := context.WithTimeout(ctx, duration)
+	defer cancel()
+
+	stats := make([]*workerStats, concurrency)
+	var wg sync.WaitGroup
+	for i := range stats {
+		stats[i] = new(workerStats)
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			w.worker(ctx, conn, i, stats[i])
+		}(i)
+	}
+
+	// Rows are flushed as they come, so columns get a minimum width to
+	// stay aligned.
+	out := tabwriter.NewWriter(os.Stdout, 10, 8, 1, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(out, "time\tops/s\treads/s\twrites/s\terrors\tmisses\tretries\tp50\tp90\tp99\tp99.9\tmax\t")
+	out.Flush()
+
+	var total, cur result
+	start := time.Now()
+	last, retries := start, conn.RetryCount()
+	collect := func() {
+		now := time.Now()
+		cur.reset()
+		for _, s := range stats {
+			s.mu.Lock()
+			cur.add(s)
+			s.reads.reset()
+			s.writes.reset()
+			s.errors, s.misses = 0, 0
+			s.mu.Unlock()
+		}
+		cur.elapsed = now.Sub(last)
+		r := conn.RetryCount()
+		cur.retries = r - retries
+		last, retries = now, r
+		total.merge(&cur)
+	}
+
+	t := time.NewTicker(interval)
+	defer t.Stop()
+loop:
+	for {
+		select {
+		case <-ctx.Done():
+			break loop
+		case <-t.C:
+			collect()
+			cur.print(out, time.Since(start).Round(time.Second))
+		}
+	}
+	wg.Wait()
+	collect()
+	total.elapsed = time.Since(start)
+
+	fmt.Fprintln(out)
+	fmt.Fprintln(out, "\tops\tops/s\terrors\tmisses\tretries\tp50\tp90\tp99\tp99.9\tmax\t")
+	total.summary(out)
+	out.Flush()
+}
+
+// result aggregates the stats of all workers over a period of time.
+type result struct {
+	reads, writes, all      histogram
+	errors, misses, retries uint64
+	elapsed                 time.Duration
+}
+
+func (r *result) reset() {
+	*r = result{}
+}
+
+func (r *result) add(s *workerStats) {
+	r.reads.merge(&s.reads)
+	r.writes.merge(&s.writes)
+	r.all.merge(&s.reads)
+	r.all.merge(&s.writes)
+	r.errors += s.errors
+	r.misses += s.misses
+}
+
+func (r *result) merge(o *result) {
+	r.reads.merge(&o.reads)
+	r.writes.merge(&o.writes)
+	r.all.merge(&o.all)
+	r.errors += o.errors
+	r.misses += o.misses
+	r.retries += o.retries
+}
+
+func (r *result) rate(n uint64) float64 {
+	if r.elapsed <= 0 {
+		return 0
+	}
+	return float64(n) / r.elapsed.Seconds()
+}
+
+func latencies(h *histogram) string {
+	q := func(q float64) string {
+		return h.quantile(q).String()
+	}
+	return strings.Join([]string{q(0.5), q(0.9), q(0.99), q(0.999), h.max.Round(time.Microsecond).String()}, "\t")
+}
+
+func (r *result) print(out *tabwriter.Writer, at time.Duration) {
+	fmt.Fprintf(out, "%v\t%.0f\t%.0f\t%.0f\t%d\t%d\t%d\t%s\t\n", at,
+		r.rate(r.all.n), r.rate(r.reads.n), r.rate(r.writes.n),
+		r.errors, r.misses, r.retries, latencies(&r.all))
+	out.Flush()
+}
+
+func (r *result) summary(out *tabwriter.Writer) {
+	for _, line := range []struct {
+		name string
+		h    *histogram
+	}{{"reads", &r.reads}, {"writes", &r.writes}, {"all", &r.all}} {
+		if line.h.n == 0 {
+			continue
+		}
+		var errors, misses, retries string
+		if line.name == "all" {
+			errors = fmt.Sprint(r.errors)
+			misses = fmt.Sprint(r.misses)
+			retries = fmt.Sprint(r.retries)
+		}
+		fmt.Fprintf(out, "%s\t%d\t%.0f\t%s\t%s\t%s\t%s\t\n", line.name, line.h.n, r.rate(line.h.n),
+			errors, misses, retries, latencies(line.h))
+	}
+}
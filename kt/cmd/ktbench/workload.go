@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"math/rand"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cloudflare/golibs/kt"
+)
+
+// workload describes the operations issued by every worker.
+type workload struct {
+	readRatio  float64
+	keys       keySource
+	minValue   int
+	maxValue   int
+	bulk       int
+	valueBytes []byte
+}
+
+// keySource creates the key generator of each worker.
+type keySource func(r *rand.Rand, worker int) func() string
+
+func keyName(prefix string, i uint64) string {
+	return prefix + strconv.FormatUint(i, 10)
+}
+
+func uniformKeys(prefix string, n uint64) keySource {
+	return func(r *rand.Rand, worker int) func() string {
+		return func() string {
+			return keyName(prefix, uint64(r.Int63n(int64(n))))
+		}
+	}
+}
+
+// zipfKeys picks keys with a Zipf distribution of exponent s, key 0
+// being the most popular.
+func zipfKeys(prefix string, n uint64, s float64) (keySource, error) {
+	if s <= 1 {
+		return nil, fmt.Errorf("zipf exponent must be greater than 1, got %v", s)
+	}
+	return func(r *rand.Rand, worker int) func() string {
+		z := rand.NewZipf(r, s, 1, n-1)
+		return func() string {
+			return keyName(prefix, z.Uint64())
+		}
+	}, nil
+}
+
+// traceKeys replays the keys read from a file, one per line. Workers
+// start at different offsets in the trace and loop over it.
+func traceKeys(path string) (keySource, []string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+	var keys []string
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		if s.Text() != "" {
+			keys = append(keys, s.Text())
+		}
+	}
+	if err := s.Err(); err != nil {
+		return nil, nil, err
+	}
+	if len(keys) == 0 {
+		return nil, nil, fmt.Errorf("%s: no keys", path)
+	}
+	return func(r *rand.Rand, worker int) func() string {
+		i := r.Intn(len(keys))
+		return func() string {
+			k := keys[i]
+			i = (i + 1) % len(keys)
+			return k
+		}
+	}, keys, nil
+}
+
+// parseSize parses a value size given as "n" or "min-max".
+func parseSize(s string) (min, max int, err error) {
+	lo, hi := s, s
+	if i := strings.IndexByte(s, '-'); i >= 0 {
+		lo, hi = s[:i], s[i+1:]
+	}
+	if min, err = strconv.Atoi(lo); err != nil {
+		return 0, 0, fmt.Errorf("invalid value size %q", s)
+	}
+	if max, err = strconv.Atoi(hi); err != nil || max < min || min < 0 {
+		return 0, 0, fmt.Errorf("invalid value size %q", s)
+	}
+	return min, max, nil
+}
+
+func (w *workload) value(r *rand.Rand) []byte {
+	n := w.minValue
+	if w.maxValue > w.minValue {
+		n += r.Intn(w.maxValue - w.minValue + 1)
+	}
+	return w.valueBytes[:n]
+}
+
+// workerStats accumulates the results of a worker until the reporter
+// collects them.
+type workerStats struct {
+	mu     sync.Mutex
+	reads  histogram
+	writes histogram
+	errors uint64
+	misses uint64
+}
+
+// worker issues operations until ctx is done.
+func (w *workload) worker(ctx context.Context, conn *kt.Conn, id int, stats *workerStats) {
+	r := rand.New(rand.NewSource(time.Now().UnixNano() + int64(id)))
+	next := w.keys(r, id)
+	for ctx.Err() == nil {
+		read := r.Float64() < w.readRatio
+		var err error
+		var missed bool
+		start := time.Now()
+		switch {
+		case read && w.bulk <= 1:
+			_, err = conn.GetBytes(ctx, next())
+			if err == kt.ErrNotFound {
+				err, missed = nil, true
+			}
+		case read:
+			keys := make(map[string][]byte, w.bulk)
+			for i := 0; i < w.bulk; i++ {
+				keys[next()] = nil
+			}
+			want := len(keys)
+			err = conn.GetBulkBytes(ctx, keys)
+			missed = len(keys) < want
+		case w.bulk <= 1:
+			err = conn.Set(ctx, next(), w.value(r))
+		default:
+			values := make(map[string]string, w.bulk)
+			for i := 0; i < w.bulk; i++ {
+				values[next()] = string(w.value(r))
+			}
+			_, err = conn.SetBulk(ctx, values)
+		}
+		elapsed := time.Since(start)
+		if ctx.Err() != nil {
+			// Operations cut short at the end of the run would skew
+			// the results.
+			return
+		}
+
+		stats.mu.Lock()
+		switch {
+		case err != nil:
+			stats.errors++
+		case read:
+			stats.reads.record(elapsed)
+		default:
+			stats.writes.record(elapsed)
+		}
+		if missed {
+			stats.misses++
+		}
+		stats.mu.Unlock()
+	}
+}
+
+// preload stores a value under every key of the keyspace.
+func (w *workload) preload(ctx context.Context, conn *kt.Conn, keys []string, batch int) error {
+	r := rand.New(rand.NewSource(1))
+	values := make(map[string]string, batch)
+	for i, k := range keys {
+		values[k] = string(w.value(r))
+		if len(values) == batch || i == len(keys)-1 {
+			if _, err := conn.SetBulk(ctx, values); err != nil {
+				return err
+			}
+			values = make(map[string]string, batch)
+		}
+	}
+	return nil
+}
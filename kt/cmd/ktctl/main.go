@@ -0,0 +1,354 @@
+// Command ktctl performs operations against a Kyoto Tycoon server using
+// package kt.
+//
+//	ktctl [flags] <command> [arguments]
+//
+// Run ktctl -help for the list of commands.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cloudflare/golibs/kt"
+)
+
+// command is a ktctl subcommand. run receives the arguments following
+// the command name.
+type command struct {
+	usage string
+	help  string
+	run   func(ctx context.Context, env *env, args []string) error
+}
+
+// env is what commands get to work with.
+type env struct {
+	conn *kt.Conn
+	out  *printer
+	// dial connects to another server with the same settings as conn.
+	dial func(addr string) (*kt.Conn, error)
+}
+
+var commands = map[string]*command{}
+
+func register(name string, cmd *command) {
+	commands[name] = cmd
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: ktctl [flags] <command> [arguments]\n\nflags:\n")
+	flag.PrintDefaults()
+	fmt.Fprintf(os.Stderr, "\ncommands:\n")
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  %-40s %s\n", name+" "+commands[name].usage, commands[name].help)
+	}
+}
+
+func main() {
+	host := flag.String("host", "127.0.0.1", "ktserver host")
+	port := flag.Int("port", 1978, "ktserver port")
+	timeout := flag.Duration("timeout", kt.DEFAULT_TIMEOUT, "timeout of each operation")
+	creds := flag.String("tls", "", "directory holding service.pem, service-key.pem and ca.pem to connect with TLS")
+	format := flag.String("format", "text", "output format: text, tsv or json")
+	flag.Usage = usage
+	flag.Parse()
+
+	if flag.NArg() == 0 {
+		usage()
+		os.Exit(2)
+	}
+	cmd, ok := commands[flag.Arg(0)]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "ktctl: unknown command %q\n", flag.Arg(0))
+		usage()
+		os.Exit(2)
+	}
+	out, err := newPrinter(os.Stdout, *format)
+	if err != nil {
+		fatal(err)
+	}
+
+	connect := func(host string, port int) (*kt.Conn, error) {
+		if *creds != "" {
+			return kt.NewConnTLS(host, port, 1, *timeout, *creds)
+		}
+		return kt.NewConn(host, port, 1, *timeout)
+	}
+	dial := func(addr string) (*kt.Conn, error) {
+		host, portstr, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		port, err := strconv.Atoi(portstr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid port in %q", addr)
+		}
+		return connect(host, port)
+	}
+	conn, err := connect(*host, *port)
+	if err != nil {
+		fatal(err)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	err = cmd.run(ctx, &env{conn: conn, out: out, dial: dial}, flag.Args()[1:])
+	stop()
+	if ferr := out.flush(); err == nil {
+		err = ferr
+	}
+	conn.Close(context.Background())
+	if err != nil {
+		fatal(err)
+	}
+}
+
+func fatal(err error) {
+	fmt.Fprintf(os.Stderr, "ktctl: %s\n", strings.TrimSpace(err.Error()))
+	os.Exit(1)
+}
+
+// parseArgs parses the flags of a subcommand and checks the number of
+// positional arguments left.
+func parseArgs(fs *flag.FlagSet, args []string, nargs int) ([]string, error) {
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	if fs.NArg() != nargs {
+		return nil, fmt.Errorf("%s: expected %d arguments, got %d", fs.Name(), nargs, fs.NArg())
+	}
+	return fs.Args(), nil
+}
+
+// notFoundOK turns the "no records" result of the match operations into
+// an empty result.
+func notFoundOK(keys []string, err error) ([]string, error) {
+	if err == kt.ErrSuccess {
+		return nil, nil
+	}
+	return keys, err
+}
+
+func init() {
+	register("get", &command{
+		usage: "<key>",
+		help:  "print the value stored at key",
+		run: func(ctx context.Context, e *env, args []string) error {
+			args, err := parseArgs(flag.NewFlagSet("get", flag.ContinueOnError), args, 1)
+			if err != nil {
+				return err
+			}
+			v, err := e.conn.GetBytes(ctx, args[0])
+			if err != nil {
+				return err
+			}
+			return e.out.value(args[0], v)
+		},
+	})
+	register("set", &command{
+		usage: "[-ttl duration] <key> <value|->",
+		help:  "store a value, read from stdin if -",
+		run: func(ctx context.Context, e *env, args []string) error {
+			fs := flag.NewFlagSet("set", flag.ContinueOnError)
+			ttl := fs.Duration("ttl", 0, "expire the record after this long")
+			args, err := parseArgs(fs, args, 2)
+			if err != nil {
+				return err
+			}
+			value := []byte(args[1])
+			if args[1] == "-" {
+				if value, err = ioutil.ReadAll(os.Stdin); err != nil {
+					return err
+				}
+			}
+			if *ttl > 0 {
+				return e.conn.SetWithExpiry(ctx, args[0], value, *ttl)
+			}
+			return e.conn.Set(ctx, args[0], value)
+		},
+	})
+	register("rm", &command{
+		usage: "<key>...",
+		help:  "remove records",
+		run: func(ctx context.Context, e *env, args []string) error {
+			if len(args) == 0 {
+				return fmt.Errorf("rm: no keys given")
+			}
+			if len(args) == 1 {
+				return e.conn.Remove(ctx, args[0])
+			}
+			n, err := e.conn.RemoveBulk(ctx, args)
+			if err != nil {
+				return err
+			}
+			return e.out.number("removed", n)
+		},
+	})
+	register("count", &command{
+		help: "print the number of records",
+		run: func(ctx context.Context, e *env, args []string) error {
+			if _, err := parseArgs(flag.NewFlagSet("count", flag.ContinueOnError), args, 0); err != nil {
+				return err
+			}
+			n, err := e.conn.Count(ctx)
+			if err != nil {
+				return err
+			}
+			return e.out.number("count", int64(n))
+		},
+	})
+	register("status", &command{
+		help: "print the database status",
+		run: func(ctx context.Context, e *env, args []string) error {
+			if _, err := parseArgs(flag.NewFlagSet("status", flag.ContinueOnError), args, 0); err != nil {
+				return err
+			}
+			status, err := e.conn.Status(ctx)
+			if err != nil {
+				return err
+			}
+			return e.out.fields(status)
+		},
+	})
+	register("match-prefix", &command{
+		usage: "[-max n] <prefix>",
+		help:  "list the keys starting with prefix",
+		run: func(ctx context.Context, e *env, args []string) error {
+			fs := flag.NewFlagSet("match-prefix", flag.ContinueOnError)
+			max := fs.Int64("max", 1000, "maximum number of keys, negative for no limit")
+			args, err := parseArgs(fs, args, 1)
+			if err != nil {
+				return err
+			}
+			keys, err := notFoundOK(e.conn.MatchPrefix(ctx, args[0], *max))
+			if err != nil {
+				return err
+			}
+			return e.out.keys(keys)
+		},
+	})
+	register("match-regex", &command{
+		usage: "[-max n] <regex>",
+		help:  "list the keys matching regex",
+		run: func(ctx context.Context, e *env, args []string) error {
+			fs := flag.NewFlagSet("match-regex", flag.ContinueOnError)
+			max := fs.Int64("max", 1000, "maximum number of keys, negative for no limit")
+			args, err := parseArgs(fs, args, 1)
+			if err != nil {
+				return err
+			}
+			keys, err := notFoundOK(e.conn.MatchRegex(ctx, args[0], *max))
+			if err != nil {
+				return err
+			}
+			return e.out.keys(keys)
+		},
+	})
+	register("bulk-get", &command{
+		usage: "[-batch n]",
+		help:  "print the records for the keys read from stdin, one per line",
+		run: func(ctx context.Context, e *env, args []string) error {
+			fs := flag.NewFlagSet("bulk-get", flag.ContinueOnError)
+			batch := fs.Int("batch", 500, "number of keys per request")
+			if _, err := parseArgs(fs, args, 0); err != nil {
+				return err
+			}
+			return bulkGet(ctx, e, os.Stdin, *batch)
+		},
+	})
+	register("watch", &command{
+		usage: "[-interval d] <key>",
+		help:  "poll key and print its value whenever it changes",
+		run: func(ctx context.Context, e *env, args []string) error {
+			fs := flag.NewFlagSet("watch", flag.ContinueOnError)
+			interval := fs.Duration("interval", time.Second, "polling interval")
+			args, err := parseArgs(fs, args, 1)
+			if err != nil {
+				return err
+			}
+			return watch(ctx, e, args[0], *interval)
+		},
+	})
+	register("dump", &command{
+		usage: "[-prefix p] [-z] [-o file]",
+		help:  "write the records to a portable dump",
+		run: func(ctx context.Context, e *env, args []string) error {
+			fs := flag.NewFlagSet("dump", flag.ContinueOnError)
+			prefix := fs.String("prefix", "", "only dump the keys starting with this prefix")
+			compress := fs.Bool("z", false, "gzip the dump")
+			out := fs.String("o", "", "write to this file instead of stdout")
+			if _, err := parseArgs(fs, args, 0); err != nil {
+				return err
+			}
+			return dump(ctx, e, *out, kt.DumpOptions{Prefix: *prefix, Compress: *compress})
+		},
+	})
+	register("restore", &command{
+		usage: "[-chunk n] [-skip n] [-i file]",
+		help:  "load the records of a dump",
+		run: func(ctx context.Context, e *env, args []string) error {
+			fs := flag.NewFlagSet("restore", flag.ContinueOnError)
+			chunk := fs.Int("chunk", 500, "number of records per request")
+			skip := fs.Int64("skip", 0, "skip this many records, to resume a restore")
+			in := fs.String("i", "", "read from this file instead of stdin")
+			if _, err := parseArgs(fs, args, 0); err != nil {
+				return err
+			}
+			return restore(ctx, e, *in, kt.RestoreOptions{ChunkSize: *chunk, Skip: *skip})
+		},
+	})
+	register("admin", &command{
+		usage: "[-nodes host:port,...] <action> [arguments]",
+		help:  "run an administration action, see ktctl admin -help",
+		run: func(ctx context.Context, e *env, args []string) error {
+			fs := flag.NewFlagSet("admin", flag.ContinueOnError)
+			nodes := fs.String("nodes", "", "comma separated servers to run the action on, instead of -host and -port")
+			fs.Usage = func() { adminUsage(fs) }
+			if err := fs.Parse(args); err != nil {
+				return err
+			}
+			if fs.NArg() == 0 {
+				adminUsage(fs)
+				return fmt.Errorf("admin: no action given")
+			}
+			return admin(ctx, e, *nodes, fs.Args())
+		},
+	})
+	register("compare", &command{
+		usage: "[-prefix p] [-repair] <host:port>",
+		help:  "list the records that differ on another server",
+		run: func(ctx context.Context, e *env, args []string) error {
+			fs := flag.NewFlagSet("compare", flag.ContinueOnError)
+			prefix := fs.String("prefix", "", "only compare the keys starting with this prefix")
+			repair := fs.Bool("repair", false, "make the other server match this one")
+			rangeSize := fs.Int("range", 4096, "average number of records per range")
+			args, err := parseArgs(fs, args, 1)
+			if err != nil {
+				return err
+			}
+			other, err := e.dial(args[0])
+			if err != nil {
+				return err
+			}
+			defer other.Close(context.Background())
+			return compare(ctx, e, other, kt.CompareOptions{
+				Prefix:    *prefix,
+				RangeSize: *rangeSize,
+				Repair:    *repair,
+			})
+		},
+	})
+}
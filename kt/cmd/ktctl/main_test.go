@@ -0,0 +1,30 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/cloudflare/golibs/kt"
+)
+
+func TestNotFoundOK(t *testing.T) {
+	boom := errors.New("boom")
+	var tests = []struct {
+		keys     []string
+		err      error
+		wantKeys []string
+		wantErr  error
+	}{
+		{[]string{"a", "b"}, nil, []string{"a", "b"}, nil},
+		{nil, kt.ErrSuccess, nil, nil},
+		{nil, kt.ErrNotFound, nil, kt.ErrNotFound},
+		{nil, boom, nil, boom},
+	}
+	for _, tt := range tests {
+		keys, err := notFoundOK(tt.keys, tt.err)
+		if !reflect.DeepEqual(keys, tt.wantKeys) || err != tt.wantErr {
+			t.Errorf("notFoundOK(%q, %v): want %q, %v, got %q, %v", tt.keys, tt.err, tt.wantKeys, tt.wantErr, keys, err)
+		}
+	}
+}
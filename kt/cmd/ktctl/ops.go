@@ -0,0 +1,355 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cloudflare/golibs/kt"
+)
+
+// bulkGet reads keys from r, one per line, and prints the records found
+// in batches of batch keys.
+func bulkGet(ctx context.Context, e *env, r io.Reader, batch int) error {
+	if batch <= 0 {
+		batch = 1
+	}
+	flush := func(keys map[string][]byte) error {
+		if len(keys) == 0 {
+			return nil
+		}
+		if err := e.conn.GetBulkBytes(ctx, keys); err != nil {
+			return err
+		}
+		sorted := make([]string, 0, len(keys))
+		for k := range keys {
+			sorted = append(sorted, k)
+		}
+		sort.Strings(sorted)
+		for _, k := range sorted {
+			if err := e.out.record(k, keys[k]); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	keys := make(map[string][]byte, batch)
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		if s.Text() == "" {
+			continue
+		}
+		keys[s.Text()] = nil
+		if len(keys) == batch {
+			if err := flush(keys); err != nil {
+				return err
+			}
+			keys = make(map[string][]byte, batch)
+		}
+	}
+	if err := s.Err(); err != nil {
+		return err
+	}
+	return flush(keys)
+}
+
+// watch polls key every interval and prints its value whenever it
+// changes, until ctx is cancelled.
+func watch(ctx context.Context, e *env, key string, interval time.Duration) error {
+	var last []byte
+	var found, first = false, true
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		v, err := e.conn.GetBytes(ctx, key)
+		switch {
+		case err == kt.ErrNotFound:
+			if found || first {
+				if err := e.out.missing(key); err != nil {
+					return err
+				}
+			}
+			found = false
+		case err != nil:
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		default:
+			if !found || !bytes.Equal(v, last) {
+				if err := e.out.record(key, v); err != nil {
+					return err
+				}
+			}
+			found, last = true, v
+		}
+		first = false
+		if err := e.out.flush(); err != nil {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-t.C:
+		}
+	}
+}
+
+// dump writes the records under prefix to the file at path, or to
+// stdout if path is empty, and reports the count on stderr.
+func dump(ctx context.Context, e *env, path string, opts kt.DumpOptions) error {
+	f := os.Stdout
+	if path != "" {
+		var err error
+		if f, err = os.Create(path); err != nil {
+			return err
+		}
+		defer f.Close()
+	}
+	bw := bufio.NewWriter(f)
+	n, err := kt.Dump(ctx, e.conn, bw, opts)
+	if err != nil {
+		return err
+	}
+	if err := bw.Flush(); err != nil {
+		return err
+	}
+	if f != os.Stdout {
+		if err := f.Close(); err != nil {
+			return err
+		}
+	}
+	fmt.Fprintf(os.Stderr, "dumped %d records\n", n)
+	return nil
+}
+
+// restore replays the dump read from the file at path, or from stdin if
+// path is empty. Progress goes to stderr so that a failed restore can be
+// resumed with -skip.
+func restore(ctx context.Context, e *env, path string, opts kt.RestoreOptions) error {
+	r := io.Reader(os.Stdin)
+	if path != "" {
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	}
+	opts.Progress = func(processed int64) {
+		fmt.Fprintf(os.Stderr, "\rrestored %d records", processed)
+	}
+	n, err := kt.Restore(ctx, e.conn, bufio.NewReader(r), opts)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return fmt.Errorf("%s (resume with -skip %d)", err, n)
+	}
+	return nil
+}
+
+// compare prints the records that differ between the server of e and
+// other, and a summary on stderr.
+func compare(ctx context.Context, e *env, other *kt.Conn, opts kt.CompareOptions) error {
+	var err error
+	opts.OnDiff = func(d kt.Diff) {
+		if err == nil {
+			err = e.out.record(d.Key, []byte(d.Kind.String()))
+		}
+	}
+	stats, cerr := kt.Compare(ctx, e.conn, other, opts)
+	if cerr != nil {
+		return cerr
+	}
+	fmt.Fprintf(os.Stderr, "%d missing, %d extra, %d differing\n", stats.Missing, stats.Extra, stats.Differing)
+	return err
+}
+
+// adminAction is an action of the admin command, run on every node.
+type adminAction struct {
+	usage string
+	help  string
+	// parse returns the function running the action on a node.
+	parse func(args []string) (func(ctx context.Context, e *env, node string, conn *kt.Conn) error, error)
+}
+
+var adminActions = map[string]*adminAction{
+	"clear": {
+		usage: "-yes",
+		help:  "remove all the records",
+		parse: func(args []string) (func(context.Context, *env, string, *kt.Conn) error, error) {
+			fs := flag.NewFlagSet("clear", flag.ContinueOnError)
+			yes := fs.Bool("yes", false, "confirm that all the records should be removed")
+			if _, err := parseArgs(fs, args, 0); err != nil {
+				return nil, err
+			}
+			if !*yes {
+				return nil, fmt.Errorf("clear: refusing to remove all the records without -yes")
+			}
+			return func(ctx context.Context, e *env, node string, conn *kt.Conn) error {
+				return conn.Clear(ctx)
+			}, nil
+		},
+	},
+	"sync": {
+		usage: "[-hard] [-command name]",
+		help:  "write the database to disk",
+		parse: func(args []string) (func(context.Context, *env, string, *kt.Conn) error, error) {
+			fs := flag.NewFlagSet("sync", flag.ContinueOnError)
+			var opts kt.SyncOptions
+			fs.BoolVar(&opts.Hard, "hard", false, "synchronize with the storage device")
+			fs.StringVar(&opts.Command, "command", "", "postprocessing command run by the server on each file")
+			if _, err := parseArgs(fs, args, 0); err != nil {
+				return nil, err
+			}
+			return func(ctx context.Context, e *env, node string, conn *kt.Conn) error {
+				return conn.Synchronize(ctx, opts)
+			}, nil
+		},
+	},
+	"vacuum": {
+		usage: "[-step n]",
+		help:  "reclaim the space of removed records",
+		parse: func(args []string) (func(context.Context, *env, string, *kt.Conn) error, error) {
+			fs := flag.NewFlagSet("vacuum", flag.ContinueOnError)
+			step := fs.Int64("step", 0, "number of steps, 0 for the whole database")
+			if _, err := parseArgs(fs, args, 0); err != nil {
+				return nil, err
+			}
+			return func(ctx context.Context, e *env, node string, conn *kt.Conn) error {
+				return conn.Vacuum(ctx, *step)
+			}, nil
+		},
+	},
+	"replicate": {
+		usage: "[-ts n|now] [-iv d] [host:port]",
+		help:  "replicate from a master, or stop replicating without one",
+		parse: func(args []string) (func(context.Context, *env, string, *kt.Conn) error, error) {
+			fs := flag.NewFlagSet("replicate", flag.ContinueOnError)
+			ts := fs.String("ts", "", "timestamp of the last update already replicated, or now")
+			iv := fs.Duration("iv", 0, "interval between replication operations")
+			if err := fs.Parse(args); err != nil {
+				return nil, err
+			}
+			if fs.NArg() > 1 {
+				return nil, fmt.Errorf("replicate: expected at most 1 argument, got %d", fs.NArg())
+			}
+			opts := kt.ReplicationOptions{Interval: *iv}
+			if fs.NArg() == 1 {
+				host, port, err := net.SplitHostPort(fs.Arg(0))
+				if err != nil {
+					return nil, err
+				}
+				opts.Host = host
+				if opts.Port, err = strconv.Atoi(port); err != nil {
+					return nil, fmt.Errorf("invalid port in %q", fs.Arg(0))
+				}
+			}
+			switch *ts {
+			case "":
+			case "now":
+				opts.FromNow = true
+			default:
+				var err error
+				if opts.Timestamp, err = strconv.ParseUint(*ts, 10, 64); err != nil {
+					return nil, fmt.Errorf("invalid timestamp %q", *ts)
+				}
+			}
+			return func(ctx context.Context, e *env, node string, conn *kt.Conn) error {
+				return conn.TuneReplication(ctx, opts)
+			}, nil
+		},
+	},
+	"ulogs": {
+		help: "list the update log files with their size and last timestamp",
+		parse: func(args []string) (func(context.Context, *env, string, *kt.Conn) error, error) {
+			if _, err := parseArgs(flag.NewFlagSet("ulogs", flag.ContinueOnError), args, 0); err != nil {
+				return nil, err
+			}
+			return func(ctx context.Context, e *env, node string, conn *kt.Conn) error {
+				logs, err := conn.UpdateLogs(ctx)
+				if err != nil {
+					return err
+				}
+				for _, l := range logs {
+					path := l.Path
+					if node != "" {
+						path = node + ":" + path
+					}
+					if err := e.out.record(path, []byte(fmt.Sprintf("%d %d", l.Size, l.Timestamp))); err != nil {
+						return err
+					}
+				}
+				return nil
+			}, nil
+		},
+	},
+	"ulog-rm": {
+		usage: "[-ts n]",
+		help:  "remove the update logs older than a timestamp, by default now",
+		parse: func(args []string) (func(context.Context, *env, string, *kt.Conn) error, error) {
+			fs := flag.NewFlagSet("ulog-rm", flag.ContinueOnError)
+			ts := fs.Uint64("ts", 0, "timestamp of the newest update that may be removed, 0 for now")
+			if _, err := parseArgs(fs, args, 0); err != nil {
+				return nil, err
+			}
+			return func(ctx context.Context, e *env, node string, conn *kt.Conn) error {
+				return conn.RemoveUpdateLogs(ctx, *ts)
+			}, nil
+		},
+	},
+}
+
+func adminUsage(fs *flag.FlagSet) {
+	fmt.Fprintf(os.Stderr, "usage: ktctl admin [-nodes host:port,...] <action> [arguments]\n\nflags:\n")
+	fs.PrintDefaults()
+	fmt.Fprintf(os.Stderr, "\nactions:\n")
+	names := make([]string, 0, len(adminActions))
+	for name := range adminActions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  %-40s %s\n", name+" "+adminActions[name].usage, adminActions[name].help)
+	}
+}
+
+// admin runs an administration action on the server of e, or on each of
+// the comma separated nodes in turn. Nodes are reported on stderr as they
+// complete; the first failure stops the run.
+func admin(ctx context.Context, e *env, nodes string, args []string) error {
+	action, ok := adminActions[args[0]]
+	if !ok {
+		return fmt.Errorf("admin: unknown action %q", args[0])
+	}
+	run, err := action.parse(args[1:])
+	if err != nil {
+		return err
+	}
+	if nodes == "" {
+		return run(ctx, e, "", e.conn)
+	}
+	for _, node := range strings.Split(nodes, ",") {
+		conn, err := e.dial(node)
+		if err != nil {
+			return fmt.Errorf("%s: %s", node, err)
+		}
+		err = run(ctx, e, node, conn)
+		conn.Close(context.Background())
+		if err != nil {
+			return fmt.Errorf("%s: %s", node, strings.TrimSpace(err.Error()))
+		}
+		fmt.Fprintf(os.Stderr, "%s: %s done\n", node, args[0])
+	}
+	return nil
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"unicode/utf8"
+
+	"github.com/cloudflare/golibs/kt"
+)
+
+// printer writes results in one of the supported output formats:
+//
+//	text: human readable, values quoted when they are not printable
+//	tsv:  one record per line, fields URL encoded as in KT's colenc=U
+//	json: one JSON object per line
+type printer struct {
+	w      *bufio.Writer
+	format string
+	tsv    *kt.TSVEncoder
+	json   *json.Encoder
+}
+
+func newPrinter(w io.Writer, format string) (*printer, error) {
+	p := &printer{w: bufio.NewWriter(w), format: format}
+	switch format {
+	case "text":
+	case "tsv":
+		p.tsv = kt.NewTSVEncoder(p.w, kt.URLEnc)
+	case "json":
+		p.json = json.NewEncoder(p.w)
+	default:
+		return nil, fmt.Errorf("unknown output format %q", format)
+	}
+	return p, nil
+}
+
+func (p *printer) flush() error {
+	return p.w.Flush()
+}
+
+// jsonRecord represents a record in JSON output. Values that are not
+// valid UTF-8 are base64 encoded in ValueBase64 instead of Value.
+type jsonRecord struct {
+	Key         string  `json:"key"`
+	Value       *string `json:"value,omitempty"`
+	ValueBase64 []byte  `json:"value_base64,omitempty"`
+	Found       *bool   `json:"found,omitempty"`
+}
+
+func newJSONRecord(key string, value []byte) jsonRecord {
+	r := jsonRecord{Key: key}
+	if utf8.Valid(value) {
+		s := string(value)
+		r.Value = &s
+	} else {
+		r.ValueBase64 = value
+	}
+	return r
+}
+
+func printable(b []byte) bool {
+	s := string(b)
+	return utf8.ValidString(s) && strconv.Quote(s) == `"`+s+`"`
+}
+
+// value prints the result of a single lookup. In text mode only the
+// value itself is printed, so that it can be piped into other tools.
+func (p *printer) value(key string, value []byte) error {
+	if p.format == "text" {
+		p.w.Write(value)
+		if len(value) == 0 || value[len(value)-1] != '\n' {
+			p.w.WriteByte('\n')
+		}
+		return nil
+	}
+	return p.record(key, value)
+}
+
+// record prints a key and its value.
+func (p *printer) record(key string, value []byte) error {
+	switch p.format {
+	case "tsv":
+		return p.tsv.Encode(kt.KV{Key: key, Value: value})
+	case "json":
+		return p.json.Encode(newJSONRecord(key, value))
+	}
+	v := string(value)
+	if !printable(value) {
+		v = strconv.Quote(v)
+	}
+	_, err := fmt.Fprintf(p.w, "%s\t%s\n", key, v)
+	return err
+}
+
+// missing prints that key does not exist.
+func (p *printer) missing(key string) error {
+	switch p.format {
+	case "tsv":
+		return p.tsv.Encode(kt.KV{Key: key})
+	case "json":
+		found := false
+		return p.json.Encode(jsonRecord{Key: key, Found: &found})
+	}
+	_, err := fmt.Fprintf(p.w, "%s\t(not found)\n", key)
+	return err
+}
+
+// keys prints a list of keys.
+func (p *printer) keys(keys []string) error {
+	if p.format == "json" {
+		if keys == nil {
+			keys = []string{}
+		}
+		return p.json.Encode(keys)
+	}
+	for _, k := range keys {
+		var err error
+		if p.format == "tsv" {
+			err = p.tsv.EncodeKey(k)
+		} else {
+			_, err = fmt.Fprintln(p.w, k)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// number prints a named integer result.
+func (p *printer) number(name string, n int64) error {
+	switch p.format {
+	case "json":
+		return p.json.Encode(map[string]int64{name: n})
+	case "tsv":
+		_, err := fmt.Fprintf(p.w, "%s\t%d\n", name, n)
+		return err
+	}
+	_, err := fmt.Fprintln(p.w, n)
+	return err
+}
+
+// fields prints a set of named string values, sorted by name.
+func (p *printer) fields(m map[string]string) error {
+	if p.format == "json" {
+		return p.json.Encode(m)
+	}
+	names := make([]string, 0, len(m))
+	for k := range m {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	for _, k := range names {
+		if err := p.record(k, []byte(m[k])); err != nil {
+			return err
+		}
+	}
+	return nil
+}
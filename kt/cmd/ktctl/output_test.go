@@ -0,0 +1,60 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestPrinter(t *testing.T) {
+	var tests = []struct {
+		format string
+		print  func(p *printer) error
+		want   string
+	}{
+		{"text", func(p *printer) error { return p.value("k", []byte("v")) }, "v\n"},
+		{"text", func(p *printer) error { return p.value("k", []byte("v\n")) }, "v\n"},
+		{"text", func(p *printer) error { return p.record("k", []byte("a\x00")) }, "k\t\"a\\x00\"\n"},
+		{"text", func(p *printer) error { return p.missing("k") }, "k\t(not found)\n"},
+		{"text", func(p *printer) error { return p.keys([]string{"a", "b c"}) }, "a\nb c\n"},
+		{"text", func(p *printer) error { return p.number("count", 3) }, "3\n"},
+		{"text", func(p *printer) error { return p.fields(map[string]string{"b": "2", "a": "1"}) }, "a\t1\nb\t2\n"},
+
+		{"tsv", func(p *printer) error { return p.value("k", []byte("v")) }, "k\tv\n"},
+		{"tsv", func(p *printer) error { return p.record("a b", []byte{0, '\t'}) }, "a b\t%00%09\n"},
+		{"tsv", func(p *printer) error { return p.missing("k") }, "k\t\n"},
+		{"tsv", func(p *printer) error { return p.keys([]string{"a", "b\n%+"}) }, "a\nb%0A%25%2B\n"},
+		{"tsv", func(p *printer) error { return p.number("count", 3) }, "count\t3\n"},
+		{"tsv", func(p *printer) error { return p.fields(map[string]string{"b": "2", "a": "1"}) }, "a\t1\nb\t2\n"},
+
+		{"json", func(p *printer) error { return p.value("k", []byte("v")) }, `{"key":"k","value":"v"}` + "\n"},
+		{"json", func(p *printer) error { return p.record("k", []byte{0xff}) }, `{"key":"k","value_base64":"/w=="}` + "\n"},
+		{"json", func(p *printer) error { return p.missing("k") }, `{"key":"k","found":false}` + "\n"},
+		{"json", func(p *printer) error { return p.keys(nil) }, "[]\n"},
+		{"json", func(p *printer) error { return p.keys([]string{"a", "b"}) }, `["a","b"]` + "\n"},
+		{"json", func(p *printer) error { return p.number("count", 3) }, `{"count":3}` + "\n"},
+		{"json", func(p *printer) error { return p.fields(map[string]string{"b": "2", "a": "1"}) }, `{"a":"1","b":"2"}` + "\n"},
+	}
+	for i, tt := range tests {
+		var buf bytes.Buffer
+		p, err := newPrinter(&buf, tt.format)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := tt.print(p); err != nil {
+			t.Errorf("%d (%s): %v", i, tt.format, err)
+			continue
+		}
+		if err := p.flush(); err != nil {
+			t.Fatal(err)
+		}
+		if got := buf.String(); got != tt.want {
+			t.Errorf("%d (%s): want %q, got %q", i, tt.format, tt.want, got)
+		}
+	}
+}
+
+func TestNewPrinterUnknownFormat(t *testing.T) {
+	if _, err := newPrinter(&bytes.Buffer{}, "xml"); err == nil {
+		t.Error("newPrinter accepted an unknown format")
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cloudflare/golibs/kt"
+)
+
+// A capture is a TSV stream, base64 encoded, of one record per request.
+// The first record is a header
+//
+//	"ktproxy-capture"	<version>
+//
+// and the key of the following ones holds the request metadata
+//
+//	<offset> <duration> <status> <method> <request URI> [<content type>]
+//
+// separated by spaces, with the offset since the start of the capture
+// and the duration in nanoseconds, while the value is the request body.
+// The status is 0 for requests that got no response. Records are
+// appended as requests complete, so they are not in the order of their
+// offsets when requests overlap.
+const (
+	captureMagic   = "ktproxy-capture"
+	captureVersion = "1"
+)
+
+// exchange is a request seen by the proxy, and how it went.
+type exchange struct {
+	offset      time.Duration
+	duration    time.Duration
+	status      int
+	method      string
+	uri         string
+	contentType string
+	body        []byte
+}
+
+func (x *exchange) encode() kt.KV {
+	meta := fmt.Sprintf("%d %d %d %s %s", x.offset, x.duration, x.status, x.method, x.uri)
+	if x.contentType != "" {
+		meta += " " + x.contentType
+	}
+	return kt.KV{Key: meta, Value: x.body}
+}
+
+func decodeExchange(kv kt.KV) (*exchange, error) {
+	fields := strings.SplitN(kv.Key, " ", 6)
+	if len(fields) < 5 {
+		return nil, fmt.Errorf("malformed capture record %q", kv.Key)
+	}
+	var nums [3]int64
+	for i := range nums {
+		n, err := strconv.ParseInt(fields[i], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("malformed capture record %q", kv.Key)
+		}
+		nums[i] = n
+	}
+	x := &exchange{
+		offset:   time.Duration(nums[0]),
+		duration: time.Duration(nums[1]),
+		status:   int(nums[2]),
+		method:   fields[3],
+		uri:      fields[4],
+		body:     kv.Value,
+	}
+	if len(fields) == 6 {
+		x.contentType = fields[5]
+	}
+	return x, nil
+}
+
+// recorder appends exchanges to a capture. It is safe for concurrent
+// use.
+type recorder struct {
+	mu    sync.Mutex
+	w     *bufio.Writer
+	enc   *kt.TSVEncoder
+	start time.Time
+	n     int
+	err   error
+}
+
+func newRecorder(w io.Writer, start time.Time) (*recorder, error) {
+	bw := bufio.NewWriter(w)
+	r := &recorder{w: bw, enc: kt.NewTSVEncoder(bw, kt.Base64Enc), start: start}
+	if err := r.enc.Encode(kt.KV{Key: captureMagic, Value: []byte(captureVersion)}); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// record appends x to the capture. The first error is kept, and
+// reported by flush.
+func (r *recorder) record(x *exchange) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.err != nil {
+		return
+	}
+	r.err = r.enc.Encode(x.encode())
+	r.n++
+}
+
+func (r *recorder) flush() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.err != nil {
+		return r.err
+	}
+	r.err = r.w.Flush()
+	return r.err
+}
+
+// readCapture reads all the exchanges of a capture, sorted by offset.
+func readCapture(rd io.Reader) ([]*exchange, error) {
+	dec := kt.NewTSVDecoder(rd, kt.Base64Enc)
+	header, err := dec.Decode()
+	if err == io.EOF || err == nil && header.Key != captureMagic {
+		return nil, fmt.Errorf("not a ktproxy capture")
+	}
+	if err != nil {
+		return nil, err
+	}
+	if string(header.Value) != captureVersion {
+		return nil, fmt.Errorf("unsupported capture version %q", header.Value)
+	}
+	var xs []*exchange
+	for {
+		kv, err := dec.Decode()
+		if err == io.EOF {
+			sort.SliceStable(xs, func(i, j int) bool { return xs[i].offset < xs[j].offset })
+			return xs, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		x, err := decodeExchange(kv)
+		if err != nil {
+			return nil, err
+		}
+		xs = append(xs, x)
+	}
+}
@@ -0,0 +1,161 @@
+// Command ktproxy sits between clients and a Kyoto Tycoon server,
+// forwarding their REST and RPC requests and optionally recording them
+// with their timings to a capture file. The capture can then be replayed
+// against another server, at its original pace or scaled, to benchmark
+// it with real traffic or reproduce an incident.
+//
+//	ktproxy serve [flags]
+//	ktproxy replay [flags] <capture>
+//
+// For instance, to record the traffic of clients pointed at port 1979 of
+// the proxy, then replay it twice as fast against a staging server:
+//
+//	ktproxy serve -listen :1979 -target kt1:1978 -record traffic.ktcap
+//	ktproxy replay -target staging:1978 -speed 2 traffic.ktcap
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"time"
+)
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage:\n  ktproxy serve [flags]\n  ktproxy replay [flags] <capture>\n\nRun ktproxy <command> -help for the flags of each command.\n")
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	var err error
+	switch os.Args[1] {
+	case "serve":
+		err = serveMain(ctx, os.Args[2:])
+	case "replay":
+		err = replayMain(ctx, os.Args[2:])
+	default:
+		fmt.Fprintf(os.Stderr, "ktproxy: unknown command %q\n", os.Args[1])
+		usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		fatal(err)
+	}
+}
+
+func fatal(err error) {
+	fmt.Fprintf(os.Stderr, "ktproxy: %s\n", strings.TrimSpace(err.Error()))
+	os.Exit(1)
+}
+
+func newTransport(poolsize int, timeout time.Duration) *http.Transport {
+	return &http.Transport{
+		DialContext:           (&net.Dialer{Timeout: timeout, KeepAlive: 30 * time.Second}).DialContext,
+		ResponseHeaderTimeout: timeout,
+		MaxIdleConnsPerHost:   poolsize,
+		IdleConnTimeout:       30 * time.Second,
+	}
+}
+
+func serveMain(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	listen := fs.String("listen", ":1979", "address to listen on")
+	target := fs.String("target", "127.0.0.1:1978", "host:port of the ktserver")
+	record := fs.String("record", "", "file to record the requests to")
+	timeout := fs.Duration("timeout", 10*time.Second, "timeout of the ktserver responses")
+	poolsize := fs.Int("poolsize", 64, "idle connections kept to the ktserver")
+	fs.Parse(args)
+
+	p := &proxy{target: *target, transport: newTransport(*poolsize, *timeout)}
+	if *record != "" {
+		f, err := os.OpenFile(*record, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		if p.rec, err = newRecorder(f, time.Now()); err != nil {
+			return err
+		}
+		// Keep the capture mostly up to date in case the proxy dies.
+		go func() {
+			t := time.NewTicker(time.Second)
+			defer t.Stop()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-t.C:
+					p.rec.flush()
+				}
+			}
+		}()
+	}
+
+	srv := &http.Server{Addr: *listen, Handler: p}
+	errc := make(chan error, 1)
+	go func() { errc <- srv.ListenAndServe() }()
+	fmt.Fprintf(os.Stderr, "forwarding %s to %s\n", *listen, *target)
+	select {
+	case err := <-errc:
+		return err
+	case <-ctx.Done():
+	}
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+	err := srv.Shutdown(shutdownCtx)
+	if p.rec != nil {
+		if ferr := p.rec.flush(); err == nil {
+			err = ferr
+		}
+		fmt.Fprintf(os.Stderr, "recorded %d requests to %s\n", p.rec.n, *record)
+	}
+	if errors.Is(err, http.ErrServerClosed) {
+		err = nil
+	}
+	return err
+}
+
+func replayMain(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("replay", flag.ExitOnError)
+	target := fs.String("target", "127.0.0.1:1978", "host:port of the ktserver")
+	speed := fs.Float64("speed", 1, "pace of the replay relative to the capture; 0 replays as fast as possible")
+	concurrency := fs.Int("c", 64, "maximum number of requests in flight")
+	timeout := fs.Duration("timeout", 10*time.Second, "timeout of the ktserver responses")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		return fmt.Errorf("usage: ktproxy replay [flags] <capture>")
+	}
+	if *speed < 0 || *concurrency < 1 {
+		return fmt.Errorf("-speed must not be negative and -c must be positive")
+	}
+
+	f, err := os.Open(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	xs, err := readCapture(f)
+	f.Close()
+	if err != nil {
+		return err
+	}
+	start := time.Now()
+	results := replay(ctx, xs, replayOptions{
+		target:      *target,
+		transport:   newTransport(*concurrency, *timeout),
+		speed:       *speed,
+		concurrency: *concurrency,
+	})
+	report(os.Stdout, results, time.Since(start))
+	return ctx.Err()
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// hopHeaders are the headers meant for a single connection, which are
+// not forwarded.
+var hopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Proxy-Connection",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+func copyHeader(dst, src http.Header) {
+	for k, vs := range src {
+		dst[k] = append([]string(nil), vs...)
+	}
+	for _, h := range hopHeaders {
+		dst.Del(h)
+	}
+}
+
+// proxy forwards the requests it serves to a ktserver, and records them
+// if rec is not nil.
+type proxy struct {
+	target    string
+	transport http.RoundTripper
+	rec       *recorder
+}
+
+// upstreamRequest builds the request sent to the ktserver at target.
+// The request URI is kept as is, rather than parsed and escaped again,
+// since the keys of REST requests are escaped as KT expects them.
+func upstreamRequest(target, method, uri string, header http.Header, body []byte) *http.Request {
+	req := &http.Request{
+		Method:        method,
+		URL:           &url.URL{Scheme: "http", Host: target, Opaque: uri},
+		Host:          target,
+		Header:        header,
+		ContentLength: int64(len(body)),
+	}
+	if body != nil {
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+	return req
+}
+
+func (p *proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	header := make(http.Header)
+	copyHeader(header, r.Header)
+	req := upstreamRequest(p.target, r.Method, r.RequestURI, header, body)
+	resp, err := p.transport.RoundTrip(req.WithContext(r.Context()))
+	x := &exchange{
+		method:      r.Method,
+		uri:         r.RequestURI,
+		contentType: r.Header.Get("Content-Type"),
+		body:        body,
+	}
+	if p.rec != nil {
+		x.offset = start.Sub(p.rec.start)
+		defer func() {
+			x.duration = time.Since(start)
+			p.rec.record(x)
+		}()
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+	x.status = resp.StatusCode
+	copyHeader(w.Header(), resp.Header)
+	w.WriteHeader(resp.StatusCode)
+	io.Copy(w, resp.Body)
+}
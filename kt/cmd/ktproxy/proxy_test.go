@@ -0,0 +1,236 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cloudflare/golibs/kt"
+)
+
+// backend is a minimal ktserver, storing records set over REST and
+// logging the requests it gets.
+type backend struct {
+	mu   sync.Mutex
+	recs map[string][]byte
+	log  []string
+}
+
+func (b *backend) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.log = append(b.log, r.Method+" "+r.RequestURI+" "+string(body))
+	switch r.Method {
+	case "POST":
+		// Only /rpc/void is used.
+		w.Header().Set("Content-Type", "text/tab-separated-values")
+	case "PUT":
+		b.recs[r.RequestURI] = body
+		w.WriteHeader(201)
+	case "GET":
+		v, ok := b.recs[r.RequestURI]
+		if !ok {
+			w.WriteHeader(404)
+			return
+		}
+		w.Write(v)
+	}
+}
+
+func startBackend(t *testing.T) (*backend, string) {
+	b := &backend{recs: make(map[string][]byte)}
+	srv := httptest.NewServer(b)
+	t.Cleanup(srv.Close)
+	return b, srv.Listener.Addr().String()
+}
+
+func TestRecordReplay(t *testing.T) {
+	ctx := context.Background()
+	b1, addr1 := startBackend(t)
+	var capture bytes.Buffer
+	rec, err := newRecorder(&capture, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := httptest.NewServer(&proxy{target: addr1, transport: newTransport(4, time.Second), rec: rec})
+	defer p.Close()
+
+	host, portstr, _ := net.SplitHostPort(p.Listener.Addr().String())
+	port, _ := strconv.Atoi(portstr)
+	db, err := kt.NewConn(host, port, 1, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close(ctx)
+	if err := db.Set(ctx, "a key/with+escapes", []byte("v\x00\t\n")); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := db.GetBytes(ctx, "a key/with+escapes"); err != nil || string(v) != "v\x00\t\n" {
+		t.Fatalf("Get through the proxy: %q, %v", v, err)
+	}
+	if _, err := db.Get(ctx, "missing"); err != kt.ErrNotFound {
+		t.Fatalf("Get of a missing key: %v", err)
+	}
+	if err := rec.flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	xs, err := readCapture(&capture)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(xs) != 4 {
+		t.Fatalf("captured %d requests, want 4", len(xs))
+	}
+	for i, want := range []struct {
+		method string
+		status int
+	}{{"POST", 200}, {"PUT", 201}, {"GET", 200}, {"GET", 404}} {
+		if x := xs[i]; x.method != want.method || x.status != want.status {
+			t.Errorf("request %d: got %s %d, want %s %d", i, x.method, x.status, want.method, want.status)
+		}
+		if i > 0 && xs[i].offset < xs[i-1].offset {
+			t.Errorf("request %d captured before request %d", i, i-1)
+		}
+	}
+	if string(xs[1].body) != "v\x00\t\n" {
+		t.Errorf("captured body %q", xs[1].body)
+	}
+
+	b2, addr2 := startBackend(t)
+	results := replay(ctx, xs, replayOptions{target: addr2, transport: newTransport(1, time.Second), concurrency: 1})
+	for i, r := range results {
+		if r.err != nil || r.status != r.x.status {
+			t.Errorf("replay of request %d: %d, %v", i, r.status, r.err)
+		}
+	}
+	b1.mu.Lock()
+	b2.mu.Lock()
+	defer b1.mu.Unlock()
+	defer b2.mu.Unlock()
+	if len(b1.log) != len(b2.log) {
+		t.Fatalf("replayed %d requests, want %d", len(b2.log), len(b1.log))
+	}
+	for i := range b1.log {
+		if b1.log[i] != b2.log[i] {
+			t.Errorf("request %d: replayed %q, want %q", i, b2.log[i], b1.log[i])
+		}
+	}
+}
+
+func TestOverlappingRequests(t *testing.T) {
+	b := &backend{recs: make(map[string][]byte)}
+	slow := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.RequestURI == "/slow" {
+			time.Sleep(100 * time.Millisecond)
+		}
+		b.ServeHTTP(w, r)
+	})
+	srv := httptest.NewServer(slow)
+	defer srv.Close()
+	var capture bytes.Buffer
+	rec, err := newRecorder(&capture, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := httptest.NewServer(&proxy{target: srv.Listener.Addr().String(), transport: newTransport(2, time.Second), rec: rec})
+	defer p.Close()
+
+	// The slow request starts first and completes last.
+	var wg sync.WaitGroup
+	for i, uri := range []string{"/slow", "/fast"} {
+		wg.Add(1)
+		go func(uri string) {
+			defer wg.Done()
+			resp, err := http.Get(p.URL + uri)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			resp.Body.Close()
+		}(uri)
+		if i == 0 {
+			time.Sleep(20 * time.Millisecond)
+		}
+	}
+	wg.Wait()
+	if err := rec.flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	xs, err := readCapture(&capture)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(xs) != 2 {
+		t.Fatalf("captured %d requests, want 2", len(xs))
+	}
+	if xs[0].uri != "/slow" || xs[0].offset > xs[1].offset {
+		t.Fatalf("capture not sorted by offset: %s at %v, %s at %v", xs[0].uri, xs[0].offset, xs[1].uri, xs[1].offset)
+	}
+
+	b2, addr := startBackend(t)
+	results := replay(context.Background(), xs, replayOptions{target: addr, transport: newTransport(2, time.Second), speed: 1, concurrency: 2})
+	for i, r := range results {
+		if r.err != nil || r.late > 50*time.Millisecond {
+			t.Errorf("replay of request %d: late by %v, %v", i, r.late, r.err)
+		}
+	}
+	b2.mu.Lock()
+	defer b2.mu.Unlock()
+	if len(b2.log) != 2 || b2.log[0] != "GET /slow " {
+		t.Errorf("replayed %q, want /slow first", b2.log)
+	}
+}
+
+func TestReplaySpeed(t *testing.T) {
+	_, addr := startBackend(t)
+	xs := []*exchange{
+		{offset: time.Second, method: "GET", uri: "/a", status: 404},
+		{offset: time.Second + 100*time.Millisecond, method: "GET", uri: "/b", status: 404},
+	}
+	start := time.Now()
+	results := replay(context.Background(), xs, replayOptions{target: addr, transport: newTransport(1, time.Second), speed: 2, concurrency: 1})
+	if d := time.Since(start); d < 50*time.Millisecond || d > time.Second {
+		t.Errorf("replay at twice the speed took %v, want about 50ms", d)
+	}
+	if len(results) != 2 || results[1].err != nil {
+		t.Errorf("results: %+v", results)
+	}
+}
+
+func TestReplayCanceled(t *testing.T) {
+	_, addr := startBackend(t)
+	xs := []*exchange{
+		{offset: 0, method: "GET", uri: "/a", status: 404},
+		{offset: 0, method: "GET", uri: "/b", status: 404},
+		{offset: time.Minute, method: "GET", uri: "/c", status: 404},
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	results := replay(ctx, xs, replayOptions{target: addr, transport: newTransport(2, time.Second), speed: 1, concurrency: 2})
+	if len(results) != 2 {
+		t.Fatalf("replayed %d requests before the cancellation, want 2", len(results))
+	}
+	for i, r := range results {
+		if r.x != xs[i] || r.err != nil || r.status != 404 {
+			t.Errorf("request %d: %+v", i, r)
+		}
+	}
+}
+
+func TestReadCaptureErrors(t *testing.T) {
+	for _, s := range []string{"", "bm90IGEgY2FwdHVyZQ==\tMQ==\n"} {
+		if _, err := readCapture(bytes.NewBufferString(s)); err == nil {
+			t.Errorf("%q: no error", s)
+		}
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// replayResult is the outcome of replaying one exchange.
+type replayResult struct {
+	x        *exchange
+	status   int
+	duration time.Duration
+	late     time.Duration
+	err      error
+}
+
+// replayOptions configures replay.
+type replayOptions struct {
+	target    string
+	transport http.RoundTripper
+	// speed scales the pace of the capture: 2 replays it twice as fast.
+	// Zero sends every request as soon as possible.
+	speed float64
+	// concurrency caps the requests in flight.
+	concurrency int
+}
+
+// replay issues the requests of a capture against a ktserver, at the
+// pace they were captured, scaled by speed. Requests are sent late when
+// concurrency requests are already in flight. If ctx is done, replay
+// returns the results of the requests sent so far once they complete.
+func replay(ctx context.Context, xs []*exchange, opts replayOptions) []replayResult {
+	results := make([]replayResult, len(xs))
+	sem := make(chan struct{}, opts.concurrency)
+	var wg sync.WaitGroup
+	start := time.Now()
+	var base time.Duration
+	if len(xs) > 0 {
+		base = xs[0].offset
+	}
+	for i, x := range xs {
+		var due time.Time
+		if opts.speed > 0 {
+			due = start.Add(time.Duration(float64(x.offset-base) / opts.speed))
+			if d := time.Until(due); d > 0 {
+				select {
+				case <-time.After(d):
+				case <-ctx.Done():
+				}
+			}
+		}
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			// The requests in flight still write their results.
+			wg.Wait()
+			return results[:i]
+		}
+		res := &results[i]
+		res.x = x
+		if !due.IsZero() {
+			res.late = time.Since(due)
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			res.status, res.duration, res.err = send(ctx, opts, res.x)
+		}()
+	}
+	wg.Wait()
+	return results
+}
+
+func send(ctx context.Context, opts replayOptions, x *exchange) (int, time.Duration, error) {
+	header := make(http.Header)
+	if x.contentType != "" {
+		header.Set("Content-Type", x.contentType)
+	}
+	req := upstreamRequest(opts.target, x.method, x.uri, header, x.body)
+	start := time.Now()
+	resp, err := opts.transport.RoundTrip(req.WithContext(ctx))
+	if err != nil {
+		return 0, time.Since(start), err
+	}
+	_, err = io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	return resp.StatusCode, time.Since(start), err
+}
+
+// report prints a summary of a replay, comparing the statuses and
+// latencies with those of the capture.
+func report(w io.Writer, results []replayResult, elapsed time.Duration) {
+	var errors, mismatches int
+	var orig, got, late []time.Duration
+	for _, r := range results {
+		if r.err != nil {
+			errors++
+			continue
+		}
+		if r.status != r.x.status {
+			mismatches++
+		}
+		orig = append(orig, r.x.duration)
+		got = append(got, r.duration)
+		late = append(late, r.late)
+	}
+	fmt.Fprintf(w, "%d requests in %v, %d errors, %d status mismatches\n",
+		len(results), elapsed.Round(time.Millisecond), errors, mismatches)
+	if len(got) == 0 {
+		return
+	}
+	tw := tabwriter.NewWriter(w, 10, 8, 1, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, "\tp50\tp90\tp99\tmax\t")
+	for _, row := range []struct {
+		name string
+		ds   []time.Duration
+	}{{"captured", orig}, {"replayed", got}, {"late", late}} {
+		sort.Slice(row.ds, func(i, j int) bool { return row.ds[i] < row.ds[j] })
+		fmt.Fprintf(tw, "%s\t", row.name)
+		for _, q := range []float64{0.5, 0.9, 0.99, 1} {
+			fmt.Fprintf(tw, "%v\t", quantile(row.ds, q))
+		}
+		fmt.Fprintln(tw)
+	}
+	tw.Flush()
+}
+
+// quantile returns the q quantile of sorted durations.
+func quantile(ds []time.Duration, q float64) time.Duration {
+	i := int(q * float64(len(ds)-1))
+	return ds[i].Round(10 * time.Microsecond)
+}
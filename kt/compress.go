@@ -0,0 +1,200 @@
+package kt
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"sync"
+)
+
+// Compression selects the algorithm used to compress values.
+type Compression byte
+
+const (
+	// CompressFlate compresses values with raw DEFLATE (compress/flate).
+	CompressFlate Compression = 1
+	// CompressGzip compresses values with gzip. It is slightly larger
+	// than CompressFlate but can be inspected with standard tools.
+	CompressGzip Compression = 2
+)
+
+// Compressed values are stored with a small header in front of them:
+//
+//	0xff 'k' 'z' <version> <algorithm> <compressed data...>
+//
+// 0xff never appears in UTF-8 text, so JSON and other textual records
+// written before compression was enabled are never mistaken for
+// compressed ones. Values without the header are returned unchanged.
+// Values stored uncompressed that start with the magic bytes anyway are
+// given the header with algorithm compressStored, so that they are not
+// mistaken for compressed ones either.
+const (
+	compressVersion   = 1
+	compressHeaderLen = 5
+
+	compressStored Compression = 0
+)
+
+var compressMagic = []byte{0xff, 'k', 'z'}
+
+// ErrCorruptValue is returned when a value carries a compression header
+// but its payload cannot be decompressed, or decompresses to more than
+// the limit set by WithDecompressLimit.
+var ErrCorruptValue error = &Error{Message: "corrupt compressed value"}
+
+// DefaultDecompressLimit is the maximum size of a decompressed value,
+// unless changed with WithDecompressLimit.
+const DefaultDecompressLimit = 64 << 20
+
+type compressor struct {
+	alg       Compression
+	level     int
+	threshold int
+	limit     int64
+	writers   sync.Pool
+}
+
+// WithCompression makes the Conn compress values of at least threshold
+// bytes before storing them, using the given algorithm and compression
+// level (see compress/flate for valid levels). Values are only stored
+// compressed if that makes them smaller. The constructor fails if the
+// algorithm or the level is invalid.
+//
+// Every value read through the Conn is inspected for the compression
+// header and decompressed transparently, so uncompressed values written
+// by older clients keep working. Clients that read compressed values must
+// be configured with WithCompression too.
+func WithCompression(alg Compression, level int, threshold int) Option {
+	return func(c *Conn) {
+		c.compressor = &compressor{
+			alg:       alg,
+			level:     level,
+			threshold: threshold,
+			limit:     c.decompressLimit,
+		}
+	}
+}
+
+// WithDecompressLimit caps the size of the values decompressed by the
+// Conn, so that a corrupt or hostile value cannot exhaust memory. Values
+// decompressing to more than n bytes fail with ErrCorruptValue. Defaults
+// to DefaultDecompressLimit.
+func WithDecompressLimit(n int64) Option {
+	return func(c *Conn) {
+		c.decompressLimit = n
+		if c.compressor != nil {
+			c.compressor.limit = n
+		}
+	}
+}
+
+// validate checks the settings given to WithCompression.
+func (z *compressor) validate() error {
+	if z.alg != CompressFlate && z.alg != CompressGzip {
+		return &Error{Message: "unknown compression algorithm " + strconv.Itoa(int(z.alg))}
+	}
+	if z.level < flate.HuffmanOnly || z.level > flate.BestCompression {
+		return &Error{Message: "invalid compression level " + strconv.Itoa(z.level)}
+	}
+	return nil
+}
+
+type compressWriter interface {
+	io.WriteCloser
+	Reset(io.Writer)
+}
+
+func (z *compressor) writer(w io.Writer) (compressWriter, error) {
+	if cw, ok := z.writers.Get().(compressWriter); ok {
+		cw.Reset(w)
+		return cw, nil
+	}
+	switch z.alg {
+	case CompressGzip:
+		return gzip.NewWriterLevel(w, z.level)
+	default:
+		return flate.NewWriter(w, z.level)
+	}
+}
+
+// encode returns value with a compression header, or value itself if
+// it is below the threshold or does not compress, unless it starts with
+// the magic bytes.
+func (z *compressor) encode(value []byte) []byte {
+	if b := z.compress(value); b != nil {
+		return b
+	}
+	if bytes.HasPrefix(value, compressMagic) {
+		b := make([]byte, 0, compressHeaderLen+len(value))
+		b = append(b, compressMagic...)
+		b = append(b, compressVersion, byte(compressStored))
+		return append(b, value...)
+	}
+	return value
+}
+
+// compress returns value compressed with a header, or nil if it is below
+// the threshold or does not compress.
+func (z *compressor) compress(value []byte) []byte {
+	if len(value) < z.threshold || len(value) <= compressHeaderLen {
+		return nil
+	}
+	var buf bytes.Buffer
+	buf.Grow(len(value) / 2)
+	buf.Write(compressMagic)
+	buf.WriteByte(compressVersion)
+	buf.WriteByte(byte(z.alg))
+	w, err := z.writer(&buf)
+	if err != nil {
+		return nil
+	}
+	_, err = w.Write(value)
+	if err == nil {
+		err = w.Close()
+	}
+	z.writers.Put(w)
+	if err != nil || buf.Len() >= len(value) {
+		return nil
+	}
+	return buf.Bytes()
+}
+
+// decode reverses encode. Values without a compression header are
+// returned as is.
+func (z *compressor) decode(value []byte) ([]byte, error) {
+	if len(value) < compressHeaderLen || !bytes.Equal(value[:len(compressMagic)], compressMagic) {
+		return value, nil
+	}
+	if value[3] != compressVersion {
+		return nil, ErrCorruptValue
+	}
+	var r io.ReadCloser
+	payload := bytes.NewReader(value[compressHeaderLen:])
+	switch Compression(value[4]) {
+	case compressStored:
+		return value[compressHeaderLen:], nil
+	case CompressFlate:
+		r = flate.NewReader(payload)
+	case CompressGzip:
+		zr, err := gzip.NewReader(payload)
+		if err != nil {
+			return nil, ErrCorruptValue
+		}
+		r = zr
+	default:
+		return nil, ErrCorruptValue
+	}
+	defer r.Close()
+	limit := z.limit
+	if limit <= 0 {
+		limit = DefaultDecompressLimit
+	}
+	b, err := ioutil.ReadAll(io.LimitReader(r, limit+1))
+	if err != nil || int64(len(b)) > limit {
+		return nil, ErrCorruptValue
+	}
+	return b, nil
+}
@@ -0,0 +1,112 @@
+package kt
+
+import (
+	"bytes"
+	"compress/flate"
+	"testing"
+)
+
+func TestCompressRoundTrip(t *testing.T) {
+	large := bytes.Repeat([]byte(`{"name":"Steve Vai","instrument":"guitar"},`), 100)
+	for _, alg := range []Compression{CompressFlate, CompressGzip} {
+		c := &Conn{}
+		WithCompression(alg, flate.DefaultCompression, 64)(c)
+		z := c.compressor
+
+		enc := z.encode(large)
+		if len(enc) >= len(large) {
+			t.Errorf("alg %d: value was not compressed: %d >= %d", alg, len(enc), len(large))
+		}
+		dec, err := z.decode(enc)
+		if err != nil {
+			t.Fatalf("alg %d: %v", alg, err)
+		}
+		if !bytes.Equal(dec, large) {
+			t.Errorf("alg %d: round trip mismatch", alg)
+		}
+
+		small := []byte("short")
+		if enc := z.encode(small); !bytes.Equal(enc, small) {
+			t.Errorf("alg %d: value below threshold was modified: %q", alg, enc)
+		}
+	}
+}
+
+func TestCompressLegacyValues(t *testing.T) {
+	c := &Conn{}
+	WithCompression(CompressFlate, flate.BestSpeed, 0)(c)
+	z := c.compressor
+
+	for _, v := range [][]byte{nil, []byte("plain"), {0xff, 'k'}, []byte(`{"a":1}`)} {
+		dec, err := z.decode(v)
+		if err != nil {
+			t.Fatalf("decode(%q): %v", v, err)
+		}
+		if !bytes.Equal(dec, v) {
+			t.Errorf("decode(%q) = %q, want unchanged", v, dec)
+		}
+	}
+
+	corrupt := []byte{0xff, 'k', 'z', compressVersion, byte(CompressGzip), 1, 2, 3}
+	if _, err := z.decode(corrupt); err != ErrCorruptValue {
+		t.Errorf("decode(corrupt) = %v, want ErrCorruptValue", err)
+	}
+}
+
+func TestCompressMagicValues(t *testing.T) {
+	c := &Conn{}
+	WithCompression(CompressFlate, flate.BestSpeed, 16)(c)
+	z := c.compressor
+
+	incompressible := []byte{0xff, 'k', 'z', compressVersion, byte(CompressFlate)}
+	for i := 0; i < 64; i++ {
+		incompressible = append(incompressible, byte(i*151))
+	}
+	for _, v := range [][]byte{
+		{0xff, 'k', 'z'},
+		{0xff, 'k', 'z', compressVersion, byte(CompressGzip), 1, 2, 3},
+		incompressible,
+	} {
+		enc := z.encode(v)
+		if bytes.Equal(enc, v) {
+			t.Errorf("encode(%q) stored the value as is", v)
+		}
+		dec, err := z.decode(enc)
+		if err != nil {
+			t.Fatalf("decode(encode(%q)): %v", v, err)
+		}
+		if !bytes.Equal(dec, v) {
+			t.Errorf("decode(encode(%q)) = %q", v, dec)
+		}
+	}
+}
+
+func TestCompressionSettings(t *testing.T) {
+	for _, opt := range []Option{
+		WithCompression(Compression(7), flate.BestSpeed, 0),
+		WithCompression(CompressFlate, 12, 0),
+		WithCompression(CompressGzip, -3, 0),
+	} {
+		if _, err := NewConn("127.0.0.1", 1, 1, DEFAULT_TIMEOUT, opt); !IsError(err) {
+			t.Errorf("want a configuration error, got %v", err)
+		}
+	}
+}
+
+func TestDecompressLimit(t *testing.T) {
+	large := make([]byte, 1<<20)
+	for _, alg := range []Compression{CompressFlate, CompressGzip} {
+		c := &Conn{}
+		WithDecompressLimit(1 << 10)(c)
+		WithCompression(alg, flate.BestCompression, 0)(c)
+		enc := c.compressor.encode(large)
+		if _, err := c.compressor.decode(enc); err != ErrCorruptValue {
+			t.Errorf("alg %d: decoding past the limit: got %v", alg, err)
+		}
+
+		WithDecompressLimit(1 << 20)(c)
+		if dec, err := c.compressor.decode(enc); err != nil || len(dec) != len(large) {
+			t.Errorf("alg %d: decoding up to the limit: %d bytes, %v", alg, len(dec), err)
+		}
+	}
+}
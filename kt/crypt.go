@@ -0,0 +1,340 @@
+package kt
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// Sealed values are stored as
+//
+//	0xfe 'k' 'e' <version> <key id, 4 bytes big endian> <nonce> <ciphertext>
+//
+// The record key is passed to AES-GCM as associated data, so a sealed
+// value copied to a different key fails to open.
+const (
+	sealVersion   = 1
+	sealHeaderLen = 8
+)
+
+var sealMagic = []byte{0xfe, 'k', 'e'}
+
+var (
+	// ErrNotSealed is returned when a value read through a SealedConn
+	// was not written by one.
+	ErrNotSealed error = &Error{Message: "value is not sealed"}
+	// ErrUnknownKey is returned when a sealed value references a key ID
+	// that is not in the keyring.
+	ErrUnknownKey error = &Error{Message: "value sealed with unknown key"}
+	// ErrOpenFailed is returned when a sealed value fails authentication.
+	ErrOpenFailed error = &Error{Message: "value failed authentication"}
+)
+
+// Keyring holds the AES keys used to seal and open values, indexed by a
+// key ID that is stored alongside every sealed value. One of the keys is
+// active and used for new writes; all of them can be used for reads.
+// Keyring is safe for concurrent use.
+type Keyring struct {
+	mu     sync.RWMutex
+	aeads  map[uint32]cipher.AEAD
+	active uint32
+}
+
+// NewKeyring creates a keyring whose active key is key, with the given ID.
+// key must be 16, 24 or 32 bytes long to select AES-128, AES-192 or AES-256.
+func NewKeyring(id uint32, key []byte) (*Keyring, error) {
+	k := &Keyring{aeads: make(map[uint32]cipher.AEAD)}
+	if err := k.Add(id, key); err != nil {
+		return nil, err
+	}
+	k.active = id
+	return k, nil
+}
+
+// Add makes key available for opening values sealed under id.
+func (k *Keyring) Add(id uint32, key []byte) error {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return err
+	}
+	k.mu.Lock()
+	k.aeads[id] = aead
+	k.mu.Unlock()
+	return nil
+}
+
+// Remove drops the key with the given ID. The active key cannot be removed.
+func (k *Keyring) Remove(id uint32) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if id == k.active {
+		return fmt.Errorf("kt: cannot remove active key %d", id)
+	}
+	delete(k.aeads, id)
+	return nil
+}
+
+// SetActive selects the key used to seal new values. The key must have
+// been added first. Rotating keys is done by adding the new key on every
+// reader, then activating it on the writers and finally re-encrypting
+// the existing records.
+func (k *Keyring) SetActive(id uint32) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if _, ok := k.aeads[id]; !ok {
+		return fmt.Errorf("kt: unknown key %d", id)
+	}
+	k.active = id
+	return nil
+}
+
+// Active returns the ID of the key used to seal new values.
+func (k *Keyring) Active() uint32 {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return k.active
+}
+
+func (k *Keyring) seal(key string, plaintext []byte) ([]byte, error) {
+	k.mu.RLock()
+	id := k.active
+	aead := k.aeads[id]
+	k.mu.RUnlock()
+
+	out := make([]byte, sealHeaderLen+aead.NonceSize(), sealHeaderLen+aead.NonceSize()+len(plaintext)+aead.Overhead())
+	copy(out, sealMagic)
+	out[3] = sealVersion
+	binary.BigEndian.PutUint32(out[4:], id)
+	nonce := out[sealHeaderLen:]
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(out, nonce, plaintext, []byte(key)), nil
+}
+
+// sealedWith returns the ID of the key that sealed value.
+func sealedWith(value []byte) (uint32, bool) {
+	if len(value) < sealHeaderLen || !bytes.Equal(value[:len(sealMagic)], sealMagic) || value[3] != sealVersion {
+		return 0, false
+	}
+	return binary.BigEndian.Uint32(value[4:]), true
+}
+
+func (k *Keyring) open(key string, value []byte) ([]byte, error) {
+	id, ok := sealedWith(value)
+	if !ok {
+		return nil, ErrNotSealed
+	}
+	k.mu.RLock()
+	aead := k.aeads[id]
+	k.mu.RUnlock()
+	if aead == nil {
+		return nil, ErrUnknownKey
+	}
+	value = value[sealHeaderLen:]
+	if len(value) < aead.NonceSize() {
+		return nil, ErrOpenFailed
+	}
+	nonce, ciphertext := value[:aead.NonceSize()], value[aead.NonceSize():]
+	plaintext, err := aead.Open(nil, nonce, ciphertext, []byte(key))
+	if err != nil {
+		return nil, ErrOpenFailed
+	}
+	return plaintext, nil
+}
+
+// SealedConn encrypts values with AES-GCM before they are sent to KT and
+// decrypts them on the way back, so the server only ever sees ciphertext.
+// Keys are not encrypted.
+// SealedConn is safe for concurrent use.
+type SealedConn struct {
+	kt   *Conn
+	keys *Keyring
+}
+
+// NewSealedConn wraps conn so that all values are sealed with keys.
+func NewSealedConn(conn *Conn, keys *Keyring) *SealedConn {
+	return &SealedConn{kt: conn, keys: keys}
+}
+
+// Get retrieves and decrypts the value stored at key. ErrNotFound is
+// returned if no such data exists.
+func (s *SealedConn) Get(ctx context.Context, key string) (string, error) {
+	b, err := s.GetBytes(ctx, key)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// GetBytes retrieves and decrypts the value stored at key. ErrNotFound
+// is returned if no such data exists.
+func (s *SealedConn) GetBytes(ctx context.Context, key string) ([]byte, error) {
+	b, err := s.kt.GetBytes(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	return s.keys.open(key, b)
+}
+
+// Set encrypts value with the active key and stores it at key.
+func (s *SealedConn) Set(ctx context.Context, key string, value []byte) error {
+	b, err := s.keys.seal(key, value)
+	if err != nil {
+		return err
+	}
+	return s.kt.set(ctx, key, b)
+}
+
+// GetBulkBytes retrieves and decrypts the keys in the map. The results
+// will be filled in on function return. If a key was not found in the
+// database, it will be removed from the map. If any value fails to
+// decrypt, the first such error is returned and the map is left with
+// the values that could be opened.
+func (s *SealedConn) GetBulkBytes(ctx context.Context, keys map[string][]byte) error {
+	if err := s.kt.GetBulkBytes(ctx, keys); err != nil {
+		return err
+	}
+	var firstErr error
+	for k, v := range keys {
+		b, err := s.keys.open(k, v)
+		if err != nil {
+			delete(keys, k)
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		keys[k] = b
+	}
+	return firstErr
+}
+
+// Remove deletes the data at key.
+func (s *SealedConn) Remove(ctx context.Context, key string) error {
+	return s.kt.remove(ctx, key)
+}
+
+// Reencrypt rewrites every record whose key starts with prefix and that
+// is not sealed with the active key, including plaintext records written
+// before sealing was enabled. At most maxrecords keys are examined
+// (negative for no limit), batch of them at a time.
+//
+// Records are replaced with compare-and-swap, so a record that is
+// concurrently updated is left to the writer, who seals it with the
+// active key anyway. Rewritten records keep their expiry. Reencrypt
+// returns the number of records rewritten.
+func (s *SealedConn) Reencrypt(ctx context.Context, prefix string, maxrecords int64, batch int) (int, error) {
+	keys, err := s.kt.MatchPrefix(ctx, prefix, maxrecords)
+	if err == ErrSuccess {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	if batch <= 0 {
+		batch = 100
+	}
+	active := s.keys.Active()
+	var rewritten int
+	for len(keys) > 0 {
+		n := batch
+		if n > len(keys) {
+			n = len(keys)
+		}
+		m := make(map[string][]byte, n)
+		for _, k := range keys[:n] {
+			m[k] = nil
+		}
+		keys = keys[n:]
+		if err := s.kt.GetBulkBytes(ctx, m); err != nil {
+			return rewritten, err
+		}
+		for k, v := range m {
+			if id, ok := sealedWith(v); ok && id == active {
+				continue
+			}
+			switch ok, err := s.reencrypt(ctx, k); {
+			case err != nil:
+				return rewritten, err
+			case ok:
+				rewritten++
+			}
+		}
+	}
+	return rewritten, nil
+}
+
+// reencrypt seals the record at k under the active key, keeping its
+// expiry. The record is read again along with its expiry, which
+// get_bulk does not return. It reports whether the record was rewritten:
+// it is not if it changed or disappeared in the meantime.
+func (s *SealedConn) reencrypt(ctx context.Context, k string) (bool, error) {
+	stored, expires, err := s.kt.getStored(ctx, k)
+	if err == ErrNotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	v := stored
+	if s.kt.compressor != nil {
+		if v, err = s.kt.compressor.decode(stored); err != nil {
+			return false, fmt.Errorf("kt: reencrypt %q: %v", k, err)
+		}
+	}
+	plaintext := v
+	if id, ok := sealedWith(v); ok {
+		if id == s.keys.Active() {
+			return false, nil
+		}
+		if plaintext, err = s.keys.open(k, v); err != nil {
+			return false, fmt.Errorf("kt: reencrypt %q: %v", k, err)
+		}
+	}
+	sealed, err := s.keys.seal(k, plaintext)
+	if err != nil {
+		return false, err
+	}
+	// A negative xt is an absolute time, kept as is.
+	var xt int64
+	if !expires.IsZero() {
+		xt = -expires.Unix()
+	}
+	switch err := s.kt.cas(ctx, k, stored, sealed, xt, true); err {
+	case nil:
+		return true, nil
+	case ErrCASMismatch:
+		return false, nil
+	default:
+		return false, err
+	}
+}
+
+// ReencryptResult is the outcome of a background re-encryption.
+type ReencryptResult struct {
+	Rewritten int
+	Err       error
+}
+
+// StartReencrypt runs Reencrypt in a new goroutine. The returned channel
+// receives the result once and is then closed. Cancel ctx to stop early.
+func (s *SealedConn) StartReencrypt(ctx context.Context, prefix string, maxrecords int64, batch int) <-chan ReencryptResult {
+	ch := make(chan ReencryptResult, 1)
+	go func() {
+		defer close(ch)
+		n, err := s.Reencrypt(ctx, prefix, maxrecords, batch)
+		ch <- ReencryptResult{Rewritten: n, Err: err}
+	}()
+	return ch
+}
@@ -0,0 +1,166 @@
+package kt
+
+import (
+	"bytes"
+	"compress/flate"
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestKeyringRotation(t *testing.T) {
+	oldKey := bytes.Repeat([]byte{1}, 32)
+	newKey := bytes.Repeat([]byte{2}, 16)
+
+	writer, err := NewKeyring(1, oldKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealed, err := writer.seal("user/1", []byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(sealed, []byte("secret")) {
+		t.Fatal("sealed value contains the plaintext")
+	}
+
+	reader, err := NewKeyring(2, newKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := reader.open("user/1", sealed); err != ErrUnknownKey {
+		t.Fatalf("open with missing key: want ErrUnknownKey, got %v", err)
+	}
+	if err := reader.Add(1, oldKey); err != nil {
+		t.Fatal(err)
+	}
+	got, err := reader.open("user/1", sealed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "secret" {
+		t.Errorf("open: want %q, got %q", "secret", got)
+	}
+
+	resealed, err := reader.seal("user/1", got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id, ok := sealedWith(resealed); !ok || id != 2 {
+		t.Errorf("sealedWith: want key 2, got %d (%v)", id, ok)
+	}
+	if err := reader.Remove(2); err == nil {
+		t.Error("removing the active key succeeded")
+	}
+}
+
+func TestKeyringAssociatedData(t *testing.T) {
+	k, err := NewKeyring(7, bytes.Repeat([]byte{3}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealed, err := k.seal("a", []byte("value"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := k.open("b", sealed); err != ErrOpenFailed {
+		t.Errorf("open under another key: want ErrOpenFailed, got %v", err)
+	}
+	if _, err := k.open("a", []byte("plaintext")); err != ErrNotSealed {
+		t.Errorf("open plaintext: want ErrNotSealed, got %v", err)
+	}
+	if _, err := k.open("a", sealed[:sealHeaderLen+3]); err != ErrOpenFailed {
+		t.Errorf("open truncated: want ErrOpenFailed, got %v", err)
+	}
+}
+
+func TestReencryptLegacyOnCompressingConn(t *testing.T) {
+	ctx := context.Background()
+	host, port := startFakeServer(t, newFakeKT())
+	legacy, err := NewConn(host, port, 1, DEFAULT_TIMEOUT)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer legacy.Close(ctx)
+	db, err := NewConn(host, port, 1, DEFAULT_TIMEOUT, WithCompression(CompressFlate, flate.BestSpeed, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close(ctx)
+
+	// Plaintext written before sealing and compression were enabled, and
+	// which the compressing Conn would store compressed.
+	plain := strings.Repeat("legacy ", 50)
+	for _, k := range []string{"r/1", "r/2"} {
+		if err := legacy.Set(ctx, k, []byte(plain)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	keys, err := NewKeyring(1, bytes.Repeat([]byte{1}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewSealedConn(db, keys)
+	n, err := s.Reencrypt(ctx, "r/", -1, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Errorf("Reencrypt: rewrote %d records, want 2", n)
+	}
+	for _, k := range []string{"r/1", "r/2"} {
+		raw, err := legacy.GetBytes(ctx, k)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bytes.Contains(raw, []byte("legacy")) {
+			t.Errorf("%s still stored in the clear", k)
+		}
+		if v, err := s.Get(ctx, k); err != nil || v != plain {
+			t.Errorf("Get(%s) after Reencrypt: %q, %v", k, v, err)
+		}
+	}
+}
+
+func TestReencryptKeepsExpiry(t *testing.T) {
+	ctx := context.Background()
+	host, port := startFakeServer(t, newFakeKT())
+	db, err := NewConn(host, port, 1, DEFAULT_TIMEOUT)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close(ctx)
+	if err := db.Add(ctx, "r/ttl", []byte("expiring"), time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Set(ctx, "r/forever", []byte("permanent")); err != nil {
+		t.Fatal(err)
+	}
+	_, want, err := db.GetWithExpiry(ctx, "r/ttl")
+	if err != nil || want.IsZero() {
+		t.Fatalf("GetWithExpiry before Reencrypt: %v, %v", want, err)
+	}
+
+	keys, err := NewKeyring(1, bytes.Repeat([]byte{1}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewSealedConn(db, keys)
+	if n, err := s.Reencrypt(ctx, "r/", -1, 10); err != nil || n != 2 {
+		t.Fatalf("Reencrypt: rewrote %d records, %v", n, err)
+	}
+	v, got, err := db.GetWithExpiry(ctx, "r/ttl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := sealedWith(v); !ok {
+		t.Error("record with a TTL not sealed")
+	}
+	if !got.Equal(want) {
+		t.Errorf("expiry after Reencrypt: want %v, got %v", want, got)
+	}
+	if _, got, err := db.GetWithExpiry(ctx, "r/forever"); err != nil || !got.IsZero() {
+		t.Errorf("record without expiry after Reencrypt: expires %v, %v", got, err)
+	}
+}
@@ -0,0 +1,182 @@
+package kt
+
+import (
+	"context"
+	"io"
+	"math/rand"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/opentracing/opentracing-go"
+)
+
+// Record is a key/value pair together with its expiration time.
+type Record struct {
+	Key   string
+	Value []byte
+	// Expires is the time at which KT drops the record, or the zero
+	// time if it never expires.
+	Expires time.Time
+}
+
+// Cursor walks the records of the database in key order. Walking in
+// order requires a tree database on the server side, such as the "%"
+// in-memory database or a .kct file; hash databases are walked in an
+// unspecified order.
+//
+// KT keeps cursors in the server session, which is bound to a TCP
+// connection, so a Cursor uses a dedicated connection of its own. If that
+// connection is lost, the cursor transparently jumps back to the last
+// key it returned.
+//
+// A Cursor is not safe for concurrent use.
+type Cursor struct {
+	conn    *Conn
+	id      string
+	prefix  string
+	start   string
+	last    string
+	started bool
+	done    bool
+}
+
+// NewCursor returns a cursor over the records whose key starts with
+// prefix, in key order. Close must be called to release its connection.
+//
+// The cursor jumps to prefix and stops at the first key that does not
+// start with it, so a non-empty prefix requires a tree database: on a
+// hash database the walk misses records and ends early.
+func (c *Conn) NewCursor(prefix string) *Cursor {
+	transport := c.transport.Clone()
+	transport.MaxConnsPerHost = 1
+	transport.MaxIdleConnsPerHost = 1
+	conn := &Conn{
+		scheme:     c.scheme,
+		timeout:    c.timeout,
+		host:       c.host,
+		transport:  transport,
+		compressor: c.compressor,
+		limits:     c.limits,
+	}
+	conn.lifecycle.dialer = c.lifecycle.dialer
+	transport.DialContext = conn.lifecycle.dial
+	return &Cursor{
+		conn:   conn,
+		id:     strconv.FormatInt(rand.Int63(), 10),
+		prefix: prefix,
+		start:  prefix,
+	}
+}
+
+// Close releases the connection of the cursor.
+func (cur *Cursor) Close() error {
+	cur.done = true
+	cur.conn.transport.CloseIdleConnections()
+	return nil
+}
+
+// jump positions the cursor on the first record whose key is greater
+// than or equal to key. It returns io.EOF if there is none.
+func (cur *Cursor) jump(ctx context.Context, key string) error {
+	code, m, err := cur.conn.doRPC(ctx, "", "/rpc/cur_jump", []KV{
+		{"CUR", []byte(cur.id)},
+		{"key", []byte(key)},
+	})
+	if err != nil {
+		return err
+	}
+	switch code {
+	case 200:
+		return nil
+	case 450:
+		return io.EOF
+	}
+	return makeError(m)
+}
+
+// get returns the record under the cursor and steps to the next one.
+// It returns io.EOF if the cursor is not positioned on a record, either
+// because the walk is over or because the session was lost.
+func (cur *Cursor) get(ctx context.Context) (Record, error) {
+	code, m, err := cur.conn.doRPC(ctx, "", "/rpc/cur_get", []KV{
+		{"CUR", []byte(cur.id)},
+		{"step", nil},
+	})
+	if err != nil {
+		return Record{}, err
+	}
+	switch code {
+	case 200:
+	case 450:
+		return Record{}, io.EOF
+	default:
+		return Record{}, makeError(m)
+	}
+	rec := Record{
+		Key:   string(findRec(m, "key").Value),
+		Value: findRec(m, "value").Value,
+	}
+	if xt := findRec(m, "xt"); xt.Key != "" {
+		if secs, err := strconv.ParseInt(string(xt.Value), 10, 64); err == nil {
+			rec.Expires = time.Unix(secs, 0)
+		}
+	}
+	if cur.conn.compressor != nil {
+		if rec.Value, err = cur.conn.compressor.decode(rec.Value); err != nil {
+			return Record{}, err
+		}
+	}
+	return rec, nil
+}
+
+// Next returns the next record. It returns io.EOF once all records have
+// been returned.
+func (cur *Cursor) Next(ctx context.Context) (Record, error) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "ktrpc CursorNext")
+	defer span.Finish()
+
+	if cur.done {
+		return Record{}, io.EOF
+	}
+	if err := cur.conn.admit(ctx, OpGet, singleKey(cur.prefix)); err != nil {
+		return Record{}, err
+	}
+	if !cur.started {
+		if err := cur.jump(ctx, cur.start); err != nil {
+			return Record{}, cur.finish(err)
+		}
+		cur.started = true
+	}
+	rec, err := cur.get(ctx)
+	if err == io.EOF {
+		// Either we are done, or the connection holding the cursor was
+		// replaced. Jump back to where we were to find out.
+		resume := cur.start
+		if cur.last != "" {
+			resume = cur.last
+		}
+		if err := cur.jump(ctx, resume); err != nil {
+			return Record{}, cur.finish(err)
+		}
+		rec, err = cur.get(ctx)
+		if err == nil && cur.last != "" && rec.Key == cur.last {
+			rec, err = cur.get(ctx)
+		}
+	}
+	if err != nil {
+		return Record{}, cur.finish(err)
+	}
+	if !strings.HasPrefix(rec.Key, cur.prefix) {
+		return Record{}, cur.finish(io.EOF)
+	}
+	cur.last = rec.Key
+	return rec, nil
+}
+
+func (cur *Cursor) finish(err error) error {
+	if err == io.EOF {
+		cur.done = true
+	}
+	return err
+}
@@ -0,0 +1,105 @@
+package kt
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+// fakeCursorServer implements cur_jump and cur_get over a fixed set of
+// records. Cursor positions are forgotten every forgetEvery requests, the
+// way they are when a KT session ends.
+type fakeCursorServer struct {
+	mu          sync.Mutex
+	keys        []string
+	values      map[string]string
+	pos         map[string]int
+	requests    int
+	forgetEvery int
+}
+
+func (s *fakeCursorServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	body, _ := ioutil.ReadAll(r.Body)
+	kvs, _ := DecodeValues(body, r.Header.Get("Content-Type"))
+	cur := string(findRec(kvs, "CUR").Value)
+
+	s.requests++
+	if s.forgetEvery > 0 && s.requests%s.forgetEvery == 0 {
+		s.pos = nil
+	}
+	if s.pos == nil {
+		s.pos = make(map[string]int)
+	}
+
+	w.Header().Set("Content-Type", "text/tab-separated-values; colenc=U")
+	switch r.URL.Path {
+	case "/rpc/cur_jump":
+		i := sort.SearchStrings(s.keys, string(findRec(kvs, "key").Value))
+		if i == len(s.keys) {
+			w.WriteHeader(450)
+			return
+		}
+		s.pos[cur] = i
+	case "/rpc/cur_get":
+		i, ok := s.pos[cur]
+		if !ok || i >= len(s.keys) {
+			w.WriteHeader(450)
+			return
+		}
+		s.pos[cur] = i + 1
+		k := s.keys[i]
+		body, _ := TSVEncode([]KV{{"key", []byte(k)}, {"value", []byte(s.values[k])}, {"xt", []byte("1000")}})
+		w.Write(body)
+	}
+}
+
+func TestCursorResume(t *testing.T) {
+	srv := &fakeCursorServer{values: make(map[string]string)}
+	for i := 0; i < 20; i++ {
+		k := "k" + strconv.Itoa(100+i)
+		srv.keys = append(srv.keys, k)
+		srv.values[k] = strconv.Itoa(i)
+	}
+	srv.keys = append(srv.keys, "z")
+	srv.values["z"] = "outside"
+	sort.Strings(srv.keys)
+
+	for _, forget := range []int{0, 4, 5, 7} {
+		srv.mu.Lock()
+		srv.forgetEvery, srv.requests, srv.pos = forget, 0, nil
+		srv.mu.Unlock()
+
+		host, port := startFakeServer(t, srv)
+		db, err := NewConn(host, port, 1, DEFAULT_TIMEOUT)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cur := db.NewCursor("k")
+		var got []string
+		for {
+			rec, err := cur.Next(context.Background())
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if rec.Expires.Unix() != 1000 {
+				t.Errorf("record %s: want expiry 1000, got %v", rec.Key, rec.Expires)
+			}
+			got = append(got, rec.Key)
+		}
+		cur.Close()
+		if !reflect.DeepEqual(got, srv.keys[:20]) {
+			t.Errorf("forgetting every %d requests: want %v, got %v", forget, srv.keys[:20], got)
+		}
+	}
+}
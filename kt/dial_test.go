@@ -0,0 +1,283 @@
+package kt
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+// pipeListener is a net.Listener handing out the server ends of
+// net.Pipe connections created by dial.
+type pipeListener struct {
+	conns  chan net.Conn
+	closed chan struct{}
+	once   sync.Once
+}
+
+func newPipeListener() *pipeListener {
+	return &pipeListener{conns: make(chan net.Conn), closed: make(chan struct{})}
+}
+
+func (l *pipeListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *pipeListener) Close() error {
+	l.once.Do(func() { close(l.closed) })
+	return nil
+}
+
+func (l *pipeListener) Addr() net.Addr {
+	return pipeAddr{}
+}
+
+func (l *pipeListener) dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	client, server := net.Pipe()
+	select {
+	case l.conns <- server:
+		return client, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+type pipeAddr struct{}
+
+func (pipeAddr) Network() string { return "pipe" }
+func (pipeAddr) String() string  { return "pipe" }
+
+// serve serves h on l until the test ends.
+func serve(t *testing.T, l net.Listener, h http.Handler) {
+	srv := &http.Server{Handler: h}
+	go srv.Serve(l)
+	t.Cleanup(func() { srv.Close() })
+}
+
+func checkGetSet(t *testing.T, db *Conn) {
+	t.Helper()
+	ctx := context.Background()
+	if err := db.Set(ctx, "k", []byte("v")); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := db.Get(ctx, "k"); err != nil || v != "v" {
+		t.Fatalf("Get: got %q, %v", v, err)
+	}
+}
+
+func TestWithDialer(t *testing.T) {
+	l := newPipeListener()
+	serve(t, l, newFakeKT())
+	var dialed []string
+	db, err := NewConn("kt.example", 1978, 1, DEFAULT_TIMEOUT, WithDialer(func(ctx context.Context, network, addr string) (net.Conn, error) {
+		dialed = append(dialed, network+" "+addr)
+		return l.dial(ctx, network, addr)
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close(context.Background())
+	checkGetSet(t, db)
+	if len(dialed) != 1 || dialed[0] != "tcp kt.example:1978" {
+		t.Errorf("dialed %q", dialed)
+	}
+	if s := db.PoolStats(); s.Dialed != 1 {
+		t.Errorf("PoolStats: connections dialed through WithDialer not counted: %+v", s)
+	}
+}
+
+func TestWithUnixSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "kt.sock")
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Skip("no Unix domain sockets:", err)
+	}
+	serve(t, l, newFakeKT())
+	db, err := NewConn("localhost", 1978, 1, DEFAULT_TIMEOUT, WithUnixSocket(path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close(context.Background())
+	checkGetSet(t, db)
+}
+
+func TestWithSourceAddr(t *testing.T) {
+	var remote string
+	f := newFakeKT()
+	host, port := startFakeServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		remote = r.RemoteAddr
+		f.ServeHTTP(w, r)
+	}))
+	db, err := NewConn(host, port, 1, DEFAULT_TIMEOUT, WithSourceAddr("127.0.0.1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close(context.Background())
+	checkGetSet(t, db)
+	if h, _, _ := net.SplitHostPort(remote); h != "127.0.0.1" {
+		t.Errorf("request from %s", remote)
+	}
+}
+
+func TestDialConfigErrors(t *testing.T) {
+	for _, opts := range [][]Option{
+		{WithSourceAddr("not an address")},
+		{WithSourceAddr("127.0.0.1:99999")},
+		{WithSourceAddr("127.0.0.1"), WithUnixSocket("/tmp/kt.sock")},
+		{WithSourceAddr("127.0.0.1"), WithDialer(newPipeListener().dial)},
+		{WithProxy("socks5://proxy:1080"), WithUnixSocket("/tmp/kt.sock")},
+		{WithProxy("ftp://proxy")},
+		{WithProxy("proxy:3128")},
+	} {
+		if _, err := NewConn("127.0.0.1", 1, 1, DEFAULT_TIMEOUT, opts...); !IsError(err) {
+			t.Errorf("%d options: want a configuration error, got %v", len(opts), err)
+		}
+	}
+}
+
+// startProxy runs a proxy speaking protocol on every accepted
+// connection, then relaying it to the address returned by protocol.
+func startProxy(t *testing.T, protocol func(conn net.Conn, br *bufio.Reader) (string, error)) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				br := bufio.NewReader(conn)
+				addr, err := protocol(conn, br)
+				if err != nil {
+					return
+				}
+				target, err := net.Dial("tcp", addr)
+				if err != nil {
+					return
+				}
+				defer target.Close()
+				go io.Copy(target, br)
+				io.Copy(conn, target)
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+func TestWithHTTPProxy(t *testing.T) {
+	host, port := startFakeServer(t, newFakeKT())
+	var connects []string
+	var mu sync.Mutex
+	proxy := startProxy(t, func(conn net.Conn, br *bufio.Reader) (string, error) {
+		req, err := http.ReadRequest(br)
+		if err != nil {
+			return "", err
+		}
+		mu.Lock()
+		connects = append(connects, req.Method+" "+req.Host+" "+req.Header.Get("Proxy-Authorization"))
+		mu.Unlock()
+		if req.Header.Get("Proxy-Authorization") == "" {
+			io.WriteString(conn, "HTTP/1.1 407 Proxy Authentication Required\r\n\r\n")
+			return "", io.EOF
+		}
+		io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+		return req.Host, nil
+	})
+
+	db, err := NewConn(host, port, 1, DEFAULT_TIMEOUT, WithProxy("http://user:secret@"+proxy))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close(context.Background())
+	checkGetSet(t, db)
+	want := "CONNECT " + net.JoinHostPort(host, strconv.Itoa(port)) + " Basic dXNlcjpzZWNyZXQ="
+	if len(connects) != 1 || connects[0] != want {
+		t.Errorf("proxy requests: want [%s], got %q", want, connects)
+	}
+
+	_, err = NewConn(host, port, 1, DEFAULT_TIMEOUT, WithProxy("http://"+proxy))
+	if err == nil {
+		t.Error("connected through a proxy refusing the request")
+	}
+}
+
+func TestWithSOCKS5Proxy(t *testing.T) {
+	host, port := startFakeServer(t, newFakeKT())
+	proxy := startProxy(t, func(conn net.Conn, br *bufio.Reader) (string, error) {
+		// Greeting, expecting user name and password authentication.
+		buf := make([]byte, 3)
+		if _, err := io.ReadFull(br, buf); err != nil {
+			return "", err
+		}
+		if buf[0] != 5 || buf[1] != 1 || buf[2] != 2 {
+			conn.Write([]byte{5, 0xff})
+			return "", io.EOF
+		}
+		conn.Write([]byte{5, 2})
+		readString := func() string {
+			n, _ := br.ReadByte()
+			s := make([]byte, n)
+			io.ReadFull(br, s)
+			return string(s)
+		}
+		br.ReadByte()
+		if readString() != "user" || readString() != "secret" {
+			conn.Write([]byte{1, 1})
+			return "", io.EOF
+		}
+		conn.Write([]byte{1, 0})
+
+		// Connect request.
+		if _, err := io.ReadFull(br, buf); err != nil {
+			return "", err
+		}
+		var host string
+		switch atyp, _ := br.ReadByte(); atyp {
+		case 1:
+			ip := make([]byte, 4)
+			io.ReadFull(br, ip)
+			host = net.IP(ip).String()
+		case 3:
+			host = readString()
+		default:
+			conn.Write([]byte{5, 8, 0, 1, 0, 0, 0, 0, 0, 0})
+			return "", io.EOF
+		}
+		p := make([]byte, 2)
+		io.ReadFull(br, p)
+		conn.Write([]byte{5, 0, 0, 1, 127, 0, 0, 1, 0, 0})
+		return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(p)))), nil
+	})
+
+	db, err := NewConn(host, port, 1, DEFAULT_TIMEOUT, WithProxy("socks5://user:secret@"+proxy))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close(context.Background())
+	checkGetSet(t, db)
+
+	if _, err := NewConn(host, port, 1, DEFAULT_TIMEOUT, WithProxy("socks5://user:wrong@"+proxy)); err == nil {
+		t.Error("connected with the wrong proxy password")
+	}
+	if _, err := NewConn(host, port, 1, DEFAULT_TIMEOUT, WithProxy("socks5://"+proxy)); err == nil {
+		t.Error("connected without authenticating to the proxy")
+	}
+}
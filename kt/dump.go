@@ -0,0 +1,358 @@
+package kt
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"time"
+)
+
+// A dump is a portable copy of a keyspace, independent of the storage
+// format of ktserver. It starts with a header
+//
+//	"KTDUMP" <version> <flags>
+//
+// followed by the body, gzip compressed if flags has dumpGzip set. The
+// body is a sequence of records
+//
+//	1 <uvarint key length> <key> <uvarint value length> <value> <varint xt> <crc32>
+//
+// where xt is the UNIX time at which the record expires, or 0, and the
+// IEEE CRC-32 covers the preceding bytes of the record. The body ends
+// with a trailer
+//
+//	0 <uvarint record count> <crc32>
+//
+// so that truncated dumps are detected.
+const (
+	dumpVersion = 1
+
+	dumpGzip = 1 << 0
+
+	dumpRecord  = 1
+	dumpTrailer = 0
+)
+
+var dumpMagic = []byte("KTDUMP")
+
+// ErrCorruptDump is returned when restoring a dump that fails its
+// checksums or is truncated.
+var ErrCorruptDump error = &Error{Message: "corrupt dump"}
+
+// DumpOptions configures Dump.
+type DumpOptions struct {
+	// Prefix restricts the dump to the keys starting with it. A non-empty
+	// prefix requires a tree database, see NewCursor.
+	Prefix string
+	// Compress the dump with gzip.
+	Compress bool
+}
+
+// Dump writes all records of c whose key starts with opts.Prefix to w,
+// with their expiration times. It returns the number of records written.
+// Records are read with a Cursor, so concurrent writes may or may not be
+// part of the dump.
+func Dump(ctx context.Context, c *Conn, w io.Writer, opts DumpOptions) (int64, error) {
+	var flags byte
+	if opts.Compress {
+		flags |= dumpGzip
+	}
+	header := append(append([]byte(nil), dumpMagic...), dumpVersion, flags)
+	if _, err := w.Write(header); err != nil {
+		return 0, err
+	}
+
+	bw := bufio.NewWriter(w)
+	var body io.Writer = bw
+	var zw *gzip.Writer
+	if opts.Compress {
+		zw = gzip.NewWriter(bw)
+		body = zw
+	}
+	dw := &dumpWriter{w: body}
+
+	cur := c.NewCursor(opts.Prefix)
+	defer cur.Close()
+	for {
+		rec, err := cur.Next(ctx)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return dw.count, err
+		}
+		if err := dw.write(rec); err != nil {
+			return dw.count, err
+		}
+	}
+	if err := dw.close(); err != nil {
+		return dw.count, err
+	}
+	if zw != nil {
+		if err := zw.Close(); err != nil {
+			return dw.count, err
+		}
+	}
+	return dw.count, bw.Flush()
+}
+
+type dumpWriter struct {
+	w     io.Writer
+	buf   []byte
+	count int64
+}
+
+func (d *dumpWriter) write(rec Record) error {
+	var xt int64
+	if !rec.Expires.IsZero() {
+		xt = rec.Expires.Unix()
+	}
+	b := append(d.buf[:0], dumpRecord)
+	b = binary.AppendUvarint(b, uint64(len(rec.Key)))
+	b = append(b, rec.Key...)
+	b = binary.AppendUvarint(b, uint64(len(rec.Value)))
+	b = append(b, rec.Value...)
+	b = binary.AppendVarint(b, xt)
+	b = binary.BigEndian.AppendUint32(b, crc32.ChecksumIEEE(b))
+	d.buf = b
+	if _, err := d.w.Write(b); err != nil {
+		return err
+	}
+	d.count++
+	return nil
+}
+
+func (d *dumpWriter) close() error {
+	b := append(d.buf[:0], dumpTrailer)
+	b = binary.AppendUvarint(b, uint64(d.count))
+	b = binary.BigEndian.AppendUint32(b, crc32.ChecksumIEEE(b))
+	_, err := d.w.Write(b)
+	return err
+}
+
+// DumpReader reads the records of a dump.
+type DumpReader struct {
+	r     *crcReader
+	count int64
+	done  bool
+}
+
+// NewDumpReader checks the header of the dump in r and returns a reader
+// for its records.
+func NewDumpReader(r io.Reader) (*DumpReader, error) {
+	header := make([]byte, len(dumpMagic)+2)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, ErrCorruptDump
+	}
+	if string(header[:len(dumpMagic)]) != string(dumpMagic) {
+		return nil, &Error{Message: "not a dump"}
+	}
+	if header[len(dumpMagic)] != dumpVersion {
+		return nil, &Error{Message: fmt.Sprintf("unsupported dump version %d", header[len(dumpMagic)])}
+	}
+	body := bufio.NewReader(r)
+	if header[len(dumpMagic)+1]&dumpGzip != 0 {
+		zr, err := gzip.NewReader(body)
+		if err != nil {
+			return nil, ErrCorruptDump
+		}
+		body = bufio.NewReader(zr)
+	}
+	return &DumpReader{r: &crcReader{r: body}}, nil
+}
+
+// Next returns the next record of the dump. It returns io.EOF after the
+// last record, once the trailer has been verified.
+func (d *DumpReader) Next() (Record, error) {
+	if d.done {
+		return Record{}, io.EOF
+	}
+	rec, err := d.next()
+	switch err {
+	case io.EOF:
+		d.done = true
+	case io.ErrUnexpectedEOF:
+		err = ErrCorruptDump
+	}
+	return rec, err
+}
+
+func (d *DumpReader) next() (Record, error) {
+	r := d.r
+	r.crc = 0
+	typ, err := r.ReadByte()
+	if err != nil {
+		return Record{}, io.ErrUnexpectedEOF
+	}
+	switch typ {
+	case dumpTrailer:
+		count, err := binary.ReadUvarint(r)
+		if err != nil {
+			return Record{}, io.ErrUnexpectedEOF
+		}
+		if err := r.checkCRC(); err != nil {
+			return Record{}, err
+		}
+		if int64(count) != d.count {
+			return Record{}, ErrCorruptDump
+		}
+		return Record{}, io.EOF
+	case dumpRecord:
+	default:
+		return Record{}, ErrCorruptDump
+	}
+	key, err := r.readBytes()
+	if err != nil {
+		return Record{}, err
+	}
+	value, err := r.readBytes()
+	if err != nil {
+		return Record{}, err
+	}
+	xt, err := binary.ReadVarint(r)
+	if err != nil {
+		return Record{}, io.ErrUnexpectedEOF
+	}
+	if err := r.checkCRC(); err != nil {
+		return Record{}, err
+	}
+	rec := Record{Key: string(key), Value: value}
+	if xt != 0 {
+		rec.Expires = time.Unix(xt, 0)
+	}
+	d.count++
+	return rec, nil
+}
+
+// maxDumpField bounds the length of keys and values read from a dump, so
+// that a corrupt length does not trigger a huge allocation.
+const maxDumpField = 1 << 30
+
+// crcReader computes the CRC-32 of the bytes read since it was reset.
+type crcReader struct {
+	r   *bufio.Reader
+	crc uint32
+}
+
+func (c *crcReader) ReadByte() (byte, error) {
+	b, err := c.r.ReadByte()
+	if err == nil {
+		c.crc = crc32.Update(c.crc, crc32.IEEETable, []byte{b})
+	}
+	return b, err
+}
+
+func (c *crcReader) readBytes() ([]byte, error) {
+	n, err := binary.ReadUvarint(c)
+	if err != nil {
+		return nil, io.ErrUnexpectedEOF
+	}
+	if n > maxDumpField {
+		return nil, ErrCorruptDump
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(c.r, b); err != nil {
+		return nil, io.ErrUnexpectedEOF
+	}
+	c.crc = crc32.Update(c.crc, crc32.IEEETable, b)
+	return b, nil
+}
+
+func (c *crcReader) checkCRC() error {
+	var sum [4]byte
+	if _, err := io.ReadFull(c.r, sum[:]); err != nil {
+		return io.ErrUnexpectedEOF
+	}
+	if binary.BigEndian.Uint32(sum[:]) != c.crc {
+		return ErrCorruptDump
+	}
+	return nil
+}
+
+// RestoreOptions configures Restore.
+type RestoreOptions struct {
+	// ChunkSize is the maximum number of records per set_bulk call.
+	// Defaults to 500.
+	ChunkSize int
+	// Skip the first Skip records of the dump, to resume an interrupted
+	// restore from the count last reported to Progress.
+	Skip int64
+	// Progress, if set, is called after every chunk with the number of
+	// records of the dump processed so far, including skipped ones.
+	Progress func(processed int64)
+}
+
+// Restore writes the records of the dump in r to c with chunked
+// set_bulk calls, keeping their expiration times. Records that have
+// expired since the dump was taken are not restored. It returns the
+// number of records processed, which can be passed as opts.Skip to
+// resume after a failure.
+func Restore(ctx context.Context, c *Conn, r io.Reader, opts RestoreOptions) (int64, error) {
+	dr, err := NewDumpReader(r)
+	if err != nil {
+		return 0, err
+	}
+	if opts.ChunkSize <= 0 {
+		opts.ChunkSize = 500
+	}
+
+	// processed counts the records written or deliberately skipped,
+	// pending those read since the last flush.
+	var processed, pending int64
+	var chunk []KV
+	var chunkXT int64
+	flush := func() error {
+		if len(chunk) > 0 {
+			if _, err := c.doSetBulk(ctx, chunk, chunkXT); err != nil {
+				return err
+			}
+		}
+		processed += pending
+		pending = 0
+		chunk = chunk[:0]
+		if opts.Progress != nil {
+			opts.Progress(processed)
+		}
+		return nil
+	}
+
+	for {
+		rec, err := dr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return processed, err
+		}
+		if processed < opts.Skip {
+			processed++
+			continue
+		}
+		// set_bulk takes a single expiration time, so records with a
+		// different one start a new chunk. Negative means absolute.
+		var xt int64
+		if !rec.Expires.IsZero() {
+			if !rec.Expires.After(time.Now()) {
+				pending++
+				continue
+			}
+			xt = -rec.Expires.Unix()
+		}
+		if len(chunk) > 0 && (xt != chunkXT || len(chunk) >= opts.ChunkSize) {
+			if err := flush(); err != nil {
+				return processed, err
+			}
+		}
+		chunkXT = xt
+		chunk = append(chunk, KV{rec.Key, rec.Value})
+		pending++
+	}
+	if err := flush(); err != nil {
+		return processed, err
+	}
+	return processed, nil
+}
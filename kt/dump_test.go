@@ -0,0 +1,180 @@
+package kt
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// dumpOf dumps the records of f.
+func dumpOf(t *testing.T, f *fakeKT, opts DumpOptions) []byte {
+	t.Helper()
+	db := f.conn(t)
+	defer db.Close(context.Background())
+	var buf bytes.Buffer
+	if _, err := Dump(context.Background(), db, &buf, opts); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func readTestDump(b []byte) ([]Record, error) {
+	dr, err := NewDumpReader(bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	var recs []Record
+	for {
+		rec, err := dr.Next()
+		if err == io.EOF {
+			return recs, nil
+		}
+		if err != nil {
+			return recs, err
+		}
+		recs = append(recs, rec)
+	}
+}
+
+// newTestDumpSource returns a fakeKT holding records under "p/" and one
+// record outside of it.
+func newTestDumpSource() *fakeKT {
+	f := newFakeKT()
+	f.put("p/a", []byte("1"), 0)
+	f.put("p/b", []byte{0, 1, 2}, 4102444800)
+	f.put("p/c", []byte{}, 0)
+	f.put("q", []byte("other"), 0)
+	return f
+}
+
+func TestDumpRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	for _, compress := range []bool{false, true} {
+		src := newTestDumpSource()
+		var buf bytes.Buffer
+		srcConn := src.conn(t)
+		n, err := Dump(ctx, srcConn, &buf, DumpOptions{Prefix: "p/", Compress: compress})
+		srcConn.Close(ctx)
+		if err != nil {
+			t.Fatalf("compress=%v: Dump: %v", compress, err)
+		}
+		if n != 3 {
+			t.Errorf("compress=%v: Dump wrote %d records, want 3", compress, n)
+		}
+		if gzipped := buf.Bytes()[len(dumpMagic)+1]&dumpGzip != 0; gzipped != compress {
+			t.Errorf("compress=%v: gzip flag %v", compress, gzipped)
+		}
+
+		dst := newFakeKT()
+		dstConn := dst.conn(t)
+		n, err = Restore(ctx, dstConn, &buf, RestoreOptions{})
+		dstConn.Close(ctx)
+		if err != nil {
+			t.Fatalf("compress=%v: Restore: %v", compress, err)
+		}
+		if n != 3 {
+			t.Errorf("compress=%v: Restore processed %d records, want 3", compress, n)
+		}
+		delete(src.recs, "q")
+		if len(dst.recs) != len(src.recs) {
+			t.Errorf("compress=%v: restored %d records, want %d", compress, len(dst.recs), len(src.recs))
+		}
+		for k, want := range src.recs {
+			if got := dst.recs[k]; !bytes.Equal(got.value, want.value) || got.xt != want.xt {
+				t.Errorf("compress=%v: restored %q as %v, want %v", compress, k, got, want)
+			}
+		}
+	}
+}
+
+func TestDumpCorruption(t *testing.T) {
+	dump := dumpOf(t, newTestDumpSource(), DumpOptions{})
+	if recs, err := readTestDump(dump); err != nil || len(recs) != 4 {
+		t.Fatalf("reading the dump: %d records, %v", len(recs), err)
+	}
+	for i := len(dumpMagic) + 2; i < len(dump); i++ {
+		corrupt := append([]byte(nil), dump...)
+		corrupt[i] ^= 0x40
+		if _, err := readTestDump(corrupt); err == nil {
+			t.Errorf("flipping byte %d went unnoticed", i)
+		}
+	}
+	for n := len(dumpMagic) + 2; n < len(dump); n++ {
+		if _, err := readTestDump(dump[:n]); err != ErrCorruptDump {
+			t.Errorf("truncating to %d bytes: want ErrCorruptDump, got %v", n, err)
+		}
+	}
+}
+
+func TestRestoreChunks(t *testing.T) {
+	var mu sync.Mutex
+	var calls []string
+	host, port := startFakeServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		kvs, err := DecodeValues(body, r.Header.Get("Content-Type"))
+		if err != nil {
+			t.Error(err)
+		}
+		if r.URL.Path == "/rpc/set_bulk" {
+			var desc string
+			for _, kv := range kvs {
+				desc += kv.Key + "=" + string(kv.Value) + " "
+			}
+			mu.Lock()
+			calls = append(calls, desc)
+			mu.Unlock()
+		}
+		w.Header().Set("Content-Type", "text/tab-separated-values")
+		w.Write([]byte("num\t" + strconv.Itoa(len(kvs)) + "\n"))
+	}))
+	db, err := NewConn(host, port, 1, DEFAULT_TIMEOUT)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// e expires between the dump and the restore.
+	src := newFakeKT()
+	soon := time.Now().Unix() + 1
+	for i, k := range []string{"a", "b", "c", "d", "e", "f"} {
+		var xt int64
+		switch k {
+		case "d", "f":
+			xt = 4102444800
+		case "e":
+			xt = soon
+		}
+		src.put(k, []byte(strconv.Itoa(i+1)), xt)
+	}
+	dump := dumpOf(t, src, DumpOptions{Compress: true})
+	time.Sleep(time.Until(time.Unix(soon, 0)))
+
+	var progress []int64
+	n, err := Restore(context.Background(), db, bytes.NewReader(dump), RestoreOptions{
+		ChunkSize: 2,
+		Skip:      1,
+		Progress:  func(p int64) { progress = append(progress, p) },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 6 {
+		t.Errorf("Restore: want 6 records processed, got %d", n)
+	}
+	want := []string{
+		"_b=2 _c=3 ",
+		"_d=4 _f=6 xt=-4102444800 ",
+	}
+	if !reflect.DeepEqual(calls, want) {
+		t.Errorf("set_bulk calls: want %q, got %q", want, calls)
+	}
+	if wantProgress := []int64{3, 6}; !reflect.DeepEqual(progress, wantProgress) {
+		t.Errorf("progress: want %v, got %v", wantProgress, progress)
+	}
+}
@@ -0,0 +1,293 @@
+package kt
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeKT is an in-memory stand-in for ktserver implementing the REST
+// calls and the RPCs used by the package, with expiration times and
+// cursors. Keys are kept sorted, like in a tree database.
+type fakeKT struct {
+	mu      sync.Mutex
+	recs    map[string]fakeRec
+	cursors map[string]string
+	calls   map[string]int
+}
+
+type fakeRec struct {
+	value []byte
+	xt    int64
+}
+
+func newFakeKT() *fakeKT {
+	return &fakeKT{
+		recs:    make(map[string]fakeRec),
+		cursors: make(map[string]string),
+		calls:   make(map[string]int),
+	}
+}
+
+// conn starts a server for f and connects to it.
+func (f *fakeKT) conn(t testing.TB, opts ...Option) *Conn {
+	host, port := startFakeServer(t, f)
+	db, err := NewConn(host, port, 1, DEFAULT_TIMEOUT, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+// put stores a record directly, bypassing HTTP.
+func (f *fakeKT) put(key string, value []byte, xt int64) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.recs[key] = fakeRec{value: append([]byte(nil), value...), xt: xt}
+}
+
+// lookup returns the live record at key.
+func (f *fakeKT) lookup(key string) (fakeRec, bool) {
+	rec, ok := f.recs[key]
+	if ok && rec.xt != 0 && rec.xt <= time.Now().Unix() {
+		delete(f.recs, key)
+		return fakeRec{}, false
+	}
+	return rec, ok
+}
+
+func (f *fakeKT) sortedKeys() []string {
+	keys := make([]string, 0, len(f.recs))
+	for k := range f.recs {
+		if _, ok := f.lookup(k); ok {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// expiry converts an xt parameter to an absolute UNIX time.
+func expiry(kvs []KV) int64 {
+	xt, _ := strconv.ParseInt(string(findRec(kvs, "xt").Value), 10, 64)
+	switch {
+	case xt > 0:
+		return time.Now().Unix() + xt
+	case xt < 0:
+		return -xt
+	}
+	return 0
+}
+
+func (f *fakeKT) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls[r.Method+" "+r.URL.Path]++
+
+	body, _ := ioutil.ReadAll(r.Body)
+	if !strings.HasPrefix(r.URL.Path, "/rpc/") {
+		f.serveREST(w, r, body)
+		return
+	}
+	in, err := DecodeValues(body, r.Header.Get("Content-Type"))
+	if err != nil {
+		w.WriteHeader(400)
+		return
+	}
+	code, out := f.serveRPC(r.URL.Path, in)
+	resp, enc := TSVEncode(out)
+	w.Header().Set("Content-Type", enc.ContentType())
+	w.WriteHeader(code)
+	w.Write(resp)
+}
+
+func (f *fakeKT) serveREST(w http.ResponseWriter, r *http.Request, body []byte) {
+	key, err := url.QueryUnescape(strings.TrimPrefix(r.URL.EscapedPath(), "/"))
+	if err != nil {
+		w.WriteHeader(400)
+		return
+	}
+	switch r.Method {
+	case "GET", "HEAD":
+		rec, ok := f.lookup(key)
+		if !ok {
+			w.WriteHeader(404)
+			return
+		}
+		if rec.xt != 0 {
+			w.Header().Set("X-Kt-Xt", time.Unix(rec.xt, 0).UTC().Format(http.TimeFormat))
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(rec.value)))
+		w.WriteHeader(200)
+		if r.Method == "GET" {
+			w.Write(rec.value)
+		}
+	case "PUT":
+		f.recs[key] = fakeRec{value: body}
+		w.WriteHeader(201)
+	case "DELETE":
+		if _, ok := f.lookup(key); !ok {
+			w.WriteHeader(404)
+			return
+		}
+		delete(f.recs, key)
+		w.WriteHeader(204)
+	default:
+		w.WriteHeader(405)
+	}
+}
+
+func (f *fakeKT) serveRPC(path string, in []KV) (int, []KV) {
+	key := string(findRec(in, "key").Value)
+	switch path {
+	case "/rpc/void":
+		return 200, nil
+	case "/rpc/status":
+		return 200, []KV{{"count", []byte(strconv.Itoa(len(f.sortedKeys())))}}
+	case "/rpc/set":
+		f.recs[key] = fakeRec{value: findRec(in, "value").Value, xt: expiry(in)}
+		return 200, nil
+	case "/rpc/add":
+		if _, ok := f.lookup(key); ok {
+			return 450, []KV{{"ERROR", []byte("DB: 6: record duplication")}}
+		}
+		f.recs[key] = fakeRec{value: findRec(in, "value").Value, xt: expiry(in)}
+		return 200, nil
+	case "/rpc/cas":
+		rec, ok := f.lookup(key)
+		oval, nval := findRec(in, "oval"), findRec(in, "nval")
+		if ok != (oval.Key != "") || ok && string(rec.value) != string(oval.Value) {
+			return 450, []KV{{"ERROR", []byte("DB: 7: status conflict")}}
+		}
+		if nval.Key == "" {
+			delete(f.recs, key)
+		} else {
+			f.recs[key] = fakeRec{value: nval.Value, xt: expiry(in)}
+		}
+		return 200, nil
+	case "/rpc/seize":
+		rec, ok := f.lookup(key)
+		if !ok {
+			return 450, []KV{{"ERROR", []byte("DB: 7: no record")}}
+		}
+		delete(f.recs, key)
+		out := []KV{{"value", rec.value}}
+		if rec.xt != 0 {
+			out = append(out, KV{"xt", []byte(strconv.FormatInt(rec.xt, 10))})
+		}
+		return 200, out
+	case "/rpc/increment":
+		n, _ := strconv.ParseInt(string(findRec(in, "num").Value), 10, 64)
+		rec, ok := f.lookup(key)
+		if ok {
+			if len(rec.value) != 8 {
+				return 450, []KV{{"ERROR", []byte("DB: 8: logical inconsistency")}}
+			}
+			n += int64(binary.BigEndian.Uint64(rec.value))
+		} else {
+			rec.xt = expiry(in)
+		}
+		rec.value = binary.BigEndian.AppendUint64(nil, uint64(n))
+		f.recs[key] = rec
+		return 200, []KV{{"num", []byte(strconv.FormatInt(n, 10))}}
+	case "/rpc/get_bulk":
+		var out []KV
+		for _, kv := range in {
+			if strings.HasPrefix(kv.Key, "_") {
+				if rec, ok := f.lookup(kv.Key[1:]); ok {
+					out = append(out, KV{kv.Key, rec.value})
+				}
+			}
+		}
+		return 200, append(out, KV{"num", []byte(strconv.Itoa(len(out)))})
+	case "/rpc/set_bulk":
+		n := 0
+		for _, kv := range in {
+			if strings.HasPrefix(kv.Key, "_") {
+				f.recs[kv.Key[1:]] = fakeRec{value: kv.Value, xt: expiry(in)}
+				n++
+			}
+		}
+		return 200, []KV{{"num", []byte(strconv.Itoa(n))}}
+	case "/rpc/remove_bulk":
+		n := 0
+		for _, kv := range in {
+			if strings.HasPrefix(kv.Key, "_") {
+				if _, ok := f.lookup(kv.Key[1:]); ok {
+					delete(f.recs, kv.Key[1:])
+					n++
+				}
+			}
+		}
+		return 200, []KV{{"num", []byte(strconv.Itoa(n))}}
+	case "/rpc/match_prefix", "/rpc/match_regex":
+		max, _ := strconv.Atoi(string(findRec(in, "max").Value))
+		var re *regexp.Regexp
+		if path == "/rpc/match_regex" {
+			var err error
+			if re, err = regexp.Compile(string(findRec(in, "regex").Value)); err != nil {
+				return 400, []KV{{"ERROR", []byte("invalid regex")}}
+			}
+		}
+		prefix := string(findRec(in, "prefix").Value)
+		var out []KV
+		for _, k := range f.sortedKeys() {
+			if max >= 0 && len(out) >= max {
+				break
+			}
+			if re != nil && re.MatchString(k) || re == nil && strings.HasPrefix(k, prefix) {
+				out = append(out, KV{"_" + k, []byte(strconv.Itoa(len(out)))})
+			}
+		}
+		return 200, append(out, KV{"num", []byte(strconv.Itoa(len(out)))})
+	case "/rpc/cur_jump":
+		f.cursors[string(findRec(in, "CUR").Value)] = key
+		if _, ok := f.cursorKey(string(findRec(in, "CUR").Value)); !ok {
+			return 450, []KV{{"ERROR", []byte("DB: 7: no record")}}
+		}
+		return 200, nil
+	case "/rpc/cur_get":
+		cur := string(findRec(in, "CUR").Value)
+		k, ok := f.cursorKey(cur)
+		if !ok {
+			return 450, []KV{{"ERROR", []byte("DB: 7: no record")}}
+		}
+		rec, _ := f.lookup(k)
+		f.cursors[cur] = k + "\x00"
+		out := []KV{{"key", []byte(k)}, {"value", rec.value}}
+		if rec.xt != 0 {
+			out = append(out, KV{"xt", []byte(strconv.FormatInt(rec.xt, 10))})
+		}
+		return 200, out
+	}
+	return 501, []KV{{"ERROR", []byte("not implemented")}}
+}
+
+// cursorKey returns the key of the record a cursor is positioned on.
+func (f *fakeKT) cursorKey(cur string) (string, bool) {
+	pos, ok := f.cursors[cur]
+	if !ok {
+		return "", false
+	}
+	var key string
+	found := false
+	for k := range f.recs {
+		if k >= pos && (!found || k < key) {
+			if _, ok := f.lookup(k); ok {
+				key, found = k, true
+			}
+		}
+	}
+	if !found {
+		delete(f.cursors, cur)
+	}
+	return key, found
+}
@@ -0,0 +1,324 @@
+package kt
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/http"
+	"os"
+	"regexp"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// FaultKind is the effect of a Fault.
+type FaultKind int
+
+const (
+	// FaultLatency delays the operation by Latency, then lets it run.
+	FaultLatency FaultKind = iota
+	// FaultTimeout fails the operation with ErrTimeout after Latency,
+	// without running it.
+	FaultTimeout
+	// FaultReset fails the operation with a connection reset error,
+	// without running it.
+	FaultReset
+	// FaultError fails the operation with a KT error of status Code and
+	// Message, without running it. A Code of 404 gives ErrNotFound.
+	FaultError
+	// FaultPartial runs GetBulk and GetBulkBytes, then drops a Fraction
+	// of the records found, as if they were missing. It has no effect on
+	// other operations.
+	FaultPartial
+
+	numFaultKinds = iota
+)
+
+var faultKindNames = [numFaultKinds]string{"latency", "timeout", "reset", "error", "partial"}
+
+func (k FaultKind) String() string {
+	if k >= 0 && k < numFaultKinds {
+		return faultKindNames[k]
+	}
+	return fmt.Sprintf("FaultKind(%d)", int(k))
+}
+
+func (k FaultKind) MarshalText() ([]byte, error) {
+	return []byte(k.String()), nil
+}
+
+func (k *FaultKind) UnmarshalText(text []byte) error {
+	for i, name := range faultKindNames {
+		if string(text) == name {
+			*k = FaultKind(i)
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown fault kind %q", text)
+}
+
+// Fault describes a fault to inject into the operations it matches. In
+// JSON, Latency is a string such as "200ms".
+type Fault struct {
+	Kind FaultKind `json:"kind"`
+	// Probability that a matching operation suffers the fault, from 0
+	// to 1.
+	Probability float64 `json:"probability"`
+	// Ops restricts the fault to these operations, Op constants. All
+	// operations match if it is empty.
+	Ops []string `json:"ops,omitempty"`
+	// Keys restricts the fault to operations on at least one key
+	// matching this regular expression. Operations without keys, such as
+	// Count, only match an empty Keys.
+	Keys string `json:"keys,omitempty"`
+	// Latency before the operation runs for FaultLatency, or before it
+	// fails for FaultTimeout.
+	Latency time.Duration `json:"-"`
+	// Code and Message of the error returned for FaultError. Code
+	// defaults to 500.
+	Code    int    `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+	// Fraction of the records dropped by FaultPartial. Defaults to 0.5.
+	Fraction float64 `json:"fraction,omitempty"`
+
+	keys *regexp.Regexp
+}
+
+func (f *Fault) UnmarshalJSON(b []byte) error {
+	type fault Fault
+	var v struct {
+		fault
+		Latency string `json:"latency"`
+	}
+	if err := json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+	*f = Fault(v.fault)
+	if v.Latency != "" {
+		d, err := time.ParseDuration(v.Latency)
+		if err != nil {
+			return err
+		}
+		f.Latency = d
+	}
+	return nil
+}
+
+func (f Fault) MarshalJSON() ([]byte, error) {
+	type fault Fault
+	v := struct {
+		fault
+		Latency string `json:"latency,omitempty"`
+	}{fault: fault(f)}
+	if f.Latency != 0 {
+		v.Latency = f.Latency.String()
+	}
+	return json.Marshal(v)
+}
+
+func (f *Fault) matches(call *Call) bool {
+	if len(f.Ops) > 0 {
+		found := false
+		for _, op := range f.Ops {
+			if op == call.Op {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if f.keys != nil {
+		for _, k := range call.Keys {
+			if f.keys.MatchString(k) {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// FaultInjector makes operations fail or slow down on purpose, to
+// exercise the error handling of their callers. Faults are injected by
+// an interceptor, see Interceptor, and can be changed at any time.
+// FaultInjector is safe for concurrent use.
+type FaultInjector struct {
+	faults   atomic.Pointer[[]Fault]
+	injected [numFaultKinds]atomic.Uint64
+
+	// mu serializes the updates made through the HTTP handler.
+	mu sync.Mutex
+}
+
+// NewFaultInjector returns an injector of faults. It injects none until
+// SetFaults is called.
+func NewFaultInjector() *FaultInjector {
+	return new(FaultInjector)
+}
+
+// SetFaults replaces the faults injected. Every matching fault applies,
+// in order: latencies add up, and the first fault failing the operation
+// ends it. It returns an error if a fault is invalid, in which case the
+// faults are left unchanged.
+func (fi *FaultInjector) SetFaults(faults []Fault) error {
+	fs := make([]Fault, len(faults))
+	for i, f := range faults {
+		if f.Kind < 0 || f.Kind >= numFaultKinds {
+			return fmt.Errorf("fault %d: unknown kind %d", i, f.Kind)
+		}
+		if f.Probability < 0 || f.Probability > 1 {
+			return fmt.Errorf("fault %d: probability %v out of [0, 1]", i, f.Probability)
+		}
+		if f.Keys != "" {
+			re, err := regexp.Compile(f.Keys)
+			if err != nil {
+				return fmt.Errorf("fault %d: %s", i, err)
+			}
+			f.keys = re
+		}
+		if f.Kind == FaultError && f.Code == 0 {
+			f.Code = 500
+		}
+		if f.Kind == FaultPartial && f.Fraction <= 0 {
+			f.Fraction = 0.5
+		}
+		fs[i] = f
+	}
+	fi.faults.Store(&fs)
+	return nil
+}
+
+// Faults returns the faults currently injected.
+func (fi *FaultInjector) Faults() []Fault {
+	if fs := fi.faults.Load(); fs != nil {
+		return append([]Fault(nil), (*fs)...)
+	}
+	return nil
+}
+
+// Injected returns the number of faults of a kind injected so far.
+func (fi *FaultInjector) Injected(kind FaultKind) uint64 {
+	if kind < 0 || kind >= numFaultKinds {
+		return 0
+	}
+	return fi.injected[kind].Load()
+}
+
+// Wrap returns a client injecting faults into the operations of c.
+func (fi *FaultInjector) Wrap(c Client) Client {
+	return Intercept(c, fi.Interceptor())
+}
+
+// Interceptor returns an interceptor injecting faults into the
+// operations going through it.
+func (fi *FaultInjector) Interceptor() Interceptor {
+	return func(ctx context.Context, call *Call, invoker Invoker) error {
+		fs := fi.faults.Load()
+		if fs == nil {
+			return invoker(ctx, call)
+		}
+		var partial []float64
+		for i := range *fs {
+			f := &(*fs)[i]
+			if !f.matches(call) || rand.Float64() >= f.Probability {
+				continue
+			}
+			fi.injected[f.Kind].Add(1)
+			switch f.Kind {
+			case FaultLatency, FaultTimeout:
+				if err := sleepContext(ctx, f.Latency); err != nil {
+					return err
+				}
+				if f.Kind == FaultTimeout {
+					return ErrTimeout
+				}
+			case FaultReset:
+				return &net.OpError{Op: "read", Net: "tcp", Err: os.NewSyscallError("read", syscall.ECONNRESET)}
+			case FaultError:
+				if f.Code == 404 {
+					return ErrNotFound
+				}
+				return &Error{Message: f.Message, Code: f.Code}
+			case FaultPartial:
+				partial = append(partial, f.Fraction)
+			}
+		}
+		err := invoker(ctx, call)
+		for _, fraction := range partial {
+			dropRecords(call.Reply, fraction)
+		}
+		return err
+	}
+}
+
+// dropRecords removes a fraction of the records of a bulk reply, chosen
+// at random.
+func dropRecords(reply interface{}, fraction float64) {
+	switch m := reply.(type) {
+	case map[string]string:
+		for k := range m {
+			if rand.Float64() < fraction {
+				delete(m, k)
+			}
+		}
+	case map[string][]byte:
+		for k := range m {
+			if rand.Float64() < fraction {
+				delete(m, k)
+			}
+		}
+	}
+}
+
+func sleepContext(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return nil
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
+
+// ServeHTTP lets the faults be changed at runtime. GET returns the
+// current faults as a JSON array, PUT replaces them with the JSON array
+// in the body, and DELETE removes them all.
+func (fi *FaultInjector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	fi.mu.Lock()
+	defer fi.mu.Unlock()
+	switch r.Method {
+	case "GET":
+	case "PUT":
+		var faults []Fault
+		if err := json.NewDecoder(r.Body).Decode(&faults); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := fi.SetFaults(faults); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	case "DELETE":
+		fi.SetFaults(nil)
+	default:
+		w.Header().Set("Allow", "GET, PUT, DELETE")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	faults := fi.Faults()
+	if faults == nil {
+		faults = []Fault{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(faults)
+}
@@ -0,0 +1,132 @@
+package kt
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestFaultInjector(t *testing.T) {
+	ctx := context.Background()
+	m := newMemClient()
+	for _, k := range []string{"a", "b", "c", "user:1", "user:2"} {
+		m.Set(ctx, k, []byte(k))
+	}
+	fi := NewFaultInjector()
+	c := fi.Wrap(m)
+
+	if _, err := c.Get(ctx, "a"); err != nil {
+		t.Fatalf("no faults: %v", err)
+	}
+
+	if err := fi.SetFaults([]Fault{
+		{Kind: FaultError, Probability: 1, Ops: []string{OpGet}, Keys: "^user:", Code: 503, Message: "busy"},
+		{Kind: FaultReset, Probability: 1, Ops: []string{OpSet}},
+		{Kind: FaultError, Probability: 1, Ops: []string{OpRemove}, Code: 404},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Get(ctx, "a"); err != nil {
+		t.Errorf("key not matching: %v", err)
+	}
+	_, err := c.Get(ctx, "user:1")
+	if e, ok := err.(*Error); !ok || e.Code != 503 || e.Message != "busy" {
+		t.Errorf("FaultError: got %v", err)
+	}
+	if err := c.Set(ctx, "a", []byte("x")); !errors.Is(err, syscall.ECONNRESET) {
+		t.Errorf("FaultReset: got %v", err)
+	}
+	if v, _ := m.Get(ctx, "a"); v != "a" {
+		t.Errorf("failed Set ran: %q", v)
+	}
+	if err := c.Remove(ctx, "a"); err != ErrNotFound {
+		t.Errorf("FaultError 404: got %v", err)
+	}
+	if fi.Injected(FaultError) != 2 || fi.Injected(FaultReset) != 1 {
+		t.Errorf("Injected: %d errors, %d resets", fi.Injected(FaultError), fi.Injected(FaultReset))
+	}
+
+	fi.SetFaults([]Fault{{Kind: FaultTimeout, Probability: 1, Latency: 10 * time.Millisecond}})
+	start := time.Now()
+	if _, err := c.Count(ctx); err != ErrTimeout {
+		t.Errorf("FaultTimeout: got %v", err)
+	}
+	if d := time.Since(start); d < 10*time.Millisecond {
+		t.Errorf("FaultTimeout returned after %v", d)
+	}
+
+	fi.SetFaults([]Fault{{Kind: FaultLatency, Probability: 1, Latency: time.Hour}})
+	cctx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	if _, err := c.Get(cctx, "a"); err != context.DeadlineExceeded {
+		t.Errorf("FaultLatency past the deadline: got %v", err)
+	}
+
+	fi.SetFaults([]Fault{{Kind: FaultPartial, Probability: 1, Fraction: 1}})
+	bulk := map[string]string{"a": "", "b": "", "c": ""}
+	if err := c.GetBulk(ctx, bulk); err != nil || len(bulk) != 0 {
+		t.Errorf("FaultPartial: got %v, %v", bulk, err)
+	}
+
+	fi.SetFaults([]Fault{{Kind: FaultReset, Probability: 0}})
+	if _, err := c.Get(ctx, "a"); err != nil {
+		t.Errorf("zero probability: %v", err)
+	}
+
+	for _, f := range []Fault{
+		{Kind: FaultKind(42), Probability: 1},
+		{Kind: FaultError, Probability: 2},
+		{Kind: FaultError, Probability: 1, Keys: "("},
+	} {
+		if err := fi.SetFaults([]Fault{f}); err == nil {
+			t.Errorf("invalid fault %+v accepted", f)
+		}
+	}
+}
+
+func TestFaultInjectorHTTP(t *testing.T) {
+	fi := NewFaultInjector()
+	do := func(method, body string) (int, string) {
+		w := httptest.NewRecorder()
+		fi.ServeHTTP(w, httptest.NewRequest(method, "/faults", strings.NewReader(body)))
+		return w.Code, strings.TrimSpace(w.Body.String())
+	}
+
+	if code, body := do("GET", ""); code != 200 || body != "[]" {
+		t.Errorf("GET: %d %s", code, body)
+	}
+	code, body := do("PUT", `[{"kind":"error","probability":0.5,"ops":["GET"],"keys":"^user:"}]`)
+	if code != 200 || !strings.Contains(body, `"kind":"error"`) || !strings.Contains(body, `"code":500`) {
+		t.Errorf("PUT: %d %s", code, body)
+	}
+	if fs := fi.Faults(); len(fs) != 1 || fs[0].Kind != FaultError || fs[0].Keys != "^user:" {
+		t.Errorf("faults after PUT: %+v", fs)
+	}
+	code, body = do("PUT", `[{"kind":"latency","probability":1,"latency":"200ms"}]`)
+	if code != 200 || !strings.Contains(body, `"latency":"200ms"`) {
+		t.Errorf("PUT of a latency: %d %s", code, body)
+	}
+	if fs := fi.Faults(); len(fs) != 1 || fs[0].Latency != 200*time.Millisecond {
+		t.Errorf("faults after PUT of a latency: %+v", fs)
+	}
+	if code, _ := do("PUT", `[{"kind":"latency","latency":"soon"}]`); code != http.StatusBadRequest {
+		t.Errorf("PUT of an invalid latency: %d", code)
+	}
+	if code, _ := do("PUT", `[{"kind":"flood"}]`); code != http.StatusBadRequest {
+		t.Errorf("PUT of an unknown kind: %d", code)
+	}
+	if len(fi.Faults()) != 1 {
+		t.Error("invalid PUT changed the faults")
+	}
+	if code, body := do("DELETE", ""); code != 200 || body != "[]" {
+		t.Errorf("DELETE: %d %s", code, body)
+	}
+	if code, _ := do("POST", ""); code != http.StatusMethodNotAllowed {
+		t.Errorf("POST: %d", code)
+	}
+}
@@ -0,0 +1,343 @@
+package kt
+
+import (
+	"context"
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/cloudflare/golibs/ewma"
+)
+
+// HedgeOptions configures a HedgedConn.
+type HedgeOptions struct {
+	// Percentile of the latency of the first request after which the
+	// hedged request is sent. Defaults to 0.95.
+	Percentile float64
+	// MinDelay and MaxDelay bound the hedge delay. MaxDelay is also
+	// the delay used until latencies have been observed. They default
+	// to 1ms and 500ms.
+	MinDelay, MaxDelay time.Duration
+	// HalfLife of the moving averages used to track latencies.
+	// Defaults to 10s.
+	HalfLife time.Duration
+	// Budget is the maximum number of hedged requests per read, so
+	// that a slow cluster is not swamped with extra load. Defaults to
+	// 0.05.
+	Budget float64
+}
+
+// HedgeStats counts the reads of a HedgedConn.
+type HedgeStats struct {
+	// Reads is the number of read operations.
+	Reads uint64
+	// Hedges is the number of hedged requests sent.
+	Hedges uint64
+	// HedgeWins is the number of reads answered by the hedged request.
+	HedgeWins uint64
+	// OverBudget is the number of hedged requests not sent because the
+	// budget was exhausted.
+	OverBudget uint64
+}
+
+// HedgedConn spreads reads over replicas of the same data and, when a
+// replica is slow to answer, sends the same read to the next replica and
+// uses the first successful response. The other request is cancelled.
+//
+// The hedge delay is a percentile of the latency of each operation,
+// estimated from moving averages of its mean and variance. Only requests
+// that complete are measured, so the estimate leans towards the fast
+// replicas, which is what a hedge delay wants.
+//
+// Writes always go to the first replica, which should be the master.
+// HedgedConn is safe for concurrent use.
+type HedgedConn struct {
+	replicas []Client
+	opts     HedgeOptions
+	z        float64
+	next     uint32
+	trackers map[string]*latencyTracker
+	budget   hedgeBudget
+	stats    HedgeStats
+}
+
+// NewHedgedConn returns a client hedging reads over replicas, which
+// must not be empty.
+func NewHedgedConn(replicas []Client, opts HedgeOptions) *HedgedConn {
+	if opts.Percentile <= 0 || opts.Percentile >= 1 {
+		opts.Percentile = 0.95
+	}
+	if opts.MinDelay <= 0 {
+		opts.MinDelay = time.Millisecond
+	}
+	if opts.MaxDelay <= 0 {
+		opts.MaxDelay = 500 * time.Millisecond
+	}
+	if opts.HalfLife <= 0 {
+		opts.HalfLife = 10 * time.Second
+	}
+	if opts.Budget <= 0 {
+		opts.Budget = 0.05
+	}
+	h := &HedgedConn{
+		replicas: replicas,
+		opts:     opts,
+		// The hedge delay assumes normally distributed latencies.
+		z:        math.Sqrt2 * math.Erfinv(2*opts.Percentile-1),
+		trackers: make(map[string]*latencyTracker),
+		budget:   hedgeBudget{ratio: opts.Budget, tokens: hedgeBurst, max: hedgeBurst},
+	}
+	for _, op := range []string{OpCount, OpGet, OpGetBytes, OpGetBulk, OpGetBulkBytes, OpMatchPrefix} {
+		h.trackers[op] = &latencyTracker{halfLife: opts.HalfLife}
+	}
+	return h
+}
+
+// Stats returns the counters of the reads performed so far.
+func (h *HedgedConn) Stats() HedgeStats {
+	return HedgeStats{
+		Reads:      atomic.LoadUint64(&h.stats.Reads),
+		Hedges:     atomic.LoadUint64(&h.stats.Hedges),
+		HedgeWins:  atomic.LoadUint64(&h.stats.HedgeWins),
+		OverBudget: atomic.LoadUint64(&h.stats.OverBudget),
+	}
+}
+
+// Delay returns the current hedge delay of op.
+func (h *HedgedConn) Delay(op string) time.Duration {
+	d := h.opts.MaxDelay
+	if t, ok := h.trackers[op]; ok {
+		if est, ok := t.estimate(h.z); ok {
+			d = est
+		}
+	}
+	if d < h.opts.MinDelay {
+		d = h.opts.MinDelay
+	}
+	if d > h.opts.MaxDelay {
+		d = h.opts.MaxDelay
+	}
+	return d
+}
+
+// latencyTracker keeps moving averages of the latency of an operation
+// and of its square, in seconds.
+type latencyTracker struct {
+	mu       sync.Mutex
+	halfLife time.Duration
+	mean, sq *ewma.Ewma
+}
+
+func (t *latencyTracker) observe(d time.Duration, now time.Time) {
+	x := d.Seconds()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.mean == nil {
+		// Start from the first sample rather than from 0.
+		t.mean, t.sq = ewma.NewEwma(t.halfLife), ewma.NewEwma(t.halfLife)
+		t.mean.Current, t.sq.Current = x, x*x
+	}
+	t.mean.Update(x, now)
+	t.sq.Update(x*x, now)
+}
+
+// estimate returns the mean plus z standard deviations.
+func (t *latencyTracker) estimate(z float64) (time.Duration, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.mean == nil {
+		return 0, false
+	}
+	mean := t.mean.Current
+	variance := t.sq.Current - mean*mean
+	if variance < 0 {
+		variance = 0
+	}
+	return time.Duration((mean + z*math.Sqrt(variance)) * float64(time.Second)), true
+}
+
+// hedgeBurst is the number of hedged requests that can be sent at once
+// before the budget applies.
+const hedgeBurst = 10
+
+// hedgeBudget earns ratio tokens per read, up to max, and spends one per
+// hedged request.
+type hedgeBudget struct {
+	mu                 sync.Mutex
+	ratio, tokens, max float64
+}
+
+func (b *hedgeBudget) deposit() {
+	b.mu.Lock()
+	b.tokens = math.Min(b.tokens+b.ratio, b.max)
+	b.mu.Unlock()
+}
+
+func (b *hedgeBudget) take() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+type attempt[T any] struct {
+	v      T
+	err    error
+	hedged bool
+}
+
+// answered tells if err is a valid answer from a replica, rather than a
+// failure to get one.
+func answered(err error) bool {
+	return err == nil || err == ErrNotFound || err == ErrSuccess
+}
+
+// hedged runs fn against one replica, and against the next one if the
+// first is slower than the hedge delay or fails. It returns the first
+// answer.
+func hedged[T any](ctx context.Context, h *HedgedConn, op string, fn func(ctx context.Context, c Client) (T, error)) (T, error) {
+	atomic.AddUint64(&h.stats.Reads, 1)
+	h.budget.deposit()
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	n := uint32(len(h.replicas))
+	first := atomic.AddUint32(&h.next, 1) % n
+	results := make(chan attempt[T], 2)
+	start := func(c Client, hedged bool) {
+		go func() {
+			t0 := time.Now()
+			v, err := fn(ctx, c)
+			if answered(err) {
+				now := time.Now()
+				h.trackers[op].observe(now.Sub(t0), now)
+			}
+			results <- attempt[T]{v, err, hedged}
+		}()
+	}
+	start(h.replicas[first], false)
+	pending, sent := 1, n < 2
+	hedge := func() {
+		sent = true
+		if !h.budget.take() {
+			atomic.AddUint64(&h.stats.OverBudget, 1)
+			return
+		}
+		atomic.AddUint64(&h.stats.Hedges, 1)
+		start(h.replicas[(first+1)%n], true)
+		pending++
+	}
+
+	timer := time.NewTimer(h.Delay(op))
+	defer timer.Stop()
+	var res attempt[T]
+	for pending > 0 {
+		select {
+		case res = <-results:
+			pending--
+			if answered(res.err) {
+				if res.hedged {
+					atomic.AddUint64(&h.stats.HedgeWins, 1)
+				}
+				return res.v, res.err
+			}
+			if !sent && ctx.Err() == nil {
+				hedge()
+			}
+		case <-timer.C:
+			if !sent {
+				hedge()
+			}
+		}
+	}
+	return res.v, res.err
+}
+
+func (h *HedgedConn) Count(ctx context.Context) (int, error) {
+	return hedged(ctx, h, OpCount, func(ctx context.Context, c Client) (int, error) {
+		return c.Count(ctx)
+	})
+}
+
+func (h *HedgedConn) Get(ctx context.Context, key string) (string, error) {
+	return hedged(ctx, h, OpGet, func(ctx context.Context, c Client) (string, error) {
+		return c.Get(ctx, key)
+	})
+}
+
+func (h *HedgedConn) GetBytes(ctx context.Context, key string) ([]byte, error) {
+	return hedged(ctx, h, OpGetBytes, func(ctx context.Context, c Client) ([]byte, error) {
+		return c.GetBytes(ctx, key)
+	})
+}
+
+// GetBulk and GetBulkBytes give every request its own map, and copy the
+// winning one back into the caller's.
+
+func (h *HedgedConn) GetBulk(ctx context.Context, keysAndVals map[string]string) error {
+	m, err := hedged(ctx, h, OpGetBulk, func(ctx context.Context, c Client) (map[string]string, error) {
+		m := make(map[string]string, len(keysAndVals))
+		for k := range keysAndVals {
+			m[k] = ""
+		}
+		return m, c.GetBulk(ctx, m)
+	})
+	if err != nil {
+		return err
+	}
+	for k := range keysAndVals {
+		if v, ok := m[k]; ok {
+			keysAndVals[k] = v
+		} else {
+			delete(keysAndVals, k)
+		}
+	}
+	return nil
+}
+
+func (h *HedgedConn) GetBulkBytes(ctx context.Context, keys map[string][]byte) error {
+	m, err := hedged(ctx, h, OpGetBulkBytes, func(ctx context.Context, c Client) (map[string][]byte, error) {
+		m := make(map[string][]byte, len(keys))
+		for k := range keys {
+			m[k] = nil
+		}
+		return m, c.GetBulkBytes(ctx, m)
+	})
+	if err != nil {
+		return err
+	}
+	for k := range keys {
+		if v, ok := m[k]; ok {
+			keys[k] = v
+		} else {
+			delete(keys, k)
+		}
+	}
+	return nil
+}
+
+func (h *HedgedConn) MatchPrefix(ctx context.Context, key string, maxrecords int64) ([]string, error) {
+	return hedged(ctx, h, OpMatchPrefix, func(ctx context.Context, c Client) ([]string, error) {
+		return c.MatchPrefix(ctx, key, maxrecords)
+	})
+}
+
+func (h *HedgedConn) Set(ctx context.Context, key string, value []byte) error {
+	return h.replicas[0].Set(ctx, key, value)
+}
+
+func (h *HedgedConn) SetBulk(ctx context.Context, values map[string]string) (int64, error) {
+	return h.replicas[0].SetBulk(ctx, values)
+}
+
+func (h *HedgedConn) Remove(ctx context.Context, key string) error {
+	return h.replicas[0].Remove(ctx, key)
+}
+
+func (h *HedgedConn) RemoveBulk(ctx context.Context, keys []string) (int64, error) {
+	return h.replicas[0].RemoveBulk(ctx, keys)
+}
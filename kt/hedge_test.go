@@ -0,0 +1,106 @@
+package kt
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// slowClient delays the reads of a memClient.
+type slowClient struct {
+	*memClient
+	delay time.Duration
+}
+
+func (s slowClient) wait(ctx context.Context) error {
+	select {
+	case <-time.After(s.delay):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (s slowClient) GetBytes(ctx context.Context, key string) ([]byte, error) {
+	if err := s.wait(ctx); err != nil {
+		return nil, err
+	}
+	return s.memClient.GetBytes(ctx, key)
+}
+
+func (s slowClient) GetBulkBytes(ctx context.Context, keys map[string][]byte) error {
+	if err := s.wait(ctx); err != nil {
+		return err
+	}
+	return s.memClient.GetBulkBytes(ctx, keys)
+}
+
+func TestHedgedReads(t *testing.T) {
+	ctx := context.Background()
+	mem := newMemClient()
+	mem.Set(ctx, "a", []byte("1"))
+	h := NewHedgedConn([]Client{slowClient{mem, time.Second}, slowClient{mem, time.Millisecond}}, HedgeOptions{
+		MaxDelay: 20 * time.Millisecond,
+		Budget:   1,
+	})
+
+	start := time.Now()
+	for i := 0; i < 10; i++ {
+		if v, err := h.GetBytes(ctx, "a"); string(v) != "1" || err != nil {
+			t.Fatalf("GetBytes: %q, %v", v, err)
+		}
+		keys := map[string][]byte{"a": nil, "b": nil}
+		if err := h.GetBulkBytes(ctx, keys); err != nil || len(keys) != 1 || string(keys["a"]) != "1" {
+			t.Fatalf("GetBulkBytes: %q, %v", keys, err)
+		}
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("reads took %v despite hedging", d)
+	}
+	stats := h.Stats()
+	// Reads starting on the slow replica are all won by the hedge.
+	if stats.Reads != 20 || stats.Hedges < 10 || stats.HedgeWins != 10 || stats.OverBudget != 0 {
+		t.Errorf("stats: %+v", stats)
+	}
+	// The delay adapted to the fast replica.
+	if d := h.Delay(OpGetBytes); d > 10*time.Millisecond {
+		t.Errorf("hedge delay: %v", d)
+	}
+}
+
+func TestHedgeBudget(t *testing.T) {
+	ctx := context.Background()
+	mem := newMemClient()
+	slow := slowClient{mem, 5 * time.Millisecond}
+	h := NewHedgedConn([]Client{slow, slow}, HedgeOptions{
+		MaxDelay: time.Millisecond,
+		Budget:   0.1,
+	})
+	for i := 0; i < 100; i++ {
+		if _, err := h.GetBytes(ctx, "a"); err != ErrNotFound {
+			t.Fatal(err)
+		}
+	}
+	// The initial burst, then one hedge every ten reads.
+	stats := h.Stats()
+	if stats.Hedges < hedgeBurst+8 || stats.Hedges > hedgeBurst+10 || stats.Hedges+stats.OverBudget != 100 {
+		t.Errorf("stats: %+v", stats)
+	}
+}
+
+func TestLatencyTracker(t *testing.T) {
+	lt := &latencyTracker{halfLife: time.Second}
+	if _, ok := lt.estimate(1); ok {
+		t.Fatal("estimate without samples")
+	}
+	now := time.Now()
+	for i := 0; i < 2000; i++ {
+		now = now.Add(10 * time.Millisecond)
+		lt.observe(time.Duration(9+2*(i%2))*time.Millisecond, now)
+	}
+	// Mean 10ms, standard deviation 1ms.
+	d, _ := lt.estimate(2)
+	if d < 11500*time.Microsecond || d > 12500*time.Microsecond {
+		t.Errorf("mean + 2 stddev: want about 12ms, got %v", d)
+	}
+}
@@ -0,0 +1,218 @@
+package kt
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/cloudflare/golibs/spacesaving"
+)
+
+// HotKeyOptions configures a HotKeys observer.
+type HotKeyOptions struct {
+	// Size is the number of keys tracked. The rates of the top keys are
+	// more accurate when it is well above the number of keys reported.
+	// Defaults to 1000.
+	Size uint32
+	// HalfLife of the rates. Defaults to 30s.
+	HalfLife time.Duration
+	// Bytes also tracks the rate of value bytes exchanged with KT for
+	// each key, as stored, so after compression.
+	Bytes bool
+	// Sample is the fraction of operations observed, to bound the cost
+	// of tracking on busy clients. Rates are scaled up accordingly.
+	// Defaults to 1.
+	Sample float64
+}
+
+// HotKey is the rate of operations on a key, and optionally of bytes.
+// Rates are per second, and known to lie between the Lo and Hi bounds.
+type HotKey struct {
+	Key    string  `json:"key"`
+	LoRate float64 `json:"lo_rate"`
+	HiRate float64 `json:"hi_rate"`
+	// LoBytes and HiBytes are zero unless bytes are tracked.
+	LoBytes float64 `json:"lo_bytes"`
+	HiBytes float64 `json:"hi_bytes"`
+}
+
+// HotKeys finds the most accessed keys of Conns, with the space saving
+// algorithm of package spacesaving. Keys are counted once for each
+// operation addressing them; MatchPrefix counts its prefix.
+// HotKeys is safe for concurrent use.
+type HotKeys struct {
+	mu     sync.Mutex
+	ops    spacesaving.Rate
+	bytes  *spacesaving.Rate
+	sample float64
+	rand   *rand.Rand
+}
+
+// NewHotKeys returns an observer to pass to WithHotKeys.
+func NewHotKeys(opts HotKeyOptions) *HotKeys {
+	if opts.Size == 0 {
+		opts.Size = 1000
+	}
+	if opts.HalfLife <= 0 {
+		opts.HalfLife = 30 * time.Second
+	}
+	if opts.Sample <= 0 || opts.Sample > 1 {
+		opts.Sample = 1
+	}
+	h := &HotKeys{
+		sample: opts.Sample,
+		rand:   rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+	h.ops.Init(opts.Size, opts.HalfLife)
+	if opts.Bytes {
+		h.bytes = new(spacesaving.Rate).Init(opts.Size, opts.HalfLife)
+	}
+	return h
+}
+
+// WithHotKeys reports the keys of the operations of the Conn to h. A
+// TrackedConn built on the Conn reports the same keys. Several Conns may
+// share an observer.
+func WithHotKeys(h *HotKeys) Option {
+	return func(c *Conn) {
+		c.hotKeys = h
+	}
+}
+
+// sampled tells whether to observe an event. h.mu must be held.
+func (h *HotKeys) sampled() bool {
+	return h.sample == 1 || h.rand.Float64() < h.sample
+}
+
+// observe counts an operation on keys. It does nothing on a nil h.
+func (h *HotKeys) observe(keys keySet) {
+	if h == nil {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if !h.sampled() {
+		return
+	}
+	now := time.Now()
+	keys.each(func(key string) {
+		h.ops.Touch(key, now)
+	})
+}
+
+// observeBytes counts n value bytes exchanged for key. It does nothing on
+// a nil h, or if h does not track bytes.
+func (h *HotKeys) observeBytes(key string, n int) {
+	if h == nil || h.bytes == nil {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.sampled() {
+		h.bytes.TouchWeighted(key, float64(n), time.Now())
+	}
+}
+
+// TopK returns the k keys with the highest rate of operations, by
+// decreasing upper bound.
+func (h *HotKeys) TopK(k int) []HotKey {
+	return h.top(k, false)
+}
+
+// TopKBytes returns the k keys with the highest rate of bytes, by
+// decreasing upper bound. It returns nil if bytes are not tracked.
+func (h *HotKeys) TopKBytes(k int) []HotKey {
+	if h.bytes == nil {
+		return nil
+	}
+	return h.top(k, true)
+}
+
+func (h *HotKeys) top(k int, byBytes bool) []HotKey {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	now := time.Now()
+	primary := &h.ops
+	if byBytes {
+		primary = h.bytes
+	}
+	all := primary.GetAll(now)
+	if k < len(all) {
+		all = all[:k]
+	}
+	res := make([]HotKey, len(all))
+	for i, e := range all {
+		hk := HotKey{Key: e.Key}
+		if byBytes {
+			hk.LoBytes, hk.HiBytes = e.LoRate/h.sample, e.HiRate/h.sample
+			lo, hi := h.ops.GetSingle(e.Key, now)
+			hk.LoRate, hk.HiRate = lo/h.sample, hi/h.sample
+		} else {
+			hk.LoRate, hk.HiRate = e.LoRate/h.sample, e.HiRate/h.sample
+			if h.bytes != nil {
+				lo, hi := h.bytes.GetSingle(e.Key, now)
+				hk.LoBytes, hk.HiBytes = lo/h.sample, hi/h.sample
+			}
+		}
+		res[i] = hk
+	}
+	return res
+}
+
+// ServeHTTP lists the hot keys, as a table or, with format=json, as a
+// JSON array. The k parameter sets the number of keys, 20 by default,
+// and by=bytes ranks them by rate of bytes.
+func (h *HotKeys) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	k := 20
+	if s := r.FormValue("k"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 0 {
+			http.Error(w, "invalid k", http.StatusBadRequest)
+			return
+		}
+		k = n
+	}
+	var keys []HotKey
+	switch r.FormValue("by") {
+	case "", "ops":
+		keys = h.TopK(k)
+	case "bytes":
+		if h.bytes == nil {
+			http.Error(w, "bytes are not tracked", http.StatusNotFound)
+			return
+		}
+		keys = h.TopKBytes(k)
+	default:
+		http.Error(w, "invalid by", http.StatusBadRequest)
+		return
+	}
+
+	if r.FormValue("format") == "json" {
+		w.Header().Set("Content-Type", "application/json")
+		if keys == nil {
+			keys = []HotKey{}
+		}
+		json.NewEncoder(w).Encode(keys)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	if h.bytes != nil {
+		fmt.Fprintln(tw, "key\tops/s\tbytes/s")
+	} else {
+		fmt.Fprintln(tw, "key\tops/s")
+	}
+	for _, hk := range keys {
+		fmt.Fprintf(tw, "%q\t%.1f-%.1f", hk.Key, hk.LoRate, hk.HiRate)
+		if h.bytes != nil {
+			fmt.Fprintf(tw, "\t%.0f-%.0f", hk.LoBytes, hk.HiBytes)
+		}
+		fmt.Fprintln(tw)
+	}
+	tw.Flush()
+}
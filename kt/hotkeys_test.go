@@ -0,0 +1,71 @@
+package kt
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestHotKeys(t *testing.T) {
+	f := newFakeKT()
+	h := NewHotKeys(HotKeyOptions{Size: 10, Bytes: true})
+	db := f.conn(t, WithHotKeys(h))
+	ctx := context.Background()
+
+	big := strings.Repeat("x", 1000)
+	for i := 0; i < 50; i++ {
+		db.Get(ctx, "hot")
+		db.GetBytes(ctx, "hot")
+		db.GetBulk(ctx, map[string]string{"hot": "", "warm": ""})
+		db.Set(ctx, "warm", []byte("v"))
+		db.Set(ctx, "cold"+strconv.Itoa(i), []byte("v"))
+		if i%10 == 0 {
+			db.Set(ctx, "big", []byte(big))
+		}
+	}
+
+	top := h.TopK(2)
+	if len(top) != 2 || top[0].Key != "hot" || top[1].Key != "warm" {
+		t.Fatalf("TopK: got %+v", top)
+	}
+	if top[0].LoRate <= 0 || top[0].HiRate < top[0].LoRate {
+		t.Errorf("TopK: bad bounds %+v", top[0])
+	}
+	bytes := h.TopKBytes(1)
+	if len(bytes) != 1 || bytes[0].Key != "big" || bytes[0].HiBytes <= 0 {
+		t.Errorf("TopKBytes: got %+v", bytes)
+	}
+
+	// The handler reports the same keys.
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/?k=2&format=json", nil))
+	var got []HotKey
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 || got[0].Key != "hot" {
+		t.Errorf("handler: got %s", w.Body)
+	}
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/?by=bytes&k=1", nil))
+	if lines := strings.Split(strings.TrimSpace(w.Body.String()), "\n"); len(lines) != 2 || !strings.HasPrefix(lines[1], `"big"`) {
+		t.Errorf("text handler: got %q", w.Body)
+	}
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/?k=x", nil))
+	if w.Code != 400 {
+		t.Errorf("handler with invalid k: got status %d", w.Code)
+	}
+
+	// TrackedConn reports through the Conn.
+	tracked := NewTrackedConnWithMetrics(db, &Metrics{})
+	for i := 0; i < 500; i++ {
+		tracked.Remove(ctx, "tracked")
+	}
+	if top := h.TopK(1); top[0].Key != "tracked" {
+		t.Errorf("TopK after TrackedConn operations: got %+v", top)
+	}
+}
@@ -3,7 +3,6 @@ package kt
 import (
 	"bytes"
 	"context"
-	"encoding/base64"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -66,6 +65,42 @@ type Conn struct {
 	timeout    time.Duration
 	host       string
 	transport  *http.Transport
+	compressor *compressor
+	lifecycle  lifecycle
+	limits     []*rateLimit
+	dialConfig dialConfig
+	hotKeys    *HotKeys
+	opTimeouts map[string]time.Duration
+
+	decompressLimit int64
+}
+
+// Option configures optional behaviour of a Conn at construction time.
+type Option func(*Conn)
+
+// WithOpTimeouts sets the timeout of some operations, given by their Op
+// constants, in place of the timeout passed to the constructor. For
+// instance, bulk operations may be given more time than single key ones.
+// Timeouts only apply to operations whose context has no deadline: a
+// deadline, earlier or later, always takes precedence. Administration
+// RPCs and cursors use the timeout of the Conn.
+func WithOpTimeouts(timeouts map[string]time.Duration) Option {
+	return func(c *Conn) {
+		if c.opTimeouts == nil {
+			c.opTimeouts = make(map[string]time.Duration, len(timeouts))
+		}
+		for op, d := range timeouts {
+			c.opTimeouts[op] = d
+		}
+	}
+}
+
+// opTimeout returns the default timeout of op.
+func (c *Conn) opTimeout(op string) time.Duration {
+	if d, ok := c.opTimeouts[op]; ok && d > 0 {
+		return d
+	}
+	return c.timeout
 }
 
 func expiryCertMetric(certFile string) error {
@@ -159,7 +194,7 @@ func newTLSClientConfig(creds string) (*tls.Config, error) {
 //
 // REST format is just the body of the HTTP request being the value.
 
-func newConn(host string, port int, poolsize int, timeout time.Duration, creds string) (*Conn, error) {
+func newConn(host string, port int, poolsize int, timeout time.Duration, creds string, opts []Option) (*Conn, error) {
 	var tlsConfig *tls.Config
 	var err error
 
@@ -180,33 +215,61 @@ func newConn(host string, port int, poolsize int, timeout time.Duration, creds s
 		timeout: timeout,
 		host:    net.JoinHostPort(host, portstr),
 		transport: &http.Transport{
-			TLSClientConfig:       tlsConfig,
-			ResponseHeaderTimeout: timeout,
-			MaxIdleConnsPerHost:   poolsize,
-			IdleConnTimeout:       30 * time.Second,
+			TLSClientConfig:     tlsConfig,
+			MaxIdleConnsPerHost: poolsize,
+			IdleConnTimeout:     30 * time.Second,
 		},
 	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	if c.compressor != nil {
+		if err := c.compressor.validate(); err != nil {
+			return nil, err
+		}
+	}
+	for _, l := range c.limits {
+		if err := l.validate(); err != nil {
+			return nil, err
+		}
+	}
+	c.lifecycle.dialer, err = c.dialConfig.build(timeout)
+	if err != nil {
+		return nil, err
+	}
+	c.transport.DialContext = c.lifecycle.dial
 
 	// connectivity check so that we can bail out
 	// early instead of when we do the first operation.
 	ctx, cancel := context.WithTimeout(context.Background(), timeout)
 	defer cancel()
-	_, _, err = c.doRPC(ctx, "/rpc/void", nil)
-	if err != nil {
+	if err := c.ping(ctx); err != nil {
+		c.transport.CloseIdleConnections()
 		return nil, err
 	}
 
+	if c.lifecycle.prewarm && poolsize > 1 {
+		if err := c.prewarmPool(ctx, poolsize); err != nil {
+			c.transport.CloseIdleConnections()
+			return nil, err
+		}
+	}
+
 	return c, nil
 }
 
 // NewConnTLS creates a TLS enabled connection to a Kyoto Tycoon endpoing
-func NewConnTLS(host string, port int, poolsize int, timeout time.Duration, creds string) (*Conn, error) {
-	return newConn(host, port, poolsize, timeout, creds)
+func NewConnTLS(host string, port int, poolsize int, timeout time.Duration, creds string, opts ...Option) (*Conn, error) {
+	return newConn(host, port, poolsize, timeout, creds, opts)
 }
 
 // NewConn creates a connection to an Kyoto Tycoon endpoint.
-func NewConn(host string, port int, poolsize int, timeout time.Duration) (*Conn, error) {
-	return newConn(host, port, poolsize, timeout, "")
+// timeout bounds connecting to the server, and the operations whose
+// context has no deadline. An operation whose context is cancelled fails
+// with context.Canceled, while one that runs out of time fails with
+// ErrTimeout.
+func NewConn(host string, port int, poolsize int, timeout time.Duration, opts ...Option) (*Conn, error) {
+	return newConn(host, port, poolsize, timeout, "", opts)
 }
 
 var (
@@ -218,8 +281,20 @@ var (
 	// old gokabinet returned this error on success. Keeping around "for compatibility" until
 	// I can kill it with fire.
 	ErrSuccess = &Error{Message: "success"}
+	// ErrCASMismatch is returned by compare-and-swap operations when the
+	// stored value did not match the expected old value.
+	ErrCASMismatch = &Error{Message: "compare and swap mismatch", Code: 450}
+	// ErrExists is returned when adding a record under a key that is
+	// already in use.
+	ErrExists = &Error{Message: "record exists", Code: 450}
 )
 
+// ping checks that the server answers, with the void RPC.
+func (c *Conn) ping(ctx context.Context) error {
+	_, _, err := c.doRPC(ctx, "", "/rpc/void", nil)
+	return err
+}
+
 // RetryCount is the number of retries performed due to the remote end
 // closing idle connections.
 //
@@ -233,8 +308,12 @@ func (c *Conn) Count(ctx context.Context) (int, error) {
 	span, ctx := opentracing.StartSpanFromContext(ctx, "ktrpc Count")
 	defer span.Finish()
 	span.SetTag("url", "/rpc/status")
+	if err := c.admit(ctx, OpCount, nil); err != nil {
+		span.SetTag("status", err)
+		return 0, err
+	}
 
-	code, m, err := c.doRPC(ctx, "/rpc/status", nil)
+	code, m, err := c.doRPC(ctx, OpCount, "/rpc/status", nil)
 	if err != nil {
 		span.SetTag("status", err)
 		return 0, err
@@ -248,11 +327,38 @@ func (c *Conn) Count(ctx context.Context) (int, error) {
 	return strconv.Atoi(string(findRec(m, "count").Value))
 }
 
+// Status returns the miscellaneous status information of the database,
+// such as "count", "size" and "path", as reported by the status RPC.
+func (c *Conn) Status(ctx context.Context) (map[string]string, error) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "ktrpc Status")
+	defer span.Finish()
+
+	code, m, err := c.doRPC(ctx, "", "/rpc/status", nil)
+	if err != nil {
+		span.SetTag("status", err)
+		return nil, err
+	}
+	if code != 200 {
+		err := makeError(m)
+		span.SetTag("status", err)
+		return nil, err
+	}
+	res := make(map[string]string, len(m))
+	for _, kv := range m {
+		res[kv.Key] = string(kv.Value)
+	}
+	return res, nil
+}
+
 func (c *Conn) remove(ctx context.Context, key string) error {
 	span, ctx := opentracing.StartSpanFromContext(ctx, "ktrpc Remove")
 	defer span.Finish()
+	if err := c.admit(ctx, OpRemove, singleKey(key)); err != nil {
+		span.SetTag("status", err)
+		return err
+	}
 
-	code, body, err := c.doREST(ctx, "DELETE", key, nil)
+	code, _, body, err := c.doREST(ctx, OpRemove, "DELETE", key, nil)
 	if err != nil {
 		span.SetTag("status", err)
 		return err
@@ -274,12 +380,16 @@ func (c *Conn) remove(ctx context.Context, key string) error {
 func (c *Conn) GetBulk(ctx context.Context, keysAndVals map[string]string) error {
 	span, ctx := opentracing.StartSpanFromContext(ctx, "ktrpc GetBulk")
 	defer span.Finish()
+	if err := c.admit(ctx, OpGetBulk, keyMap[string](keysAndVals)); err != nil {
+		span.SetTag("status", err)
+		return err
+	}
 
 	m := make(map[string][]byte)
 	for k := range keysAndVals {
 		m[k] = zeroslice
 	}
-	err := c.doGetBulkBytes(ctx, m)
+	err := c.doGetBulkBytes(ctx, OpGetBulk, m)
 	if err != nil {
 		span.SetTag("status", err)
 		return err
@@ -301,7 +411,11 @@ func (c *Conn) Get(ctx context.Context, key string) (string, error) {
 	span, ctx := opentracing.StartSpanFromContext(ctx, "ktrpc Get")
 	defer span.Finish()
 	span.SetTag("key", key)
-	s, err := c.doGet(ctx, key)
+	if err := c.admit(ctx, OpGet, singleKey(key)); err != nil {
+		span.SetTag("status", err)
+		return "", err
+	}
+	s, _, err := c.doGet(ctx, OpGet, key)
 	if err != nil {
 		return "", err
 	}
@@ -309,13 +423,36 @@ func (c *Conn) Get(ctx context.Context, key string) (string, error) {
 }
 
 // doGet perform http request to retrieve the value associated with key
-func (c *Conn) doGet(ctx context.Context, key string) ([]byte, error) {
+// and its expiration time.
+func (c *Conn) doGet(ctx context.Context, op string, key string) ([]byte, time.Time, error) {
+	body, expires, err := c.doGetStored(ctx, op, key)
+	if err == nil && c.compressor != nil {
+		body, err = c.compressor.decode(body)
+	}
+	return body, expires, err
+}
+
+// getStored is GetWithExpiry returning the value as stored in KT, still
+// compressed, so that it can be passed to cas as storedOval.
+func (c *Conn) getStored(ctx context.Context, key string) ([]byte, time.Time, error) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "ktrpc GetWithExpiry")
+	defer span.Finish()
+	span.SetTag("key", key)
+	if err := c.admit(ctx, OpGetWithExpiry, singleKey(key)); err != nil {
+		span.SetTag("status", err)
+		return nil, time.Time{}, err
+	}
+	return c.doGetStored(ctx, OpGetWithExpiry, key)
+}
+
+// doGetStored is doGet without decompression.
+func (c *Conn) doGetStored(ctx context.Context, op string, key string) ([]byte, time.Time, error) {
 	span := opentracing.SpanFromContext(ctx)
 
-	code, body, err := c.doREST(ctx, "GET", key, nil)
+	code, header, body, err := c.doREST(ctx, op, "GET", key, nil)
 	if err != nil {
 		span.SetTag("err", err)
-		return nil, err
+		return nil, time.Time{}, err
 	}
 
 	switch code {
@@ -324,13 +461,32 @@ func (c *Conn) doGet(ctx context.Context, key string) ([]byte, error) {
 		break
 	case 404:
 		span.SetTag("status", "not_found")
-		return nil, ErrNotFound
+		return nil, time.Time{}, ErrNotFound
 	default:
 		err := &Error{string(body), code}
 		span.SetTag("status", err)
-		return nil, err
+		return nil, time.Time{}, err
+	}
+	c.hotKeys.observeBytes(key, len(body))
+	expires, err := headerExpiry(header)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	return body, expires, nil
+}
+
+// headerExpiry returns the expiration time of a record given in the
+// X-Kt-Xt header of REST responses, or the zero time if there is none.
+func headerExpiry(header http.Header) (time.Time, error) {
+	xt := header.Get("X-Kt-Xt")
+	if xt == "" {
+		return time.Time{}, nil
+	}
+	t, err := http.ParseTime(xt)
+	if err != nil {
+		return time.Time{}, &Error{Message: "bad X-Kt-Xt header: " + xt}
 	}
-	return body, nil
+	return t, nil
 }
 
 // GetBytes retrieves the data stored at key in the format of a byte slice
@@ -339,25 +495,299 @@ func (c *Conn) GetBytes(ctx context.Context, key string) ([]byte, error) {
 	span, ctx := opentracing.StartSpanFromContext(ctx, "ktrpc GetBytes")
 	defer span.Finish()
 	span.SetTag("key", key)
-	return c.doGet(ctx, key)
+	if err := c.admit(ctx, OpGetBytes, singleKey(key)); err != nil {
+		span.SetTag("status", err)
+		return nil, err
+	}
+	b, _, err := c.doGet(ctx, OpGetBytes, key)
+	return b, err
+}
+
+// GetWithExpiry retrieves the data stored at key, and the time at which
+// the record expires. The time is zero if the record never expires.
+// ErrNotFound is returned if no such data is found.
+func (c *Conn) GetWithExpiry(ctx context.Context, key string) ([]byte, time.Time, error) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "ktrpc GetWithExpiry")
+	defer span.Finish()
+	span.SetTag("key", key)
+	if err := c.admit(ctx, OpGetWithExpiry, singleKey(key)); err != nil {
+		span.SetTag("status", err)
+		return nil, time.Time{}, err
+	}
+	return c.doGet(ctx, OpGetWithExpiry, key)
+}
+
+// Check tells whether a record exists at key without transferring its
+// value. It returns the size of the stored value, which is its compressed
+// size if the Conn compresses values, and the time at which the record
+// expires, zero if it never does. ErrNotFound is returned if there is no
+// such record.
+func (c *Conn) Check(ctx context.Context, key string) (int, time.Time, error) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "ktrpc Check")
+	defer span.Finish()
+	span.SetTag("key", key)
+	if err := c.admit(ctx, OpCheck, singleKey(key)); err != nil {
+		span.SetTag("status", err)
+		return 0, time.Time{}, err
+	}
+
+	code, header, _, err := c.doREST(ctx, OpCheck, "HEAD", key, nil)
+	if err != nil {
+		span.SetTag("status", err)
+		return 0, time.Time{}, err
+	}
+	switch code {
+	case 200:
+	case 404:
+		span.SetTag("status", "not_found")
+		return 0, time.Time{}, ErrNotFound
+	default:
+		span.SetTag("status", code)
+		return 0, time.Time{}, &Error{Message: http.StatusText(code), Code: code}
+	}
+	size, err := strconv.Atoi(header.Get("Content-Length"))
+	if err != nil {
+		return 0, time.Time{}, &Error{Message: "bad Content-Length header: " + header.Get("Content-Length")}
+	}
+	expires, err := headerExpiry(header)
+	return size, expires, err
+}
+
+// Seize retrieves and removes the data stored at key in a single atomic
+// operation, so that concurrent callers never both get it. ErrNotFound is
+// returned if no such data is found.
+func (c *Conn) Seize(ctx context.Context, key string) ([]byte, error) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "ktrpc Seize")
+	defer span.Finish()
+	span.SetTag("key", key)
+	if err := c.admit(ctx, OpSeize, singleKey(key)); err != nil {
+		span.SetTag("status", err)
+		return nil, err
+	}
+
+	code, m, err := c.doRPC(ctx, OpSeize, "/rpc/seize", []KV{{"key", []byte(key)}})
+	if err != nil {
+		span.SetTag("status", err)
+		return nil, err
+	}
+	switch code {
+	case 200:
+	case 450:
+		span.SetTag("status", "not_found")
+		return nil, ErrNotFound
+	default:
+		span.SetTag("status", code)
+		return nil, makeError(m)
+	}
+	value := findRec(m, "value").Value
+	c.hotKeys.observeBytes(key, len(value))
+	if c.compressor != nil {
+		return c.compressor.decode(value)
+	}
+	return value, nil
 }
 
 // Set stores the data at key
 func (c *Conn) set(ctx context.Context, key string, value []byte) error {
 	span, ctx := opentracing.StartSpanFromContext(ctx, "ktrpc Set")
 	defer span.Finish()
+	if err := c.admit(ctx, OpSet, singleKey(key)); err != nil {
+		span.SetTag("status", err)
+		return err
+	}
 
-	code, body, err := c.doREST(ctx, "PUT", key, value)
+	if c.compressor != nil {
+		value = c.compressor.encode(value)
+	}
+	code, _, body, err := c.doREST(ctx, OpSet, "PUT", key, value)
 	if err != nil {
 		return err
 	}
 	if code != 201 {
 		return &Error{string(body), code}
 	}
+	c.hotKeys.observeBytes(key, len(value))
+	return nil
+}
 
+// SetWithExpiry stores the data at key. The record expires after ttl,
+// rounded to the second; a ttl of 0 means the record never expires.
+func (c *Conn) SetWithExpiry(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "ktrpc SetWithExpiry")
+	defer span.Finish()
+	if err := c.admit(ctx, OpSet, singleKey(key)); err != nil {
+		span.SetTag("status", err)
+		return err
+	}
+
+	if c.compressor != nil {
+		value = c.compressor.encode(value)
+	}
+	vals := []KV{
+		{"key", []byte(key)},
+		{"value", value},
+	}
+	if ttl > 0 {
+		vals = append(vals, KV{"xt", []byte(strconv.FormatInt(expirySeconds(ttl), 10))})
+	}
+	code, m, err := c.doRPC(ctx, OpSet, "/rpc/set", vals)
+	if err != nil {
+		span.SetTag("status", err)
+		return err
+	}
+	if code != 200 {
+		span.SetTag("status", code)
+		return makeError(m)
+	}
+	c.hotKeys.observeBytes(key, len(value))
 	return nil
 }
 
+// expirySeconds converts a ttl to the relative xt understood by KT,
+// rounding up so that a short positive ttl never means "no expiry". A
+// ttl of 0 or less gives 0, as a negative xt is an absolute time.
+func expirySeconds(ttl time.Duration) int64 {
+	if ttl <= 0 {
+		return 0
+	}
+	return int64((ttl + time.Second - 1) / time.Second)
+}
+
+// CAS replaces the value at key with nval if it currently holds oval.
+// A nil oval requires that the record does not exist, a nil nval removes
+// the record. A stored record expires after ttl, rounded to the second;
+// a ttl of 0 means it never expires. ErrCASMismatch is returned if the
+// precondition failed.
+func (c *Conn) CAS(ctx context.Context, key string, oval, nval []byte, ttl time.Duration) error {
+	return c.cas(ctx, key, oval, nval, expirySeconds(ttl), false)
+}
+
+// Add stores value at key unless a record already exists there, in which
+// case ErrExists is returned. The record expires after ttl as in CAS.
+func (c *Conn) Add(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	return c.add(ctx, key, value, expirySeconds(ttl))
+}
+
+// cas is CAS with xt passed to KT as in doSetBulk. If storedOval is set,
+// oval is the value as stored in KT, as returned by getStored, and is
+// sent as is rather than compressed: compressing it again only gives the
+// stored bytes back if it was stored compressed with the same settings.
+func (c *Conn) cas(ctx context.Context, key string, oval, nval []byte, xt int64, storedOval bool) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "ktrpc CAS")
+	defer span.Finish()
+	if err := c.admit(ctx, OpSet, singleKey(key)); err != nil {
+		span.SetTag("status", err)
+		return err
+	}
+
+	vals := []KV{{"key", []byte(key)}}
+	if oval != nil {
+		if c.compressor != nil && !storedOval {
+			oval = c.compressor.encode(oval)
+		}
+		vals = append(vals, KV{"oval", oval})
+	}
+	if nval != nil {
+		if c.compressor != nil {
+			nval = c.compressor.encode(nval)
+		}
+		vals = append(vals, KV{"nval", nval})
+	}
+	if xt != 0 {
+		vals = append(vals, KV{"xt", []byte(strconv.FormatInt(xt, 10))})
+	}
+	code, m, err := c.doRPC(ctx, OpSet, "/rpc/cas", vals)
+	if err != nil {
+		span.SetTag("status", err)
+		return err
+	}
+	switch code {
+	case 200:
+		c.hotKeys.observeBytes(key, len(nval))
+		return nil
+	case 450:
+		span.SetTag("status", "mismatch")
+		return ErrCASMismatch
+	default:
+		span.SetTag("status", code)
+		return makeError(m)
+	}
+}
+
+// add stores value at key unless a record already exists there, in which
+// case ErrExists is returned. xt is passed to KT as in doSetBulk.
+func (c *Conn) add(ctx context.Context, key string, value []byte, xt int64) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "ktrpc Add")
+	defer span.Finish()
+	if err := c.admit(ctx, OpSet, singleKey(key)); err != nil {
+		span.SetTag("status", err)
+		return err
+	}
+
+	if c.compressor != nil {
+		value = c.compressor.encode(value)
+	}
+	vals := []KV{
+		{"key", []byte(key)},
+		{"value", value},
+	}
+	if xt != 0 {
+		vals = append(vals, KV{"xt", []byte(strconv.FormatInt(xt, 10))})
+	}
+	code, m, err := c.doRPC(ctx, OpSet, "/rpc/add", vals)
+	if err != nil {
+		span.SetTag("status", err)
+		return err
+	}
+	switch code {
+	case 200:
+		c.hotKeys.observeBytes(key, len(value))
+		return nil
+	case 450:
+		span.SetTag("status", "exists")
+		return ErrExists
+	default:
+		span.SetTag("status", code)
+		return makeError(m)
+	}
+}
+
+// Increment adds n to the number stored at key and returns the result. A
+// missing record counts as 0, and is created to expire after ttl as in
+// CAS; the expiry of an existing record is left alone. KT stores the
+// number as 8 big-endian bytes, which GetBytes returns as is, and fails
+// if the record holds anything else. The number is never compressed.
+func (c *Conn) Increment(ctx context.Context, key string, n int64, ttl time.Duration) (int64, error) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "ktrpc Increment")
+	defer span.Finish()
+	if err := c.admit(ctx, OpSet, singleKey(key)); err != nil {
+		span.SetTag("status", err)
+		return 0, err
+	}
+
+	vals := []KV{
+		{"key", []byte(key)},
+		{"num", []byte(strconv.FormatInt(n, 10))},
+	}
+	if xt := expirySeconds(ttl); xt != 0 {
+		vals = append(vals, KV{"xt", []byte(strconv.FormatInt(xt, 10))})
+	}
+	code, m, err := c.doRPC(ctx, OpSet, "/rpc/increment", vals)
+	if err != nil {
+		span.SetTag("status", err)
+		return 0, err
+	}
+	if code != 200 {
+		span.SetTag("status", code)
+		return 0, makeError(m)
+	}
+	num, err := strconv.ParseInt(string(findRec(m, "num").Value), 10, 64)
+	if err != nil {
+		return 0, &Error{Message: "bad increment result: " + err.Error()}
+	}
+	return num, nil
+}
+
 var zeroslice = []byte("0")
 
 // GetBulkBytes retrieves the keys in the map. The results will be filled in on function return.
@@ -365,7 +795,11 @@ var zeroslice = []byte("0")
 func (c *Conn) GetBulkBytes(ctx context.Context, keys map[string][]byte) error {
 	span, ctx := opentracing.StartSpanFromContext(ctx, "ktrpc GetBulkBytes")
 	defer span.Finish()
-	err := c.doGetBulkBytes(ctx, keys)
+	if err := c.admit(ctx, OpGetBulkBytes, keyMap[[]byte](keys)); err != nil {
+		span.SetTag("status", err)
+		return err
+	}
+	err := c.doGetBulkBytes(ctx, OpGetBulkBytes, keys)
 	if err != nil {
 		span.SetTag("status", err)
 	}
@@ -374,7 +808,7 @@ func (c *Conn) GetBulkBytes(ctx context.Context, keys map[string][]byte) error {
 
 // doGetBulkBytes retrieves the keys in the map. The results will be filled in on function return.
 // If a key was not found in the database, it will be removed from the map.
-func (c *Conn) doGetBulkBytes(ctx context.Context, keys map[string][]byte) error {
+func (c *Conn) doGetBulkBytes(ctx context.Context, op string, keys map[string][]byte) error {
 
 	// The format for querying multiple keys in KT is to send a
 	// TSV value for each key with a _ as a prefix.
@@ -388,7 +822,7 @@ func (c *Conn) doGetBulkBytes(ctx context.Context, keys map[string][]byte) error
 		keystransmit = append(keystransmit, KV{"_" + k, zeroslice})
 	}
 
-	code, m, err := c.doRPC(ctx, "/rpc/get_bulk", keystransmit)
+	code, m, err := c.doRPC(ctx, op, "/rpc/get_bulk", keystransmit)
 	if err != nil {
 		return err
 	}
@@ -399,6 +833,13 @@ func (c *Conn) doGetBulkBytes(ctx context.Context, keys map[string][]byte) error
 		if kv.Key[0] != '_' {
 			continue
 		}
+		c.hotKeys.observeBytes(kv.Key[1:], len(kv.Value))
+		if c.compressor != nil {
+			kv.Value, err = c.compressor.decode(kv.Value)
+			if err != nil {
+				return err
+			}
+		}
 		keys[kv.Key[1:]] = kv.Value
 	}
 	for k, v := range keys {
@@ -413,12 +854,34 @@ func (c *Conn) doGetBulkBytes(ctx context.Context, keys map[string][]byte) error
 func (c *Conn) setBulk(ctx context.Context, values map[string]string) (int64, error) {
 	vals := make([]KV, 0, len(values))
 	for k, v := range values {
-		vals = append(vals, KV{"_" + k, []byte(v)})
+		vals = append(vals, KV{k, []byte(v)})
+	}
+	return c.doSetBulk(ctx, vals, 0)
+}
+
+// doSetBulk stores the records in vals. xt is passed to KT as is: 0
+// means no expiry, a positive value is relative to now in seconds and a
+// negative one is an absolute UNIX time.
+func (c *Conn) doSetBulk(ctx context.Context, values []KV, xt int64) (int64, error) {
+	vals := make([]KV, 0, len(values)+1)
+	for _, kv := range values {
+		b := kv.Value
+		if c.compressor != nil {
+			b = c.compressor.encode(b)
+		}
+		vals = append(vals, KV{"_" + kv.Key, b})
+	}
+	if xt != 0 {
+		vals = append(vals, KV{"xt", []byte(strconv.FormatInt(xt, 10))})
 	}
 	span, ctx := opentracing.StartSpanFromContext(ctx, "ktrpc SetBulk")
 	defer span.Finish()
+	if err := c.admit(ctx, OpSetBulk, kvKeys(values)); err != nil {
+		span.SetTag("status", err)
+		return 0, err
+	}
 
-	code, m, err := c.doRPC(ctx, "/rpc/set_bulk", vals)
+	code, m, err := c.doRPC(ctx, OpSetBulk, "/rpc/set_bulk", vals)
 	if err != nil {
 		span.SetTag("status", err)
 		return 0, err
@@ -427,6 +890,9 @@ func (c *Conn) setBulk(ctx context.Context, values map[string]string) (int64, er
 		span.SetTag("status", code)
 		return 0, makeError(m)
 	}
+	for _, kv := range vals[:len(values)] {
+		c.hotKeys.observeBytes(kv.Key[1:], len(kv.Value))
+	}
 	return strconv.ParseInt(string(findRec(m, "num").Value), 10, 64)
 }
 
@@ -438,8 +904,12 @@ func (c *Conn) removeBulk(ctx context.Context, keys []string) (int64, error) {
 
 	span, ctx := opentracing.StartSpanFromContext(ctx, "ktrpc RemoveBulk")
 	defer span.Finish()
+	if err := c.admit(ctx, OpRemoveBulk, keyList(keys)); err != nil {
+		span.SetTag("status", err)
+		return 0, err
+	}
 
-	code, m, err := c.doRPC(ctx, "/rpc/remove_bulk", vals)
+	code, m, err := c.doRPC(ctx, OpRemoveBulk, "/rpc/remove_bulk", vals)
 	if err != nil {
 		span.SetTag("status", err)
 		return 0, err
@@ -456,17 +926,42 @@ func (c *Conn) removeBulk(ctx context.Context, keys []string) (int64, error) {
 // The error may be ErrSuccess in the case that no records were found.
 // This is for compatibility with the old gokabinet library.
 func (c *Conn) MatchPrefix(ctx context.Context, key string, maxrecords int64) ([]string, error) {
-	keystransmit := []KV{
-		{"prefix", []byte(key)},
-		{"max", []byte(strconv.FormatInt(maxrecords, 10))},
-	}
-
 	span, ctx := opentracing.StartSpanFromContext(ctx, "ktrpc MatchPrefix")
 	defer span.Finish()
 	span.SetTag("prefix", key)
 	span.SetTag("limit", maxrecords)
+	if err := c.admit(ctx, OpMatchPrefix, singleKey(key)); err != nil {
+		span.SetTag("status", err)
+		return nil, err
+	}
+
+	return c.matchKeys(ctx, OpMatchPrefix, "/rpc/match_prefix", "prefix", key, maxrecords)
+}
+
+// MatchRegex performs the match_regex operation against the server.
+// It returns a sorted list of the keys matching the regular expression.
+// Like MatchPrefix, the error is ErrSuccess if no records were found.
+func (c *Conn) MatchRegex(ctx context.Context, regex string, maxrecords int64) ([]string, error) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "ktrpc MatchRegex")
+	defer span.Finish()
+	span.SetTag("regex", regex)
+	span.SetTag("limit", maxrecords)
+	if err := c.admit(ctx, OpMatchRegex, nil); err != nil {
+		span.SetTag("status", err)
+		return nil, err
+	}
+
+	return c.matchKeys(ctx, OpMatchRegex, "/rpc/match_regex", "regex", regex, maxrecords)
+}
 
-	code, m, err := c.doRPC(ctx, "/rpc/match_prefix", keystransmit)
+func (c *Conn) matchKeys(ctx context.Context, op string, path string, param string, pattern string, maxrecords int64) ([]string, error) {
+	span := opentracing.SpanFromContext(ctx)
+	keystransmit := []KV{
+		{param, []byte(pattern)},
+		{"max", []byte(strconv.FormatInt(maxrecords, 10))},
+	}
+
+	code, m, err := c.doRPC(ctx, op, path, keystransmit)
 	if err != nil {
 		span.SetTag("status", err)
 		return nil, err
@@ -489,46 +984,31 @@ func (c *Conn) MatchPrefix(ctx context.Context, key string, maxrecords int64) ([
 	return res, nil
 }
 
-var base64headers http.Header
-var identityheaders http.Header
-
-func init() {
-	identityheaders = make(http.Header)
-	identityheaders.Set("Content-Type", "text/tab-separated-values")
-	base64headers = make(http.Header)
-	base64headers.Set("Content-Type", "text/tab-separated-values; colenc=B")
-}
-
-// KV uses an explicit structure here rather than a map[string][]byte
-// because we need ordered data.
-type KV struct {
-	Key   string
-	Value []byte
-}
+// Do an RPC call against the KT endpoint. op selects the default timeout,
+// see WithOpTimeouts.
+func (c *Conn) doRPC(ctx context.Context, op string, path string, values []KV) (code int, vals []KV, err error) {
+	if err := c.lifecycle.begin(); err != nil {
+		return 0, nil, err
+	}
+	defer c.lifecycle.end()
 
-// Do an RPC call against the KT endpoint.
-func (c *Conn) doRPC(ctx context.Context, path string, values []KV) (code int, vals []KV, err error) {
 	url := &url.URL{
 		Scheme: c.scheme,
 		Host:   c.host,
 		Path:   path,
 	}
 	body, enc := TSVEncode(values)
-	headers := identityheaders
-	if enc == Base64Enc {
-		headers = base64headers
-	}
-	resp, t, err := c.roundTrip(ctx, "POST", url, headers, body)
+	headers := http.Header{"Content-Type": {enc.ContentType()}}
+	rctx, cancel := c.requestContext(ctx, op)
+	defer cancel()
+	resp, err := c.roundTrip(rctx, "POST", url, headers, body)
 	if err != nil {
-		return 0, nil, err
+		return 0, nil, requestError(rctx, err)
 	}
 	resultBody, err := ioutil.ReadAll(resp.Body)
 	resp.Body.Close()
-	if !t.Stop() {
-		return 0, nil, ErrTimeout
-	}
 	if err != nil {
-		return 0, nil, err
+		return 0, nil, requestError(rctx, err)
 	}
 	m, err := DecodeValues(resultBody, resp.Header.Get("Content-Type"))
 	if err != nil {
@@ -537,28 +1017,42 @@ func (c *Conn) doRPC(ctx context.Context, path string, values []KV) (code int, v
 	return resp.StatusCode, m, nil
 }
 
-func (c *Conn) roundTrip(ctx context.Context, method string, url *url.URL, headers http.Header, body []byte) (*http.Response, *time.Timer, error) {
-	req, t := c.makeRequest(ctx, method, url, headers, body)
-	resp, err := c.transport.RoundTrip(req)
-	if err != nil {
+// requestContext returns the context bounding a request for op: ctx if
+// it has a deadline, or ctx with the default timeout of op otherwise.
+func (c *Conn) requestContext(ctx context.Context, op string) (context.Context, context.CancelFunc) {
+	if _, ok := ctx.Deadline(); ok {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, c.opTimeout(op))
+}
+
+// requestError returns the error of a request failed with err, telling
+// apart the expiry of the deadline of its context ctx, reported as
+// ErrTimeout, and the caller giving up, reported as context.Canceled.
+func requestError(ctx context.Context, err error) error {
+	switch ctx.Err() {
+	case context.DeadlineExceeded:
+		return ErrTimeout
+	case context.Canceled:
+		return context.Canceled
+	}
+	return err
+}
+
+// roundTrip sends a request, cancelled when ctx is done.
+func (c *Conn) roundTrip(ctx context.Context, method string, url *url.URL, headers http.Header, body []byte) (*http.Response, error) {
+	resp, err := c.transport.RoundTrip(c.makeRequest(ctx, method, url, headers, body))
+	if err != nil && ctx.Err() == nil {
 		// Ideally we would only retry when we hit a network error. This doesn't work
 		// since net/http wraps some of these errors. Do the simple thing and retry eagerly.
-		t.Stop()
 		c.transport.CloseIdleConnections()
-		req, t = c.makeRequest(ctx, method, url, headers, body)
-		resp, err = c.transport.RoundTrip(req)
+		resp, err = c.transport.RoundTrip(c.makeRequest(ctx, method, url, headers, body))
 		atomic.AddUint64(&c.retryCount, 1)
 	}
-	if err != nil {
-		if !t.Stop() {
-			err = ErrTimeout
-		}
-		return nil, nil, err
-	}
-	return resp, t, nil
+	return resp, err
 }
 
-func (c *Conn) makeRequest(ctx context.Context, method string, url *url.URL, headers http.Header, body []byte) (*http.Request, *time.Timer) {
+func (c *Conn) makeRequest(ctx context.Context, method string, url *url.URL, headers http.Header, body []byte) *http.Request {
 	var rc io.ReadCloser
 	if body != nil {
 		rc = ioutil.NopCloser(bytes.NewReader(body))
@@ -582,191 +1076,7 @@ func (c *Conn) makeRequest(ctx context.Context, method string, url *url.URL, hea
 		ContentLength: int64(len(body)),
 	}
 
-	req = req.WithContext(ctx)
-
-	t := time.AfterFunc(c.timeout, func() {
-		c.transport.CancelRequest(req)
-	})
-	return req, t
-}
-
-type Encoding int
-
-const (
-	IdentityEnc Encoding = iota
-	Base64Enc
-)
-
-// Encode the request body in TSV. The encoding is chosen based
-// on whether there are any binary data in the key/values
-func TSVEncode(values []KV) ([]byte, Encoding) {
-	var bufsize int
-	var hasbinary bool
-	for _, kv := range values {
-		// length of key
-		hasbinary = hasbinary || hasBinary(kv.Key)
-		bufsize += base64.StdEncoding.EncodedLen(len(kv.Key))
-		// tab
-		bufsize += 1
-		// value
-		hasbinary = hasbinary || hasBinarySlice(kv.Value)
-		bufsize += base64.StdEncoding.EncodedLen(len(kv.Value))
-		// newline
-		bufsize += 1
-	}
-	buf := make([]byte, bufsize)
-	var n int
-	for _, kv := range values {
-		if hasbinary {
-			base64.StdEncoding.Encode(buf[n:], []byte(kv.Key))
-			n += base64.StdEncoding.EncodedLen(len(kv.Key))
-		} else {
-			n += copy(buf[n:], kv.Key)
-		}
-		buf[n] = '\t'
-		n++
-		if hasbinary {
-			base64.StdEncoding.Encode(buf[n:], kv.Value)
-			n += base64.StdEncoding.EncodedLen(len(kv.Value))
-		} else {
-			n += copy(buf[n:], kv.Value)
-		}
-		buf[n] = '\n'
-		n++
-	}
-	enc := IdentityEnc
-	if hasbinary {
-		enc = Base64Enc
-	}
-	return buf, enc
-}
-
-func hasBinary(b string) bool {
-	for i := 0; i < len(b); i++ {
-		c := b[i]
-		if c < 0x20 || c > 0x7e {
-			return true
-		}
-	}
-	return false
-}
-
-func hasBinarySlice(b []byte) bool {
-	for _, c := range b {
-		if c < 0x20 || c > 0x7e {
-			return true
-		}
-	}
-	return false
-}
-
-// DecodeValues takes a response from an KT RPC call decodes it into a list of key
-// value pairs.
-func DecodeValues(buf []byte, contenttype string) ([]KV, error) {
-	if len(buf) == 0 {
-		return nil, nil
-	}
-	// Ideally, we should parse the mime media type here,
-	// but this is an expensive operation because mime is just
-	// that awful.
-	//
-	// KT can return values in 3 different formats, Tab separated values (TSV) without any field encoding,
-	// TSV with fields base64 encoded or TSV with URL encoding.
-	// KT does not give you any option as to the format that it returns, so we have to implement all of them
-	//
-	// KT responses are pretty simple and we can rely
-	// on it putting the parameter of colenc=[BU] at
-	// the end of the string. Just look for B, U or s
-	// (last character of tab-separated-values)
-	// to figure out which field encoding is used.
-	var decodef decodefunc
-	switch contenttype[len(contenttype)-1] {
-	case 'B':
-		decodef = base64Decode
-	case 'U':
-		decodef = urlDecode
-	case 's':
-		decodef = identityDecode
-	default:
-		return nil, &Error{Message: fmt.Sprintf("responded with unknown Content-Type: %s", contenttype)}
-	}
-
-	// Because of the encoding, we can tell how many records there
-	// are by scanning through the input and counting the \n's
-	var recCount int
-	for _, v := range buf {
-		if v == '\n' {
-			recCount++
-		}
-	}
-	result := make([]KV, 0, recCount)
-	b := bytes.NewBuffer(buf)
-	for {
-		key, err := b.ReadBytes('\t')
-		if err != nil {
-			return result, nil
-		}
-		key = decodef(key[:len(key)-1])
-		value, err := b.ReadBytes('\n')
-		if len(value) > 0 {
-			fieldlen := len(value) - 1
-			if value[len(value)-1] != '\n' {
-				fieldlen = len(value)
-			}
-			value = decodef(value[:fieldlen])
-			result = append(result, KV{string(key), value})
-		}
-		if err != nil {
-			return result, nil
-		}
-	}
-}
-
-// decodefunc takes a byte slice and decodes the
-// value in place. It returns a slice pointing into
-// the original byte slice. It is used for decoding the
-// individual fields of the TSV that kt returns
-type decodefunc func([]byte) []byte
-
-// Don't do anything, this is pure TSV
-func identityDecode(b []byte) []byte {
-	return b
-}
-
-// Base64 decode each of the field
-func base64Decode(b []byte) []byte {
-	n, _ := base64.StdEncoding.Decode(b, b)
-	return b[:n]
-}
-
-// Decode % escaped URL format
-func urlDecode(b []byte) []byte {
-	res := b
-	resi := 0
-	for i := 0; i < len(b); i++ {
-		if b[i] != '%' {
-			res[resi] = b[i]
-			resi++
-			continue
-		}
-		res[resi] = unhex(b[i+1])<<4 | unhex(b[i+2])
-		resi++
-		i += 2
-	}
-	return res[:resi]
-}
-
-// copied from net/url
-func unhex(c byte) byte {
-	switch {
-	case '0' <= c && c <= '9':
-		return c - '0'
-	case 'a' <= c && c <= 'f':
-		return c - 'a' + 10
-	case 'A' <= c && c <= 'F':
-		return c - 'A' + 10
-	}
-	return 0
+	return req.WithContext(ctx)
 }
 
 // TODO: make this return errors that can be introspected more easily
@@ -791,23 +1101,30 @@ func findRec(kvs []KV, key string) KV {
 // empty header for REST calls.
 var emptyHeader = make(http.Header)
 
-func (c *Conn) doREST(ctx context.Context, op string, key string, val []byte) (code int, body []byte, err error) {
+func (c *Conn) doREST(ctx context.Context, op string, method string, key string, val []byte) (code int, header http.Header, body []byte, err error) {
+	if err := c.lifecycle.begin(); err != nil {
+		return 0, nil, nil, err
+	}
+	defer c.lifecycle.end()
+
 	newkey := urlenc(key)
 	url := &url.URL{
 		Scheme: c.scheme,
 		Host:   c.host,
 		Opaque: newkey,
 	}
-	resp, t, err := c.roundTrip(ctx, op, url, emptyHeader, val)
+	rctx, cancel := c.requestContext(ctx, op)
+	defer cancel()
+	resp, err := c.roundTrip(rctx, method, url, emptyHeader, val)
 	if err != nil {
-		return 0, nil, err
+		return 0, nil, nil, requestError(rctx, err)
 	}
 	resultBody, err := ioutil.ReadAll(resp.Body)
 	resp.Body.Close()
-	if !t.Stop() {
-		err = ErrTimeout
+	if err != nil {
+		err = requestError(rctx, err)
 	}
-	return resp.StatusCode, resultBody, err
+	return resp.StatusCode, resp.Header, resultBody, err
 }
 
 // encode the key for use in a RESTFUL url
@@ -1,8 +1,10 @@
 package kt
 
 import (
+	"bytes"
 	"context"
 	"net"
+	"net/http"
 	"os/exec"
 	"reflect"
 	"strconv"
@@ -405,3 +407,144 @@ func TestIsError(t *testing.T) {
 		t.Error("IsError returns false")
 	}
 }
+
+func TestStatus(t *testing.T) {
+	host, port := startFakeServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/tab-separated-values")
+		w.Write([]byte("count\t42\nsize\t1024\npath\t%\n"))
+	}))
+	db, err := NewConn(host, port, 1, DEFAULT_TIMEOUT)
+	if err != nil {
+		t.Fatal(err)
+	}
+	status, err := db.Status(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"count": "42", "size": "1024", "path": "%"}
+	if !reflect.DeepEqual(status, want) {
+		t.Errorf("Status: want %v, got %v", want, status)
+	}
+}
+
+func TestExpirySeconds(t *testing.T) {
+	var tests = []struct {
+		ttl  time.Duration
+		want int64
+	}{
+		{time.Millisecond, 1},
+		{time.Second, 1},
+		{1500 * time.Millisecond, 2},
+		{time.Hour, 3600},
+		{0, 0},
+		{-time.Second, 0},
+	}
+	for _, tt := range tests {
+		if got := expirySeconds(tt.ttl); got != tt.want {
+			t.Errorf("expirySeconds(%v): want %d, got %d", tt.ttl, tt.want, got)
+		}
+	}
+}
+
+func TestAddCASIncrement(t *testing.T) {
+	f := newFakeKT()
+	db := f.conn(t)
+	ctx := context.Background()
+
+	if err := db.Add(ctx, "k", []byte("a"), time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Add(ctx, "k", []byte("b"), 0); err != ErrExists {
+		t.Fatalf("Add of an existing key: want ErrExists, got %v", err)
+	}
+	if err := db.CAS(ctx, "k", []byte("b"), []byte("c"), 0); err != ErrCASMismatch {
+		t.Fatalf("CAS with a stale value: want ErrCASMismatch, got %v", err)
+	}
+	if err := db.CAS(ctx, "k", []byte("a"), []byte("c"), time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	rec, _ := f.lookup("k")
+	if string(rec.value) != "c" || rec.xt < time.Now().Add(59*time.Minute).Unix() {
+		t.Errorf("after CAS: got %q expiring at %d", rec.value, rec.xt)
+	}
+	if err := db.CAS(ctx, "k", []byte("c"), nil, 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := f.lookup("k"); ok {
+		t.Error("CAS to nil did not remove the record")
+	}
+
+	for i, want := range []int64{5, 3, 10} {
+		got, err := db.Increment(ctx, "n", []int64{5, -2, 7}[i], 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != want {
+			t.Errorf("Increment %d: want %d, got %d", i, want, got)
+		}
+	}
+	f.put("s", []byte("text"), 0)
+	if _, err := db.Increment(ctx, "s", 1, 0); err == nil {
+		t.Error("Increment of a non-numeric record succeeded")
+	}
+}
+
+func TestSeizeCheckGetWithExpiry(t *testing.T) {
+	f := newFakeKT()
+	var ops []string
+	db := newTrackedConn(f.conn(t), func(ctx context.Context, call *Call, invoker Invoker) error {
+		ops = append(ops, call.Op)
+		return invoker(ctx, call)
+	})
+	ctx := context.Background()
+	xt := time.Now().Add(time.Hour).Unix()
+	f.put("ttl", []byte("hello"), xt)
+	f.put("forever", []byte("world!"), 0)
+
+	v, expires, err := db.GetWithExpiry(ctx, "ttl")
+	if err != nil || string(v) != "hello" || expires.Unix() != xt {
+		t.Errorf("GetWithExpiry: got %q, %v, %v", v, expires, err)
+	}
+	if _, expires, err = db.GetWithExpiry(ctx, "forever"); err != nil || !expires.IsZero() {
+		t.Errorf("GetWithExpiry of a record without expiry: got %v, %v", expires, err)
+	}
+	if _, _, err = db.GetWithExpiry(ctx, "missing"); err != ErrNotFound {
+		t.Errorf("GetWithExpiry of a missing record: want ErrNotFound, got %v", err)
+	}
+
+	size, expires, err := db.Check(ctx, "ttl")
+	if err != nil || size != 5 || expires.Unix() != xt {
+		t.Errorf("Check: got %d, %v, %v", size, expires, err)
+	}
+	if f.calls["GET /ttl"] != 1 || f.calls["HEAD /ttl"] != 1 {
+		t.Errorf("Check did not use HEAD: %v", f.calls)
+	}
+	if _, _, err = db.Check(ctx, "missing"); err != ErrNotFound {
+		t.Errorf("Check of a missing record: want ErrNotFound, got %v", err)
+	}
+
+	if v, err = db.Seize(ctx, "forever"); err != nil || string(v) != "world!" {
+		t.Errorf("Seize: got %q, %v", v, err)
+	}
+	if _, err = db.Seize(ctx, "forever"); err != ErrNotFound {
+		t.Errorf("second Seize: want ErrNotFound, got %v", err)
+	}
+
+	want := []string{OpGetWithExpiry, OpGetWithExpiry, OpGetWithExpiry, OpCheck, OpCheck, OpSeize, OpSeize}
+	if !reflect.DeepEqual(ops, want) {
+		t.Errorf("intercepted ops: want %v, got %v", want, ops)
+	}
+
+	// Values are decompressed.
+	zdb := f.conn(t, WithCompression(CompressFlate, 6, 0))
+	value := bytes.Repeat([]byte("abc"), 100)
+	if err := zdb.Set(ctx, "z", value); err != nil {
+		t.Fatal(err)
+	}
+	if size, _, _ := zdb.Check(ctx, "z"); size >= len(value) {
+		t.Errorf("Check of a compressed record: size %d, want the compressed size", size)
+	}
+	if v, err := zdb.Seize(ctx, "z"); err != nil || !bytes.Equal(v, value) {
+		t.Errorf("Seize of a compressed record: got %q, %v", v, err)
+	}
+}
@@ -2,6 +2,7 @@ package kt
 
 import (
 	"context"
+	"sync/atomic"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
@@ -9,24 +10,115 @@ import (
 
 // TrackedConn is a wrapper around kt.Conn that will accept a prometheus counter
 // vector, and keep track of number of IO operations made to KT.
+// It is implemented as a Conn wrapped with MetricsInterceptor.
 type TrackedConn struct {
-	kt      *Conn
-	opTimer *prometheus.SummaryVec
+	kt        *Conn
+	client    Client
+	intercept Interceptor
 }
 
+// Outcome labels used by Metrics.
 const (
-	opCount        = "COUNT"
-	opRemove       = "REMOVE"
-	opGetBulk      = "GETBULK"
-	opGet          = "GET"
-	opGetBytes     = "GETBYTES"
-	opSet          = "SET"
-	opGetBulkBytes = "GETBULKBYTES"
-	opSetBulk      = "SETBULK"
-	opRemoveBulk   = "REMOVEBULK"
-	opMatchPrefix  = "MATCHPREFIX"
+	outcomeOK       = "ok"
+	outcomeNotFound = "not_found"
+	outcomeTimeout  = "timeout"
+	outcomeCanceled = "canceled"
+	outcomeError    = "error"
 )
 
+// Metrics is the set of prometheus collectors updated by a TrackedConn.
+// Any of the fields may be nil to disable that metric.
+type Metrics struct {
+	// Latency of operations in seconds, labelled by op and outcome.
+	Latency *prometheus.HistogramVec
+	// Payload bytes exchanged with KT, labelled by op and direction
+	// (sent or received). Only keys and values are counted, not the
+	// protocol overhead.
+	Bytes *prometheus.CounterVec
+	// Number of keys per bulk operation, labelled by op.
+	BulkKeys *prometheus.HistogramVec
+	// Number of operations in flight.
+	InFlight prometheus.Gauge
+	// Number of requests retried after the server closed an idle connection.
+	Retries prometheus.Counter
+}
+
+// NewMetrics creates the collectors for a TrackedConn, named under the
+// given prometheus namespace and subsystem. They still have to be
+// registered, see Collectors.
+func NewMetrics(namespace, subsystem string) *Metrics {
+	return &Metrics{
+		Latency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "kt_operation_duration_seconds",
+			Help:      "Latency of KT operations labeled by operation and outcome",
+			Buckets:   prometheus.ExponentialBuckets(0.0005, 2, 14),
+		}, []string{"op", "outcome"}),
+		Bytes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "kt_payload_bytes_total",
+			Help:      "Key and value bytes exchanged with KT labeled by operation and direction",
+		}, []string{"op", "direction"}),
+		BulkKeys: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "kt_bulk_keys",
+			Help:      "Number of keys per KT bulk operation",
+			Buckets:   prometheus.ExponentialBuckets(1, 4, 8),
+		}, []string{"op"}),
+		InFlight: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "kt_operations_in_flight",
+			Help:      "Number of KT operations in flight",
+		}),
+		Retries: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "kt_retries_total",
+			Help:      "Number of KT requests retried after the server closed an idle connection",
+		}),
+	}
+}
+
+// Collectors returns the non-nil collectors of m, for registration.
+func (m *Metrics) Collectors() []prometheus.Collector {
+	var cs []prometheus.Collector
+	if m.Latency != nil {
+		cs = append(cs, m.Latency)
+	}
+	if m.Bytes != nil {
+		cs = append(cs, m.Bytes)
+	}
+	if m.BulkKeys != nil {
+		cs = append(cs, m.BulkKeys)
+	}
+	if m.InFlight != nil {
+		cs = append(cs, m.InFlight)
+	}
+	if m.Retries != nil {
+		cs = append(cs, m.Retries)
+	}
+	return cs
+}
+
+// outcome classifies the error of an operation for the outcome label.
+func outcome(err error) string {
+	switch err {
+	case nil:
+		return outcomeOK
+	case ErrNotFound, ErrSuccess:
+		return outcomeNotFound
+	case ErrTimeout, context.DeadlineExceeded:
+		return outcomeTimeout
+	case context.Canceled:
+		return outcomeCanceled
+	}
+	return outcomeError
+}
+
 // NewTrackedConn creates a new connection to a Kyoto Tycoon endpoint, and tracks
 // operations made to it using prometheus metrics.
 // All supported operations are tracked, opTimer times the number of seconds
@@ -38,115 +130,167 @@ func NewTrackedConn(host string, port int, poolsize int, timeout time.Duration,
 		return nil, err
 	}
 
-	return &TrackedConn{
-		kt:      conn,
-		opTimer: opTimer}, nil
+	return NewTrackedConnFromConn(conn, opTimer)
 }
 
 // NewTrackedConnFromConn returns a tracked connection that simply wraps the given
 // database connection.
 func NewTrackedConnFromConn(conn *Conn, opTimer *prometheus.SummaryVec) (*TrackedConn, error) {
+	return newTrackedConn(conn, summaryInterceptor(opTimer)), nil
+}
+
+// NewTrackedConnWithMetrics returns a tracked connection wrapping conn that
+// records latency histograms by outcome, payload sizes, bulk sizes, the
+// number of operations in flight and retries into m.
+func NewTrackedConnWithMetrics(conn *Conn, m *Metrics) *TrackedConn {
+	return newTrackedConn(conn, MetricsInterceptor(m, conn))
+}
+
+// newTrackedConn runs the operations of conn through interceptor. The
+// Client operations go through Intercept, the others call it directly.
+func newTrackedConn(conn *Conn, interceptor Interceptor) *TrackedConn {
 	return &TrackedConn{
-		kt:      conn,
-		opTimer: opTimer}, nil
+		kt:        conn,
+		client:    Intercept(conn, interceptor),
+		intercept: interceptor,
+	}
 }
 
-func (c *TrackedConn) Count(ctx context.Context) (int, error) {
-	start := time.Now()
-	defer func() {
+// summaryInterceptor times operations into a summary labelled by op.
+func summaryInterceptor(opTimer *prometheus.SummaryVec) Interceptor {
+	return func(ctx context.Context, call *Call, invoker Invoker) error {
+		start := time.Now()
+		err := invoker(ctx, call)
+		opTimer.WithLabelValues(call.Op).Observe(time.Since(start).Seconds())
+		return err
+	}
+}
+
+// MetricsInterceptor returns an interceptor recording every operation
+// into m. If conn is not nil, its retries are counted too. If m is nil,
+// the interceptor records nothing.
+func MetricsInterceptor(m *Metrics, conn *Conn) Interceptor {
+	if m == nil {
+		return func(ctx context.Context, call *Call, invoker Invoker) error {
+			return invoker(ctx, call)
+		}
+	}
+	var lastRetryCount uint64
+	if conn != nil {
+		lastRetryCount = conn.RetryCount()
+	}
+	return func(ctx context.Context, call *Call, invoker Invoker) error {
+		start := time.Now()
+		if m.InFlight != nil {
+			m.InFlight.Inc()
+		}
+		err := invoker(ctx, call)
 		since := time.Since(start)
-		c.opTimer.WithLabelValues(opGet).Observe(since.Seconds())
-	}()
+		if m.InFlight != nil {
+			m.InFlight.Dec()
+		}
+		if m.Latency != nil {
+			m.Latency.WithLabelValues(call.Op, outcome(err)).Observe(since.Seconds())
+		}
+		if m.Bytes != nil {
+			m.Bytes.WithLabelValues(call.Op, "sent").Add(float64(call.Sent))
+			m.Bytes.WithLabelValues(call.Op, "received").Add(float64(call.Received))
+		}
+		if m.BulkKeys != nil && isBulk(call.Op) {
+			m.BulkKeys.WithLabelValues(call.Op).Observe(float64(len(call.Keys)))
+		}
+		if m.Retries != nil && conn != nil {
+			cur := conn.RetryCount()
+			prev := atomic.SwapUint64(&lastRetryCount, cur)
+			if cur > prev {
+				m.Retries.Add(float64(cur - prev))
+			}
+		}
+		return err
+	}
+}
 
-	return c.kt.Count(ctx)
+func isBulk(op string) bool {
+	switch op {
+	case OpGetBulk, OpGetBulkBytes, OpSetBulk, OpRemoveBulk:
+		return true
+	}
+	return false
 }
 
-func (c *TrackedConn) Remove(ctx context.Context, key string) error {
-	start := time.Now()
-	defer func() {
-		since := time.Since(start)
-		c.opTimer.WithLabelValues(opRemove).Observe(since.Seconds())
-	}()
+func (c *TrackedConn) Count(ctx context.Context) (int, error) {
+	return c.client.Count(ctx)
+}
 
-	return c.kt.remove(ctx, key)
+func (c *TrackedConn) Remove(ctx context.Context, key string) error {
+	return c.client.Remove(ctx, key)
 }
 
 func (c *TrackedConn) GetBulk(ctx context.Context, keysAndVals map[string]string) error {
-	start := time.Now()
-	defer func() {
-		since := time.Since(start)
-		c.opTimer.WithLabelValues(opGetBulk).Observe(since.Seconds())
-	}()
-
-	return c.kt.GetBulk(ctx, keysAndVals)
+	return c.client.GetBulk(ctx, keysAndVals)
 }
 
 func (c *TrackedConn) Get(ctx context.Context, key string) (string, error) {
-	start := time.Now()
-	defer func() {
-		since := time.Since(start)
-		c.opTimer.WithLabelValues(opGet).Observe(since.Seconds())
-	}()
-
-	return c.kt.Get(ctx, key)
+	return c.client.Get(ctx, key)
 }
 
 func (c *TrackedConn) GetBytes(ctx context.Context, key string) ([]byte, error) {
-	start := time.Now()
-	defer func() {
-		since := time.Since(start)
-		c.opTimer.WithLabelValues(opGetBytes).Observe(since.Seconds())
-	}()
-
-	return c.kt.GetBytes(ctx, key)
+	return c.client.GetBytes(ctx, key)
 }
 
-func (c *TrackedConn) set(ctx context.Context, key string, value []byte) error {
-	start := time.Now()
-	defer func() {
-		since := time.Since(start)
-		c.opTimer.WithLabelValues(opSet).Observe(since.Seconds())
-	}()
-
-	return c.kt.set(ctx, key, value)
+func (c *TrackedConn) Set(ctx context.Context, key string, value []byte) error {
+	return c.client.Set(ctx, key, value)
 }
 
 func (c *TrackedConn) GetBulkBytes(ctx context.Context, keys map[string][]byte) error {
-	start := time.Now()
-	defer func() {
-		since := time.Since(start)
-		c.opTimer.WithLabelValues(opGetBulkBytes).Observe(since.Seconds())
-	}()
-
-	return c.kt.GetBulkBytes(ctx, keys)
+	return c.client.GetBulkBytes(ctx, keys)
 }
 
-func (c *TrackedConn) setBulk(ctx context.Context, values map[string]string) (int64, error) {
-	start := time.Now()
-	defer func() {
-		since := time.Since(start)
-		c.opTimer.WithLabelValues(opSetBulk).Observe(since.Seconds())
-	}()
-
-	return c.kt.setBulk(ctx, values)
+func (c *TrackedConn) SetBulk(ctx context.Context, values map[string]string) (int64, error) {
+	return c.client.SetBulk(ctx, values)
 }
 
 func (c *TrackedConn) RemoveBulk(ctx context.Context, keys []string) (int64, error) {
-	start := time.Now()
-	defer func() {
-		since := time.Since(start)
-		c.opTimer.WithLabelValues(opRemoveBulk).Observe(since.Seconds())
-	}()
-
-	return c.kt.removeBulk(ctx, keys)
+	return c.client.RemoveBulk(ctx, keys)
 }
 
 func (c *TrackedConn) MatchPrefix(ctx context.Context, key string, maxrecords int64) ([]string, error) {
-	start := time.Now()
-	defer func() {
-		since := time.Since(start)
-		c.opTimer.WithLabelValues(opMatchPrefix).Observe(since.Seconds())
-	}()
+	return c.client.MatchPrefix(ctx, key, maxrecords)
+}
+
+func (c *TrackedConn) GetWithExpiry(ctx context.Context, key string) ([]byte, time.Time, error) {
+	var b []byte
+	var expires time.Time
+	call := &Call{Op: OpGetWithExpiry, Keys: []string{key}}
+	err := c.intercept(ctx, call, func(ctx context.Context, call *Call) error {
+		var err error
+		b, expires, err = c.kt.GetWithExpiry(ctx, key)
+		call.Sent, call.Received = len(key), len(b)
+		return err
+	})
+	return b, expires, err
+}
+
+func (c *TrackedConn) Check(ctx context.Context, key string) (int, time.Time, error) {
+	var size int
+	var expires time.Time
+	call := &Call{Op: OpCheck, Keys: []string{key}, Sent: len(key)}
+	err := c.intercept(ctx, call, func(ctx context.Context, call *Call) error {
+		var err error
+		size, expires, err = c.kt.Check(ctx, key)
+		return err
+	})
+	return size, expires, err
+}
 
-	return c.kt.MatchPrefix(ctx, key, maxrecords)
+func (c *TrackedConn) Seize(ctx context.Context, key string) ([]byte, error) {
+	var b []byte
+	call := &Call{Op: OpSeize, Keys: []string{key}}
+	err := c.intercept(ctx, call, func(ctx context.Context, call *Call) error {
+		var err error
+		b, err = c.kt.Seize(ctx, key)
+		call.Sent, call.Received = len(key), len(b)
+		return err
+	})
+	return b, err
 }
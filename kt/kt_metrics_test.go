@@ -0,0 +1,216 @@
+package kt
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestOutcome(t *testing.T) {
+	var tests = []struct {
+		err  error
+		want string
+	}{
+		{nil, outcomeOK},
+		{ErrNotFound, outcomeNotFound},
+		{ErrSuccess, outcomeNotFound},
+		{ErrTimeout, outcomeTimeout},
+		{context.DeadlineExceeded, outcomeTimeout},
+		{&Error{Message: "boom", Code: 500}, outcomeError},
+		{errors.New("connection reset"), outcomeError},
+	}
+	for _, tt := range tests {
+		if got := outcome(tt.err); got != tt.want {
+			t.Errorf("outcome(%v): want %s, got %s", tt.err, tt.want, got)
+		}
+	}
+}
+
+func TestMetricsCollectors(t *testing.T) {
+	m := NewMetrics("test", "kt")
+	if n := len(m.Collectors()); n != 5 {
+		t.Errorf("Collectors: want 5, got %d", n)
+	}
+	m.Bytes = nil
+	m.Retries = nil
+	if n := len(m.Collectors()); n != 3 {
+		t.Errorf("Collectors with disabled metrics: want 3, got %d", n)
+	}
+}
+
+func TestTrackedConnWithNilMetrics(t *testing.T) {
+	ctx := context.Background()
+	host, port := startFakeServer(t, newFakeKT())
+	conn, err := NewConn(host, port, 1, DEFAULT_TIMEOUT)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close(ctx)
+	db := NewTrackedConnWithMetrics(conn, nil)
+	if err := db.Set(ctx, "k", []byte("v")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Get(ctx, "missing"); err != ErrNotFound {
+		t.Errorf("Get of a missing key: want ErrNotFound, got %v", err)
+	}
+}
+
+// meteredServer serves f, holding requests for the key "slow" until
+// release is closed and dropping the connection of the next request
+// once drop is set.
+type meteredServer struct {
+	f       *fakeKT
+	release chan struct{}
+	drop    atomic.Bool
+}
+
+func (s *meteredServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if s.drop.CompareAndSwap(true, false) {
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err == nil {
+			conn.Close()
+		}
+		return
+	}
+	if r.URL.Path == "/slow" {
+		<-s.release
+	}
+	s.f.ServeHTTP(w, r)
+}
+
+// histogram returns the number and the sum of the observations of the
+// series of c with the given label values.
+func histogram(t *testing.T, c prometheus.Collector, labels map[string]string) (uint64, float64) {
+	t.Helper()
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(c)
+	mfs, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, mf := range mfs {
+	series:
+		for _, m := range mf.GetMetric() {
+			for _, lp := range m.GetLabel() {
+				if labels[lp.GetName()] != lp.GetValue() {
+					continue series
+				}
+			}
+			return m.GetHistogram().GetSampleCount(), m.GetHistogram().GetSampleSum()
+		}
+	}
+	return 0, 0
+}
+
+func TestMetricsInterceptor(t *testing.T) {
+	ctx := context.Background()
+	srv := &meteredServer{f: newFakeKT(), release: make(chan struct{})}
+	host, port := startFakeServer(t, srv)
+	conn, err := NewConn(host, port, 1, DEFAULT_TIMEOUT)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close(ctx)
+	m := NewMetrics("test", "kt")
+	db := NewTrackedConnWithMetrics(conn, m)
+
+	if err := db.Set(ctx, "a", []byte("value")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Get(ctx, "a"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Get(ctx, "missing"); err != ErrNotFound {
+		t.Fatalf("Get of a missing key: %v", err)
+	}
+	if _, err := db.SetBulk(ctx, map[string]string{"b": "12", "c": "345"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.GetBulkBytes(ctx, map[string][]byte{"a": nil, "b": nil, "x": nil}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		op, outcome string
+		want        uint64
+	}{
+		{OpSet, outcomeOK, 1},
+		{OpGet, outcomeOK, 1},
+		{OpGet, outcomeNotFound, 1},
+		{OpSetBulk, outcomeOK, 1},
+		{OpGetBulkBytes, outcomeOK, 1},
+		{OpGetBulkBytes, outcomeError, 0},
+	} {
+		if n, _ := histogram(t, m.Latency, map[string]string{"op": c.op, "outcome": c.outcome}); n != c.want {
+			t.Errorf("latency of %s %s: want %d observations, got %d", c.op, c.outcome, c.want, n)
+		}
+	}
+	for _, c := range []struct {
+		op, direction string
+		want          float64
+	}{
+		{OpSet, "sent", 6},
+		{OpSet, "received", 0},
+		{OpGet, "sent", 8},
+		{OpGet, "received", 5},
+		{OpSetBulk, "sent", 7},
+		{OpGetBulkBytes, "sent", 3},
+		{OpGetBulkBytes, "received", 7},
+	} {
+		if got := testutil.ToFloat64(m.Bytes.WithLabelValues(c.op, c.direction)); got != c.want {
+			t.Errorf("%s bytes %s: want %v, got %v", c.op, c.direction, c.want, got)
+		}
+	}
+	for _, c := range []struct {
+		op   string
+		n    uint64
+		keys float64
+	}{
+		{OpSetBulk, 1, 2},
+		{OpGetBulkBytes, 1, 3},
+		{OpGet, 0, 0},
+	} {
+		if n, keys := histogram(t, m.BulkKeys, map[string]string{"op": c.op}); n != c.n || keys != c.keys {
+			t.Errorf("bulk keys of %s: want %d operations of %v keys, got %d of %v", c.op, c.n, c.keys, n, keys)
+		}
+	}
+
+	// The gauge counts the operations waiting for the server.
+	done := make(chan error)
+	go func() {
+		_, err := db.GetBytes(ctx, "slow")
+		done <- err
+	}()
+	deadline := time.Now().Add(time.Second)
+	for testutil.ToFloat64(m.InFlight) != 1 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if n := testutil.ToFloat64(m.InFlight); n != 1 {
+		t.Errorf("in flight during GetBytes: want 1, got %v", n)
+	}
+	close(srv.release)
+	if err := <-done; err != ErrNotFound {
+		t.Fatalf("GetBytes: %v", err)
+	}
+	if n := testutil.ToFloat64(m.InFlight); n != 0 {
+		t.Errorf("in flight after GetBytes: want 0, got %v", n)
+	}
+
+	// A request dropped by the server is retried once, and counted.
+	if n := testutil.ToFloat64(m.Retries); n != 0 {
+		t.Fatalf("retries before a dropped request: %v", n)
+	}
+	srv.drop.Store(true)
+	if _, err := db.Count(ctx); err != nil {
+		t.Fatalf("Count with a dropped request: %v", err)
+	}
+	if n := testutil.ToFloat64(m.Retries); n != 1 {
+		t.Errorf("retries: want 1, got %v", n)
+	}
+}
@@ -0,0 +1,143 @@
+package kt
+
+import (
+	"context"
+	"net"
+	"sync"
+	"sync/atomic"
+)
+
+// ErrClosed is returned for operations on a Conn that has been closed.
+var ErrClosed error = &Error{Message: "connection closed"}
+
+// PoolStats describes the state of the connection pool of a Conn.
+type PoolStats struct {
+	// Idle is the number of open connections not serving a request.
+	Idle int64
+	// Active is the number of requests in flight.
+	Active int64
+	// Dialed is the total number of connections dialed so far.
+	Dialed uint64
+}
+
+// lifecycle keeps track of requests in flight and of the connections
+// dialed by the transport, so that a Conn can be closed gracefully.
+type lifecycle struct {
+	dialed atomic.Uint64
+	open   atomic.Int64
+	active atomic.Int64
+
+	mu       sync.RWMutex
+	closed   bool
+	inflight sync.WaitGroup
+
+	prewarm bool
+	dialer  func(ctx context.Context, network, addr string) (net.Conn, error)
+}
+
+// WithPrewarm makes the constructor open poolsize connections to the
+// server up front, instead of dialing them lazily under the first burst
+// of traffic.
+func WithPrewarm() Option {
+	return func(c *Conn) {
+		c.lifecycle.prewarm = true
+	}
+}
+
+// begin registers a request. It fails once the Conn is closed.
+func (l *lifecycle) begin() error {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if l.closed {
+		return ErrClosed
+	}
+	l.inflight.Add(1)
+	l.active.Add(1)
+	return nil
+}
+
+func (l *lifecycle) end() {
+	l.active.Add(-1)
+	l.inflight.Done()
+}
+
+func (l *lifecycle) dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	conn, err := l.dialer(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+	l.dialed.Add(1)
+	l.open.Add(1)
+	return &countedConn{Conn: conn, open: &l.open}, nil
+}
+
+// countedConn decrements the number of open connections when closed.
+type countedConn struct {
+	net.Conn
+	open *atomic.Int64
+	once sync.Once
+}
+
+func (c *countedConn) Close() error {
+	c.once.Do(func() { c.open.Add(-1) })
+	return c.Conn.Close()
+}
+
+// prewarmPool dials n connections concurrently and returns them to the
+// idle pool.
+func (c *Conn) prewarmPool(ctx context.Context, n int) error {
+	errs := make(chan error, n)
+	for i := 0; i < n; i++ {
+		go func() {
+			errs <- c.ping(ctx)
+		}()
+	}
+	var firstErr error
+	for i := 0; i < n; i++ {
+		if err := <-errs; err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// PoolStats reports the state of the connection pool.
+func (c *Conn) PoolStats() PoolStats {
+	active := c.lifecycle.active.Load()
+	idle := c.lifecycle.open.Load() - active
+	if idle < 0 {
+		// Requests are counted before their connection is dialed.
+		idle = 0
+	}
+	return PoolStats{
+		Idle:   idle,
+		Active: active,
+		Dialed: c.lifecycle.dialed.Load(),
+	}
+}
+
+// Close stops the Conn from accepting new operations, waits for the
+// operations in flight to finish and closes all connections to the
+// server. If ctx expires first, the remaining requests are left to
+// finish on their own, idle connections are closed and ctx.Err() is
+// returned. Close is idempotent.
+func (c *Conn) Close(ctx context.Context) error {
+	l := &c.lifecycle
+	l.mu.Lock()
+	l.closed = true
+	l.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		l.inflight.Wait()
+		close(done)
+	}()
+	var err error
+	select {
+	case <-done:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	c.transport.CloseIdleConnections()
+	return err
+}
@@ -0,0 +1,128 @@
+package kt
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// startFakeServer starts an HTTP server standing in for ktserver and
+// returns its host and port.
+func startFakeServer(t testing.TB, h http.Handler) (string, int) {
+	srv := httptest.NewServer(h)
+	t.Cleanup(srv.Close)
+	host, portstr, err := net.SplitHostPort(srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	port, err := strconv.Atoi(portstr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return host, port
+}
+
+func TestPrewarmAndClose(t *testing.T) {
+	release := make(chan struct{})
+	host, port := startFakeServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/rpc/status" {
+			<-release
+			w.Header().Set("Content-Type", "text/tab-separated-values")
+			w.Write([]byte("count\t3\n"))
+		}
+	}))
+
+	db, err := NewConn(host, port, 4, DEFAULT_TIMEOUT, WithPrewarm())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats := db.PoolStats(); stats.Dialed != 4 || stats.Idle != 4 || stats.Active != 0 {
+		t.Fatalf("PoolStats after prewarm: %+v", stats)
+	}
+
+	counted := make(chan error)
+	go func() {
+		_, err := db.Count(context.Background())
+		counted <- err
+	}()
+	for db.PoolStats().Active != 1 {
+		time.Sleep(time.Millisecond)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := db.Close(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("Close with a request in flight: want DeadlineExceeded, got %v", err)
+	}
+	if _, err := db.Get(context.Background(), "a"); err != ErrClosed {
+		t.Errorf("Get after Close: want ErrClosed, got %v", err)
+	}
+
+	close(release)
+	if err := <-counted; err != nil {
+		t.Errorf("in-flight Count failed: %v", err)
+	}
+	if err := db.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if stats := db.PoolStats(); stats.Idle != 0 || stats.Active != 0 {
+		t.Errorf("PoolStats after Close: %+v", stats)
+	}
+}
+
+func TestDeadlines(t *testing.T) {
+	// Requests for keys starting with "slow" take 200ms.
+	f := newFakeKT()
+	host, port := startFakeServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.RequestURI, "/slow") {
+			select {
+			case <-time.After(200 * time.Millisecond):
+			case <-r.Context().Done():
+				return
+			}
+		}
+		f.ServeHTTP(w, r)
+	}))
+	db, err := NewConn(host, port, 1, 50*time.Millisecond, WithOpTimeouts(map[string]time.Duration{OpGetBytes: time.Second}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close(context.Background())
+	ctx := context.Background()
+
+	if _, err := db.Get(ctx, "slow"); err != ErrTimeout {
+		t.Errorf("Get past the Conn timeout: got %v", err)
+	}
+	if _, err := db.GetBytes(ctx, "slow"); err != ErrNotFound {
+		t.Errorf("GetBytes within its own timeout: got %v", err)
+	}
+	long, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+	if _, err := db.Get(long, "slow"); err != ErrNotFound {
+		t.Errorf("Get within the context deadline: got %v", err)
+	}
+	short, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err := db.GetBytes(short, "slow"); err != ErrTimeout {
+		t.Errorf("GetBytes past the context deadline: got %v", err)
+	}
+	if d := time.Since(start); d > 150*time.Millisecond {
+		t.Errorf("context deadline ignored, GetBytes took %v", d)
+	}
+
+	retries := db.RetryCount()
+	canceled, cancel := context.WithCancel(ctx)
+	time.AfterFunc(10*time.Millisecond, cancel)
+	if _, err := db.Get(canceled, "slow"); err != context.Canceled {
+		t.Errorf("cancelled Get: got %v", err)
+	}
+	if db.RetryCount() != retries {
+		t.Error("cancelled request retried")
+	}
+}
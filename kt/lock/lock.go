@@ -0,0 +1,313 @@
+// Package lock implements mutual exclusion between processes through a
+// Kyoto Tycoon server.
+//
+// A lock is a record holding the identifier of its owner and expiring
+// after a time to live. It is taken with an atomic add, so that only one
+// owner can create it, and renewed and released with compare-and-swap, so
+// that an owner never extends or removes a lock that expired and was
+// taken by someone else in the meantime.
+//
+// Expiry makes a lease of the lock: an owner that is paused or cut off
+// from the server for longer than the time to live loses it without
+// knowing. Work protected by the lock should check Lost, and stores that
+// accept writes from lock holders should reject the ones carrying a
+// fencing token lower than the highest seen.
+package lock
+
+import (
+	"context"
+	crand "crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/cloudflare/golibs/kt"
+)
+
+var (
+	// ErrHeld is returned by TryAcquire when the lock is held by another
+	// owner.
+	ErrHeld = errors.New("lock: held by another owner")
+	// ErrLost is returned when renewing or releasing a lease that
+	// expired, whether or not another owner took the lock since.
+	ErrLost = errors.New("lock: lease lost")
+)
+
+// Store is the subset of kt.Conn used by locks.
+type Store interface {
+	Add(ctx context.Context, key string, value []byte, ttl time.Duration) error
+	CAS(ctx context.Context, key string, oval, nval []byte, ttl time.Duration) error
+	Increment(ctx context.Context, key string, n int64, ttl time.Duration) (int64, error)
+}
+
+var _ Store = (*kt.Conn)(nil)
+
+// FenceSuffix is appended to the key of a lock to name the counter of its
+// fencing tokens. The counter never expires.
+const FenceSuffix = ".fence"
+
+// Options configures the leases taken on a lock.
+type Options struct {
+	// TTL is the time after which a lease expires unless renewed. KT
+	// rounds it up to the second. Defaults to 30s.
+	TTL time.Duration
+	// RenewInterval is the interval at which leases are renewed in the
+	// background. Defaults to a third of TTL; a negative value disables
+	// background renewal, leaving it to the caller. Either way the lease
+	// is marked lost once it expires.
+	RenewInterval time.Duration
+	// RetryInterval is the average interval between attempts of
+	// Acquire. Defaults to 500ms.
+	RetryInterval time.Duration
+	// Owner names the owner in the lock record, for debugging. A random
+	// suffix is added to it so that every lease has its own identifier.
+	// Defaults to the host name and process ID.
+	Owner string
+}
+
+func (o *Options) setDefaults() {
+	if o.TTL <= 0 {
+		o.TTL = 30 * time.Second
+	}
+	if o.RenewInterval == 0 {
+		o.RenewInterval = o.TTL / 3
+	}
+	if o.RetryInterval <= 0 {
+		o.RetryInterval = 500 * time.Millisecond
+	}
+	if o.Owner == "" {
+		host, _ := os.Hostname()
+		o.Owner = fmt.Sprintf("%s:%d", host, os.Getpid())
+	}
+}
+
+// Lease is the ownership of a lock for a limited time.
+// Lease is safe for concurrent use.
+type Lease struct {
+	store Store
+	key   string
+	id    []byte
+	fence int64
+	ttl   time.Duration
+
+	mu       sync.Mutex
+	expires  time.Time
+	expiry   *time.Timer // marks the lease lost at expires
+	lost     chan struct{}
+	lostOnce sync.Once
+	stop     chan struct{}
+	stopOnce sync.Once
+	done     chan struct{}
+}
+
+// TryAcquire takes the lock at key, or returns ErrHeld if another owner
+// holds it.
+func TryAcquire(ctx context.Context, store Store, key string, opts Options) (*Lease, error) {
+	opts.setDefaults()
+	suffix := make([]byte, 8)
+	if _, err := crand.Read(suffix); err != nil {
+		return nil, err
+	}
+	l := &Lease{
+		store: store,
+		key:   key,
+		id:    []byte(opts.Owner + "/" + hex.EncodeToString(suffix)),
+		ttl:   opts.TTL,
+		lost:  make(chan struct{}),
+		stop:  make(chan struct{}),
+		done:  make(chan struct{}),
+	}
+	start := time.Now()
+	switch err := store.Add(ctx, key, l.id, l.ttl); err {
+	case nil:
+	case kt.ErrExists:
+		return nil, ErrHeld
+	default:
+		return nil, err
+	}
+	l.expires = start.Add(l.ttl)
+
+	fence, err := store.Increment(ctx, key+FenceSuffix, 1, 0)
+	if err != nil {
+		// Without a fencing token the lease is useless, give the lock
+		// back rather than block others until it expires.
+		store.CAS(ctx, key, l.id, nil, 0)
+		return nil, err
+	}
+	l.fence = fence
+
+	l.mu.Lock()
+	l.expiry = time.AfterFunc(time.Until(l.expires), l.markLost)
+	l.mu.Unlock()
+	if opts.RenewInterval > 0 {
+		go l.renewLoop(opts.RenewInterval)
+	} else {
+		close(l.done)
+	}
+	return l, nil
+}
+
+// Acquire takes the lock at key, waiting until it is free or until ctx is
+// done. Errors other than the lock being held are returned at once.
+func Acquire(ctx context.Context, store Store, key string, opts Options) (*Lease, error) {
+	opts.setDefaults()
+	for {
+		l, err := TryAcquire(ctx, store, key, opts)
+		if err != ErrHeld {
+			return l, err
+		}
+		// Jitter the retries so that waiting owners do not wake up
+		// together.
+		d := opts.RetryInterval/2 + time.Duration(rand.Int63n(int64(opts.RetryInterval)))
+		t := time.NewTimer(d)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return nil, ctx.Err()
+		case <-t.C:
+		}
+	}
+}
+
+// Do runs fn while holding the lock at key, waiting for it as Acquire
+// does. The context passed to fn is cancelled if the lease is lost. The
+// lease is released when fn returns; the error of fn takes precedence
+// over the one of the release.
+func Do(ctx context.Context, store Store, key string, opts Options, fn func(ctx context.Context, l *Lease) error) error {
+	l, err := Acquire(ctx, store, key, opts)
+	if err != nil {
+		return err
+	}
+	fnCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		select {
+		case <-l.Lost():
+			cancel()
+		case <-fnCtx.Done():
+		}
+	}()
+	err = fn(fnCtx, l)
+	// The caller's context may be done already, the lock should still
+	// be given back.
+	relCtx, relCancel := context.WithTimeout(context.Background(), l.ttl)
+	defer relCancel()
+	if rerr := l.Release(relCtx); err == nil {
+		err = rerr
+	}
+	return err
+}
+
+// Key returns the key of the lock.
+func (l *Lease) Key() string {
+	return l.key
+}
+
+// ID returns the identifier of the owner stored in the lock record.
+func (l *Lease) ID() string {
+	return string(l.id)
+}
+
+// Fence returns the fencing token of the lease. Tokens increase with
+// every lease taken on the lock.
+func (l *Lease) Fence() int64 {
+	return l.fence
+}
+
+// Expires returns the time until which the lease is known to be held,
+// measured from the start of the last successful acquisition or renewal.
+func (l *Lease) Expires() time.Time {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.expires
+}
+
+// Lost returns a channel closed when the lease is found to be lost, when
+// it expires without having been renewed in time, or once it is released.
+func (l *Lease) Lost() <-chan struct{} {
+	return l.lost
+}
+
+func (l *Lease) markLost() {
+	l.lostOnce.Do(func() {
+		close(l.lost)
+		l.mu.Lock()
+		l.expiry.Stop()
+		l.mu.Unlock()
+	})
+}
+
+// Renew extends the lease by its time to live. ErrLost is returned if the
+// lock no longer belongs to the lease.
+func (l *Lease) Renew(ctx context.Context) error {
+	select {
+	case <-l.lost:
+		return ErrLost
+	default:
+	}
+	start := time.Now()
+	switch err := l.store.CAS(ctx, l.key, l.id, l.id, l.ttl); err {
+	case nil:
+		l.mu.Lock()
+		l.expires = start.Add(l.ttl)
+		l.expiry.Reset(time.Until(l.expires))
+		l.mu.Unlock()
+		return nil
+	case kt.ErrCASMismatch:
+		l.markLost()
+		return ErrLost
+	default:
+		return err
+	}
+}
+
+// renewLoop renews the lease every interval until it is released or lost.
+// Failed renewals are retried at the next tick, until the lease expires.
+func (l *Lease) renewLoop(interval time.Duration) {
+	defer close(l.done)
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-l.stop:
+			return
+		case <-l.lost:
+			return
+		case <-t.C:
+		}
+		expires := l.Expires()
+		ctx, cancel := context.WithDeadline(context.Background(), expires)
+		err := l.Renew(ctx)
+		cancel()
+		if err != nil && !time.Now().Before(expires) {
+			l.markLost()
+		}
+	}
+}
+
+// Release gives the lock back, unless it no longer belongs to the lease
+// in which case ErrLost is returned. Background renewal stops even if
+// releasing fails; the lock is then freed when the lease expires.
+func (l *Lease) Release(ctx context.Context) error {
+	l.stopOnce.Do(func() { close(l.stop) })
+	<-l.done
+	select {
+	case <-l.lost:
+		return ErrLost
+	default:
+	}
+	switch err := l.store.CAS(ctx, l.key, l.id, nil, 0); err {
+	case nil:
+		l.markLost()
+		return nil
+	case kt.ErrCASMismatch:
+		l.markLost()
+		return ErrLost
+	default:
+		return err
+	}
+}
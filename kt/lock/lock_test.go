@@ -0,0 +1,306 @@
+package lock
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cloudflare/golibs/kt"
+)
+
+// fakeStore keeps records in memory, with exact expiry times.
+type fakeStore struct {
+	mu      sync.Mutex
+	recs    map[string]fakeRec
+	failing bool
+}
+
+type fakeRec struct {
+	value   string
+	n       int64
+	expires time.Time
+}
+
+var errUnavailable = errors.New("unavailable")
+
+func newFakeStore() *fakeStore {
+	return &fakeStore{recs: make(map[string]fakeRec)}
+}
+
+func (s *fakeStore) setFailing(failing bool) {
+	s.mu.Lock()
+	s.failing = failing
+	s.mu.Unlock()
+}
+
+func (s *fakeStore) lookup(key string) (fakeRec, bool) {
+	rec, ok := s.recs[key]
+	if ok && !rec.expires.IsZero() && !time.Now().Before(rec.expires) {
+		delete(s.recs, key)
+		return fakeRec{}, false
+	}
+	return rec, ok
+}
+
+func expiresAt(ttl time.Duration) time.Time {
+	if ttl <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(ttl)
+}
+
+func (s *fakeStore) Add(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.failing {
+		return errUnavailable
+	}
+	if _, ok := s.lookup(key); ok {
+		return kt.ErrExists
+	}
+	s.recs[key] = fakeRec{value: string(value), expires: expiresAt(ttl)}
+	return nil
+}
+
+func (s *fakeStore) CAS(ctx context.Context, key string, oval, nval []byte, ttl time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.failing {
+		return errUnavailable
+	}
+	rec, ok := s.lookup(key)
+	if ok != (oval != nil) || ok && rec.value != string(oval) {
+		return kt.ErrCASMismatch
+	}
+	if nval == nil {
+		delete(s.recs, key)
+	} else {
+		s.recs[key] = fakeRec{value: string(nval), expires: expiresAt(ttl)}
+	}
+	return nil
+}
+
+func (s *fakeStore) Increment(ctx context.Context, key string, n int64, ttl time.Duration) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.failing {
+		return 0, errUnavailable
+	}
+	rec, ok := s.lookup(key)
+	if !ok {
+		rec.expires = expiresAt(ttl)
+	}
+	rec.n += n
+	s.recs[key] = rec
+	return rec.n, nil
+}
+
+func (s *fakeStore) holder(key string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	rec, _ := s.lookup(key)
+	return rec.value
+}
+
+func TestExclusion(t *testing.T) {
+	ctx := context.Background()
+	s := newFakeStore()
+	opts := Options{TTL: time.Minute, RenewInterval: -1}
+
+	a, err := TryAcquire(ctx, s, "job", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.holder("job") != a.ID() {
+		t.Errorf("lock record: want %q, got %q", a.ID(), s.holder("job"))
+	}
+	if _, err := TryAcquire(ctx, s, "job", opts); err != ErrHeld {
+		t.Fatalf("second TryAcquire: want ErrHeld, got %v", err)
+	}
+	if err := a.Renew(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Release(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Release(ctx); err != ErrLost {
+		t.Errorf("second Release: want ErrLost, got %v", err)
+	}
+	select {
+	case <-a.Lost():
+	default:
+		t.Error("Lost not closed after Release")
+	}
+
+	b, err := TryAcquire(ctx, s, "job", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.Fence() != 1 || b.Fence() != 2 {
+		t.Errorf("fencing tokens: want 1 then 2, got %d then %d", a.Fence(), b.Fence())
+	}
+	if a.ID() == b.ID() {
+		t.Errorf("leases share the identifier %q", a.ID())
+	}
+}
+
+func TestExpiredLeaseCannotRelease(t *testing.T) {
+	ctx := context.Background()
+	s := newFakeStore()
+	opts := Options{TTL: 20 * time.Millisecond, RenewInterval: -1}
+
+	a, err := TryAcquire(ctx, s, "job", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(30 * time.Millisecond)
+	b, err := TryAcquire(ctx, s, "job", Options{TTL: time.Minute, RenewInterval: -1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Renew(ctx); err != ErrLost {
+		t.Errorf("Renew of an expired lease: want ErrLost, got %v", err)
+	}
+	if err := a.Release(ctx); err != ErrLost {
+		t.Errorf("Release of an expired lease: want ErrLost, got %v", err)
+	}
+	if s.holder("job") != b.ID() {
+		t.Errorf("lock taken from its new owner: held by %q", s.holder("job"))
+	}
+}
+
+func TestBackgroundRenewal(t *testing.T) {
+	ctx := context.Background()
+	s := newFakeStore()
+	opts := Options{TTL: 60 * time.Millisecond, RenewInterval: 10 * time.Millisecond}
+
+	l, err := TryAcquire(ctx, s, "job", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(200 * time.Millisecond)
+	if s.holder("job") != l.ID() {
+		t.Fatal("lease not renewed")
+	}
+
+	// Renewals failing past the expiry lose the lease.
+	s.setFailing(true)
+	select {
+	case <-l.Lost():
+	case <-time.After(time.Second):
+		t.Fatal("lease not lost while the store is unavailable")
+	}
+	if time.Now().Before(l.Expires()) {
+		t.Errorf("lease lost before it expired at %v", l.Expires())
+	}
+	s.setFailing(false)
+	if err := l.Release(ctx); err != ErrLost {
+		t.Errorf("Release of a lost lease: want ErrLost, got %v", err)
+	}
+}
+
+func TestAcquireWaits(t *testing.T) {
+	ctx := context.Background()
+	s := newFakeStore()
+	opts := Options{TTL: time.Minute, RetryInterval: 5 * time.Millisecond}
+
+	a, err := TryAcquire(ctx, s, "job", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	short, cancel := context.WithTimeout(ctx, 20*time.Millisecond)
+	defer cancel()
+	if _, err := Acquire(short, s, "job", opts); err != context.DeadlineExceeded {
+		t.Fatalf("Acquire of a held lock: want DeadlineExceeded, got %v", err)
+	}
+
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		a.Release(ctx)
+	}()
+	b, err := Acquire(ctx, s, "job", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.Release(ctx)
+}
+
+func TestDo(t *testing.T) {
+	ctx := context.Background()
+	s := newFakeStore()
+	opts := Options{TTL: 40 * time.Millisecond, RenewInterval: 10 * time.Millisecond}
+
+	want := errors.New("done")
+	err := Do(ctx, s, "job", opts, func(ctx context.Context, l *Lease) error {
+		if s.holder("job") != l.ID() {
+			t.Error("lock not held while running")
+		}
+		return want
+	})
+	if err != want {
+		t.Errorf("Do: want the error of fn, got %v", err)
+	}
+	if s.holder("job") != "" {
+		t.Error("lock not released")
+	}
+
+	// Losing the lease cancels the context of fn.
+	err = Do(ctx, s, "job", opts, func(ctx context.Context, l *Lease) error {
+		s.setFailing(true)
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(time.Second):
+			return errors.New("context not cancelled")
+		}
+	})
+	s.setFailing(false)
+	if err != ErrLost {
+		t.Errorf("Do after losing the lease: want ErrLost, got %v", err)
+	}
+}
+
+func TestExpiryWithoutRenewal(t *testing.T) {
+	ctx := context.Background()
+	s := newFakeStore()
+	opts := Options{TTL: 40 * time.Millisecond, RenewInterval: -1}
+
+	l, err := TryAcquire(ctx, s, "job", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Renewing by hand pushes the expiry back.
+	time.Sleep(20 * time.Millisecond)
+	if err := l.Renew(ctx); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(30 * time.Millisecond)
+	select {
+	case <-l.Lost():
+		t.Fatal("renewed lease lost before it expired")
+	default:
+	}
+	select {
+	case <-l.Lost():
+	case <-time.After(time.Second):
+		t.Fatal("lease not lost once expired")
+	}
+	if time.Now().Before(l.Expires()) {
+		t.Errorf("lease lost before it expired at %v", l.Expires())
+	}
+
+	// Do cancels fn once the lease expires, even without renewal.
+	err = Do(ctx, s, "job", opts, func(ctx context.Context, l *Lease) error {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(time.Second):
+			return errors.New("context not cancelled")
+		}
+	})
+	if err != ErrLost {
+		t.Errorf("Do after the lease expired: want ErrLost, got %v", err)
+	}
+}
@@ -0,0 +1,336 @@
+package kt
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"math/rand"
+	"sync/atomic"
+)
+
+// Primary selects the cluster a DualWriteConn reads from.
+type Primary int32
+
+const (
+	PrimaryOld Primary = iota
+	PrimaryNew
+)
+
+// DualWriteConn writes to two clusters and reads from one of them, the
+// primary, which can be switched at any time. It carries live traffic
+// while a Migrator copies the existing records.
+//
+// Writes go to the primary first and, if that succeeded, to the other
+// cluster. Only errors from the primary are returned: errors from the
+// other cluster are passed to the callback given to NewDualWriteConn,
+// since they must not fail live traffic. ErrNotFound is not reported
+// when removing from the other cluster, as the record may not have been
+// copied there yet.
+// DualWriteConn is safe for concurrent use.
+type DualWriteConn struct {
+	old, new Client
+	primary  int32
+	onError  func(op string, err error)
+}
+
+// NewDualWriteConn returns a client writing to both old and new and
+// reading from primary. onError, if not nil, is called with the
+// operation name and the error for every failed write to the
+// non-primary cluster.
+func NewDualWriteConn(old, new Client, primary Primary, onError func(op string, err error)) *DualWriteConn {
+	return &DualWriteConn{old: old, new: new, primary: int32(primary), onError: onError}
+}
+
+// SetPrimary switches the cluster reads and first writes go to.
+func (d *DualWriteConn) SetPrimary(p Primary) {
+	atomic.StoreInt32(&d.primary, int32(p))
+}
+
+// Primary returns the cluster reads currently go to.
+func (d *DualWriteConn) Primary() Primary {
+	return Primary(atomic.LoadInt32(&d.primary))
+}
+
+func (d *DualWriteConn) clients() (primary, secondary Client) {
+	if d.Primary() == PrimaryNew {
+		return d.new, d.old
+	}
+	return d.old, d.new
+}
+
+func (d *DualWriteConn) secondaryError(op string, err error) {
+	if err != nil && err != ErrNotFound && d.onError != nil {
+		d.onError(op, err)
+	}
+}
+
+func (d *DualWriteConn) Count(ctx context.Context) (int, error) {
+	p, _ := d.clients()
+	return p.Count(ctx)
+}
+
+func (d *DualWriteConn) Get(ctx context.Context, key string) (string, error) {
+	p, _ := d.clients()
+	return p.Get(ctx, key)
+}
+
+func (d *DualWriteConn) GetBytes(ctx context.Context, key string) ([]byte, error) {
+	p, _ := d.clients()
+	return p.GetBytes(ctx, key)
+}
+
+func (d *DualWriteConn) GetBulk(ctx context.Context, keysAndVals map[string]string) error {
+	p, _ := d.clients()
+	return p.GetBulk(ctx, keysAndVals)
+}
+
+func (d *DualWriteConn) GetBulkBytes(ctx context.Context, keys map[string][]byte) error {
+	p, _ := d.clients()
+	return p.GetBulkBytes(ctx, keys)
+}
+
+func (d *DualWriteConn) MatchPrefix(ctx context.Context, key string, maxrecords int64) ([]string, error) {
+	p, _ := d.clients()
+	return p.MatchPrefix(ctx, key, maxrecords)
+}
+
+func (d *DualWriteConn) Set(ctx context.Context, key string, value []byte) error {
+	p, s := d.clients()
+	if err := p.Set(ctx, key, value); err != nil {
+		return err
+	}
+	d.secondaryError(OpSet, s.Set(ctx, key, value))
+	return nil
+}
+
+func (d *DualWriteConn) SetBulk(ctx context.Context, values map[string]string) (int64, error) {
+	p, s := d.clients()
+	n, err := p.SetBulk(ctx, values)
+	if err != nil {
+		return n, err
+	}
+	_, err = s.SetBulk(ctx, values)
+	d.secondaryError(OpSetBulk, err)
+	return n, nil
+}
+
+func (d *DualWriteConn) Remove(ctx context.Context, key string) error {
+	p, s := d.clients()
+	err := p.Remove(ctx, key)
+	if err != nil && err != ErrNotFound {
+		return err
+	}
+	d.secondaryError(OpRemove, s.Remove(ctx, key))
+	return err
+}
+
+func (d *DualWriteConn) RemoveBulk(ctx context.Context, keys []string) (int64, error) {
+	p, s := d.clients()
+	n, err := p.RemoveBulk(ctx, keys)
+	if err != nil {
+		return n, err
+	}
+	_, err = s.RemoveBulk(ctx, keys)
+	d.secondaryError(OpRemoveBulk, err)
+	return n, nil
+}
+
+// MigrateOptions configures a Migrator.
+type MigrateOptions struct {
+	// Prefix restricts the migration to the keys starting with it.
+	Prefix string
+	// Rate limits the number of records read from the source per
+	// second. 0 means no limit.
+	Rate float64
+	// BatchSize is the number of records Verify checks per get_bulk
+	// call, and the interval at which Progress is called. Defaults
+	// to 100.
+	BatchSize int
+	// Progress, if set, is called periodically during Copy.
+	Progress func(MigrateStats)
+}
+
+// MigrateStats counts the records seen by Migrator.Copy.
+type MigrateStats struct {
+	// Copied records were added to the destination.
+	Copied int64
+	// Existing records were already in the destination, and were left
+	// as they are.
+	Existing int64
+}
+
+// VerifyStats is the result of Migrator.Verify.
+type VerifyStats struct {
+	// Checked is the number of sampled records.
+	Checked int64
+	// Missing lists the sampled keys found in the source only.
+	Missing []string
+	// Differing lists the sampled keys whose values differ.
+	Differing []string
+}
+
+// Migrator copies the records of a KT server to another one while both
+// are in use.
+//
+// Moving a keyspace between clusters without losing writes goes as
+// follows:
+//
+//  1. Route live traffic through a DualWriteConn reading from the old
+//     cluster, so that every write from then on reaches both.
+//  2. Copy the existing records with Migrator.Copy. It only adds records
+//     missing from the new cluster, so it never overwrites a value
+//     written by live traffic in step 1.
+//  3. Check the result with Migrator.Verify.
+//  4. Switch reads to the new cluster with SetPrimary(PrimaryNew), then
+//     drop the old cluster once nothing reads from it.
+//
+// A record removed by live traffic after Copy read it but before Copy
+// wrote it is resurrected in the new cluster. Verify samples the old
+// cluster and cannot see such records, so workloads relying on removals
+// rather than expiration should pause them during the copy.
+type Migrator struct {
+	src, dst *Conn
+	opts     MigrateOptions
+	limiter  *rateBucket
+}
+
+// NewMigrator returns a migrator from src to dst.
+func NewMigrator(src, dst *Conn, opts MigrateOptions) *Migrator {
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = 100
+	}
+	m := &Migrator{src: src, dst: dst, opts: opts}
+	if opts.Rate > 0 {
+		m.limiter = newRateBucket(opts.Rate, 0)
+	}
+	return m
+}
+
+// wait blocks until the rate limit allows reading another record.
+func (m *Migrator) wait(ctx context.Context) error {
+	if m.limiter == nil {
+		return nil
+	}
+	return m.limiter.wait(ctx)
+}
+
+// Copy adds the records of the source missing from the destination,
+// keeping their expiration times. It can be interrupted and run again.
+func (m *Migrator) Copy(ctx context.Context) (MigrateStats, error) {
+	var stats MigrateStats
+	cur := m.src.NewCursor(m.opts.Prefix)
+	defer cur.Close()
+	for {
+		if err := m.wait(ctx); err != nil {
+			return stats, err
+		}
+		rec, err := cur.Next(ctx)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return stats, err
+		}
+		var xt int64
+		if !rec.Expires.IsZero() {
+			xt = -rec.Expires.Unix()
+		}
+		switch err := m.dst.add(ctx, rec.Key, rec.Value, xt); err {
+		case nil:
+			stats.Copied++
+		case ErrExists:
+			stats.Existing++
+		default:
+			return stats, err
+		}
+		if m.opts.Progress != nil && (stats.Copied+stats.Existing)%int64(m.opts.BatchSize) == 0 {
+			m.opts.Progress(stats)
+		}
+	}
+	if m.opts.Progress != nil {
+		m.opts.Progress(stats)
+	}
+	return stats, nil
+}
+
+// Verify compares a random sample of the records of the source, each
+// picked with probability fraction, with the destination. A sampled
+// record that differs is read again from both sides before it is
+// reported, so that writes racing with the check are not flagged.
+func (m *Migrator) Verify(ctx context.Context, fraction float64) (VerifyStats, error) {
+	var stats VerifyStats
+	sample := make(map[string][]byte, m.opts.BatchSize)
+	check := func() error {
+		if len(sample) == 0 {
+			return nil
+		}
+		missing, differing, err := m.compare(ctx, sample)
+		if err != nil {
+			return err
+		}
+		if suspects := append(missing, differing...); len(suspects) > 0 {
+			again := make(map[string][]byte, len(suspects))
+			for _, k := range suspects {
+				again[k] = nil
+			}
+			if err := m.src.GetBulkBytes(ctx, again); err != nil {
+				return err
+			}
+			if missing, differing, err = m.compare(ctx, again); err != nil {
+				return err
+			}
+			stats.Missing = append(stats.Missing, missing...)
+			stats.Differing = append(stats.Differing, differing...)
+		}
+		stats.Checked += int64(len(sample))
+		sample = make(map[string][]byte, m.opts.BatchSize)
+		return nil
+	}
+
+	cur := m.src.NewCursor(m.opts.Prefix)
+	defer cur.Close()
+	for {
+		if err := m.wait(ctx); err != nil {
+			return stats, err
+		}
+		rec, err := cur.Next(ctx)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return stats, err
+		}
+		if rand.Float64() >= fraction {
+			continue
+		}
+		sample[rec.Key] = rec.Value
+		if len(sample) >= m.opts.BatchSize {
+			if err := check(); err != nil {
+				return stats, err
+			}
+		}
+	}
+	return stats, check()
+}
+
+// compare returns the keys of want missing from the destination, and
+// those holding a different value there.
+func (m *Migrator) compare(ctx context.Context, want map[string][]byte) (missing, differing []string, err error) {
+	got := make(map[string][]byte, len(want))
+	for k := range want {
+		got[k] = nil
+	}
+	if err := m.dst.GetBulkBytes(ctx, got); err != nil {
+		return nil, nil, err
+	}
+	for k, v := range want {
+		gv, ok := got[k]
+		switch {
+		case !ok:
+			missing = append(missing, k)
+		case !bytes.Equal(gv, v):
+			differing = append(differing, k)
+		}
+	}
+	return missing, differing, nil
+}
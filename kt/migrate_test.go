@@ -0,0 +1,138 @@
+package kt
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sort"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// failingClient fails every write.
+type failingClient struct {
+	*memClient
+}
+
+var errFailing = errors.New("failing")
+
+func (f failingClient) Set(ctx context.Context, key string, value []byte) error {
+	return errFailing
+}
+
+func TestDualWrite(t *testing.T) {
+	ctx := context.Background()
+	old, new := newMemClient(), newMemClient()
+	old.Set(ctx, "only-old", []byte("1"))
+
+	var failed []string
+	d := NewDualWriteConn(old, failingClient{new}, PrimaryOld, func(op string, err error) {
+		failed = append(failed, op)
+	})
+	if err := d.Set(ctx, "a", []byte("1")); err != nil {
+		t.Fatalf("Set with failing secondary: %v", err)
+	}
+	if !reflect.DeepEqual(failed, []string{OpSet}) {
+		t.Errorf("reported failures: want [%s], got %v", OpSet, failed)
+	}
+
+	d = NewDualWriteConn(old, new, PrimaryOld, nil)
+	if err := d.Set(ctx, "b", []byte("2")); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []*memClient{old, new} {
+		if v, err := c.Get(ctx, "b"); v != "2" || err != nil {
+			t.Errorf("b: want 2, got %q, %v", v, err)
+		}
+	}
+	// The record was not copied yet: removing it from the new cluster
+	// must not fail.
+	if err := d.Remove(ctx, "only-old"); err != nil {
+		t.Errorf("Remove: %v", err)
+	}
+
+	new.Set(ctx, "c", []byte("new"))
+	if _, err := d.Get(ctx, "c"); err != ErrNotFound {
+		t.Errorf("reading c from old: want ErrNotFound, got %v", err)
+	}
+	d.SetPrimary(PrimaryNew)
+	if v, err := d.Get(ctx, "c"); v != "new" || err != nil {
+		t.Errorf("reading c from new: got %q, %v", v, err)
+	}
+	d = NewDualWriteConn(old, failingClient{new}, PrimaryNew, nil)
+	if err := d.Set(ctx, "d", []byte("4")); err != errFailing {
+		t.Errorf("Set with failing primary: want errFailing, got %v", err)
+	}
+	if _, err := old.Get(ctx, "d"); err != ErrNotFound {
+		t.Errorf("secondary written after the primary failed")
+	}
+}
+
+func TestMigrator(t *testing.T) {
+	ctx := context.Background()
+	srcKT, dstKT := newFakeKT(), newFakeKT()
+	later := time.Now().Add(time.Hour).Unix()
+	for i := 0; i < 50; i++ {
+		srcKT.put("m"+strconv.Itoa(i), []byte(strconv.Itoa(i)), 0)
+	}
+	srcKT.put("m7", []byte("7"), later)
+	srcKT.put("other", []byte("x"), 0)
+	// Written by live traffic before the copy reached it.
+	dstKT.put("m3", []byte("newer"), 0)
+
+	var progress []MigrateStats
+	m := NewMigrator(srcKT.conn(t), dstKT.conn(t), MigrateOptions{
+		Prefix:    "m",
+		BatchSize: 20,
+		Progress:  func(s MigrateStats) { progress = append(progress, s) },
+	})
+	stats, err := m.Copy(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (MigrateStats{Copied: 49, Existing: 1}); stats != want {
+		t.Errorf("Copy: want %+v, got %+v", want, stats)
+	}
+	if len(progress) != 3 || progress[2] != stats {
+		t.Errorf("progress: %+v", progress)
+	}
+	if rec, _ := dstKT.lookup("m3"); string(rec.value) != "newer" {
+		t.Errorf("m3 was overwritten with %q", rec.value)
+	}
+	if rec, _ := dstKT.lookup("m7"); rec.xt != later {
+		t.Errorf("m7: want expiry %d, got %d", later, rec.xt)
+	}
+	if _, ok := dstKT.lookup("other"); ok {
+		t.Errorf("record outside of the prefix was copied")
+	}
+
+	dstKT.put("m10", []byte("wrong"), 0)
+	dstKT.mu.Lock()
+	delete(dstKT.recs, "m11")
+	dstKT.mu.Unlock()
+	vs, err := m.Verify(ctx, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(vs.Differing)
+	if vs.Checked != 50 || !reflect.DeepEqual(vs.Missing, []string{"m11"}) || !reflect.DeepEqual(vs.Differing, []string{"m10", "m3"}) {
+		t.Errorf("Verify: %+v", vs)
+	}
+}
+
+func TestMigratorRate(t *testing.T) {
+	srcKT := newFakeKT()
+	for i := 0; i < 30; i++ {
+		srcKT.put(strconv.Itoa(i), nil, 0)
+	}
+	m := NewMigrator(srcKT.conn(t), newFakeKT().conn(t), MigrateOptions{Rate: 100})
+	start := time.Now()
+	if _, err := m.Copy(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	// A burst of 10 records, then 20 more at 100 per second.
+	if d := time.Since(start); d < 150*time.Millisecond {
+		t.Errorf("copying 30 records at 100/s took %v", d)
+	}
+}
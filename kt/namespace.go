@@ -0,0 +1,159 @@
+package kt
+
+import (
+	"context"
+	"strings"
+)
+
+// NamespacedConn is a view of a Client restricted to the keys starting with
+// a fixed prefix. The prefix is added to every key sent to KT and stripped
+// from every key returned, so users of the view cannot address records
+// outside of it.
+// NamespacedConn is safe for concurrent use.
+type NamespacedConn struct {
+	kt     Client
+	prefix string
+}
+
+// NamespaceSeparator ends the prefix of every namespace, so that the
+// namespaces "a" and "ab" do not overlap.
+const NamespaceSeparator = "/"
+
+// Namespace returns a view of conn in which every key is implicitly
+// prefixed with prefix and NamespaceSeparator, unless prefix already ends
+// with it. conn is typically a *Conn or a *TrackedConn. Namespaces only
+// overlap when nested, such as "a" and "a/b".
+// Namespace panics if prefix is empty, as the view would then cover the
+// whole database.
+func Namespace(conn Client, prefix string) *NamespacedConn {
+	if prefix == "" {
+		panic("kt: empty namespace prefix")
+	}
+	if !strings.HasSuffix(prefix, NamespaceSeparator) {
+		prefix += NamespaceSeparator
+	}
+	return &NamespacedConn{kt: conn, prefix: prefix}
+}
+
+// Prefix returns the prefix of the namespace, ending with
+// NamespaceSeparator.
+func (c *NamespacedConn) Prefix() string {
+	return c.prefix
+}
+
+// RetryCount returns the retry count of the underlying connection,
+// or 0 if it does not keep one.
+func (c *NamespacedConn) RetryCount() uint64 {
+	if rc, ok := c.kt.(interface{ RetryCount() uint64 }); ok {
+		return rc.RetryCount()
+	}
+	return 0
+}
+
+// Count returns the number of records in the namespace. Unlike Conn.Count
+// this has to list the keys of the namespace, so it is proportional to the
+// number of records in it.
+func (c *NamespacedConn) Count(ctx context.Context) (int, error) {
+	keys, err := c.kt.MatchPrefix(ctx, c.prefix, -1)
+	if err == ErrSuccess {
+		return 0, nil
+	}
+	return len(keys), err
+}
+
+func (c *NamespacedConn) Remove(ctx context.Context, key string) error {
+	return c.kt.Remove(ctx, c.prefix+key)
+}
+
+func (c *NamespacedConn) GetBulk(ctx context.Context, keysAndVals map[string]string) error {
+	m := make(map[string]string, len(keysAndVals))
+	for k := range keysAndVals {
+		m[c.prefix+k] = ""
+	}
+	if err := c.kt.GetBulk(ctx, m); err != nil {
+		return err
+	}
+	for k := range keysAndVals {
+		v, ok := m[c.prefix+k]
+		if ok {
+			keysAndVals[k] = v
+		} else {
+			delete(keysAndVals, k)
+		}
+	}
+	return nil
+}
+
+func (c *NamespacedConn) Get(ctx context.Context, key string) (string, error) {
+	return c.kt.Get(ctx, c.prefix+key)
+}
+
+func (c *NamespacedConn) GetBytes(ctx context.Context, key string) ([]byte, error) {
+	return c.kt.GetBytes(ctx, c.prefix+key)
+}
+
+func (c *NamespacedConn) Set(ctx context.Context, key string, value []byte) error {
+	return c.kt.Set(ctx, c.prefix+key, value)
+}
+
+func (c *NamespacedConn) GetBulkBytes(ctx context.Context, keys map[string][]byte) error {
+	m := make(map[string][]byte, len(keys))
+	for k := range keys {
+		m[c.prefix+k] = nil
+	}
+	if err := c.kt.GetBulkBytes(ctx, m); err != nil {
+		return err
+	}
+	for k := range keys {
+		v, ok := m[c.prefix+k]
+		if ok {
+			keys[k] = v
+		} else {
+			delete(keys, k)
+		}
+	}
+	return nil
+}
+
+func (c *NamespacedConn) SetBulk(ctx context.Context, values map[string]string) (int64, error) {
+	m := make(map[string]string, len(values))
+	for k, v := range values {
+		m[c.prefix+k] = v
+	}
+	return c.kt.SetBulk(ctx, m)
+}
+
+func (c *NamespacedConn) RemoveBulk(ctx context.Context, keys []string) (int64, error) {
+	return c.kt.RemoveBulk(ctx, c.prefixKeys(keys))
+}
+
+// MatchPrefix performs the match_prefix operation within the namespace.
+// The returned keys do not include the namespace prefix.
+func (c *NamespacedConn) MatchPrefix(ctx context.Context, key string, maxrecords int64) ([]string, error) {
+	keys, err := c.kt.MatchPrefix(ctx, c.prefix+key, maxrecords)
+	if err != nil {
+		return nil, err
+	}
+	return c.stripKeys(keys), nil
+}
+
+func (c *NamespacedConn) prefixKeys(keys []string) []string {
+	res := make([]string, len(keys))
+	for i, k := range keys {
+		res[i] = c.prefix + k
+	}
+	return res
+}
+
+// stripKeys removes the namespace prefix from keys in place. Keys
+// without the prefix cannot be returned by KT for a prefixed request and
+// are dropped defensively.
+func (c *NamespacedConn) stripKeys(keys []string) []string {
+	res := keys[:0]
+	for _, k := range keys {
+		if strings.HasPrefix(k, c.prefix) {
+			res = append(res, k[len(c.prefix):])
+		}
+	}
+	return res
+}
@@ -0,0 +1,114 @@
+package kt
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+func TestNamespaceStripKeys(t *testing.T) {
+	ns := &NamespacedConn{prefix: "svc/"}
+	keys := ns.prefixKeys([]string{"a", "b/c"})
+	if want := []string{"svc/a", "svc/b/c"}; !reflect.DeepEqual(keys, want) {
+		t.Errorf("prefixKeys: want %v, got %v", want, keys)
+	}
+	keys = append(keys, "other/a")
+	if got, want := ns.stripKeys(keys), []string{"a", "b/c"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("stripKeys: want %v, got %v", want, got)
+	}
+}
+
+func TestNamespaceIsolation(t *testing.T) {
+	ctx := context.Background()
+	cmd := startServer(t)
+	defer haltServer(cmd, t)
+	db, err := NewConn(KTHOST, KTPORT, 1, DEFAULT_TIMEOUT)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	a := Namespace(db, "a/")
+	b := Namespace(db, "b/")
+	a.Set(ctx, "key", []byte("from a"))
+	b.Set(ctx, "key", []byte("from b"))
+	if _, err := a.SetBulk(ctx, map[string]string{"x": "1", "y": "2"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if got, _ := a.Get(ctx, "key"); got != "from a" {
+		t.Errorf("a.Get: want %q, got %q", "from a", got)
+	}
+	if got, _ := db.Get(ctx, "b/key"); got != "from b" {
+		t.Errorf("db.Get: want %q, got %q", "from b", got)
+	}
+
+	keys, err := a.MatchPrefix(ctx, "", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"key", "x", "y"}; !reflect.DeepEqual(keys, want) {
+		t.Errorf("a.MatchPrefix: want %v, got %v", want, keys)
+	}
+
+	vals := map[string][]byte{"x": nil, "key": nil, "missing": nil}
+	if err := a.GetBulkBytes(ctx, vals); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string][]byte{"x": []byte("1"), "key": []byte("from a")}
+	if !reflect.DeepEqual(vals, want) {
+		t.Errorf("a.GetBulkBytes: want %q, got %q", want, vals)
+	}
+
+	if n, err := a.Count(ctx); err != nil || n != 3 {
+		t.Errorf("a.Count: want 3, got %d (%v)", n, err)
+	}
+	if _, err := b.RemoveBulk(ctx, []string{"x", "key"}); err != nil {
+		t.Fatal(err)
+	}
+	if n, _ := a.Count(ctx); n != 3 {
+		t.Errorf("b.RemoveBulk removed keys from a: count %d", n)
+	}
+}
+
+func TestNamespaceOverlappingPrefixes(t *testing.T) {
+	ctx := context.Background()
+	db := newFakeKT().conn(t)
+	defer db.Close(ctx)
+	a := Namespace(db, "a")
+	ab := Namespace(db, "ab")
+	if a.Prefix() != "a/" || Namespace(db, "a/").Prefix() != "a/" {
+		t.Errorf("prefixes: %q, %q", a.Prefix(), Namespace(db, "a/").Prefix())
+	}
+	if err := ab.Set(ctx, "key", []byte("from ab")); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Set(ctx, "key", []byte("from a")); err != nil {
+		t.Fatal(err)
+	}
+
+	if got, _ := ab.Get(ctx, "key"); got != "from ab" {
+		t.Errorf("ab.Get: want %q, got %q", "from ab", got)
+	}
+	if _, err := a.Get(ctx, "b/key"); err != ErrNotFound {
+		t.Errorf("a.Get of a key of ab: want ErrNotFound, got %v", err)
+	}
+	keys, err := a.MatchPrefix(ctx, "", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"key"}; !reflect.DeepEqual(keys, want) {
+		t.Errorf("a.MatchPrefix: want %v, got %v", want, keys)
+	}
+	if n, err := a.Count(ctx); err != nil || n != 1 {
+		t.Errorf("a.Count: want 1, got %d, %v", n, err)
+	}
+}
+
+func TestNamespaceEmptyPrefix(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("Namespace with an empty prefix did not panic")
+		}
+	}()
+	Namespace(&memClient{}, "")
+}
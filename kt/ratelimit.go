@@ -0,0 +1,247 @@
+package kt
+
+import (
+	"context"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cloudflare/golibs/tokenbucket"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var rateLimitRejections = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "ktrpc_client_rate_limit_rejections_total",
+	Help: "Operations rejected by client-side rate limits, labeled by operation and by the key prefix of the limit",
+},
+	[]string{
+		"op",
+		"prefix",
+	},
+)
+
+func init() {
+	prometheus.MustRegister(rateLimitRejections)
+}
+
+// ErrRateLimited is returned when an operation exceeds a fail-fast rate
+// limit.
+var ErrRateLimited error = &Error{Message: "rate limited"}
+
+// RateLimit caps the rate of the operations of a Conn matching Op and
+// Prefix.
+type RateLimit struct {
+	// Op restricts the limit to one operation, one of the Op
+	// constants. The empty string matches all operations.
+	Op string
+	// Prefix restricts the limit to the operations on at least one key
+	// starting with it. Operations without keys, such as Count, only
+	// match an empty Prefix.
+	Prefix string
+	// QPS is the number of operations allowed per second. It must be
+	// positive.
+	QPS float64
+	// Burst is the number of operations allowed at once when the limit
+	// has not been reached for a while. Defaults to a tenth of QPS,
+	// rounded up. It is at least 2.
+	Burst uint64
+	// FailFast makes operations over the limit fail with
+	// ErrRateLimited, rather than wait until the limit allows them or
+	// their context is done.
+	FailFast bool
+}
+
+// WithRateLimit limits the rate of operations of the Conn. An operation
+// proceeds once all the limits it matches allow it; a bulk operation
+// counts as one. Cursor steps count as OpGet on the prefix of the
+// cursor, and compare-and-swap, add and increment as OpSet.
+//
+// Fail-fast limits are checked first, so that an operation they reject
+// takes no token from the limits it would have waited for; it still
+// takes one from the fail-fast limits it passed. Waiting is bounded by
+// the deadline of the context of the operation or, without one, by its
+// timeout, after which it fails with ErrTimeout.
+//
+// Rejected operations, including the ones whose context ended while
+// waiting, are counted in the ktrpc_client_rate_limit_rejections_total
+// metric.
+func WithRateLimit(limits ...RateLimit) Option {
+	return func(c *Conn) {
+		for _, l := range limits {
+			c.limits = append(c.limits, &rateLimit{RateLimit: l, bucket: newRateBucket(l.QPS, l.Burst)})
+		}
+	}
+}
+
+type rateLimit struct {
+	RateLimit
+	bucket *rateBucket
+}
+
+func (l *rateLimit) validate() error {
+	if !(l.QPS > 0) || math.IsInf(l.QPS, 1) {
+		return &Error{Message: "invalid rate limit QPS " + strconv.FormatFloat(l.QPS, 'g', -1, 64)}
+	}
+	return nil
+}
+
+func (l *rateLimit) matches(op string, keys keySet) bool {
+	if l.Op != "" && l.Op != op {
+		return false
+	}
+	return l.Prefix == "" || keys != nil && keys.hasPrefix(l.Prefix)
+}
+
+// keySet is the set of keys of an operation, as seen by rate limits and
+// by the hot key observer.
+type keySet interface {
+	hasPrefix(prefix string) bool
+	each(fn func(key string))
+}
+
+type singleKey string
+
+func (k singleKey) hasPrefix(prefix string) bool {
+	return strings.HasPrefix(string(k), prefix)
+}
+
+func (k singleKey) each(fn func(key string)) {
+	fn(string(k))
+}
+
+type keyList []string
+
+func (keys keyList) hasPrefix(prefix string) bool {
+	for _, k := range keys {
+		if strings.HasPrefix(k, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func (keys keyList) each(fn func(key string)) {
+	for _, k := range keys {
+		fn(k)
+	}
+}
+
+type keyMap[V any] map[string]V
+
+func (keys keyMap[V]) hasPrefix(prefix string) bool {
+	for k := range keys {
+		if strings.HasPrefix(k, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func (keys keyMap[V]) each(fn func(key string)) {
+	for k := range keys {
+		fn(k)
+	}
+}
+
+type kvKeys []KV
+
+func (kvs kvKeys) hasPrefix(prefix string) bool {
+	for _, kv := range kvs {
+		if strings.HasPrefix(kv.Key, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func (kvs kvKeys) each(fn func(key string)) {
+	for _, kv := range kvs {
+		fn(kv.Key)
+	}
+}
+
+// admit is called at the start of every operation. It reports keys to
+// the hot key observer, then waits until the rate limits of c matching op
+// and keys allow the operation. keys is nil for operations without keys.
+func (c *Conn) admit(ctx context.Context, op string, keys keySet) error {
+	if keys != nil {
+		c.hotKeys.observe(keys)
+	}
+	// The operation has not started yet, so waiting is bounded as the
+	// request will be.
+	var waitCtx context.Context
+	for _, failFast := range [...]bool{true, false} {
+		for _, l := range c.limits {
+			if l.FailFast != failFast || !l.matches(op, keys) {
+				continue
+			}
+			var err error
+			if l.FailFast {
+				if !l.bucket.take() {
+					err = ErrRateLimited
+				}
+			} else {
+				if waitCtx == nil {
+					var cancel context.CancelFunc
+					waitCtx, cancel = c.requestContext(ctx, op)
+					defer cancel()
+				}
+				if err = l.bucket.wait(waitCtx); err != nil {
+					err = requestError(waitCtx, err)
+				}
+			}
+			if err != nil {
+				rateLimitRejections.WithLabelValues(op, l.Prefix).Inc()
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// rateBucket makes a tokenbucket.Filter safe for concurrent use, and
+// adds a way to wait for a token.
+type rateBucket struct {
+	mu       sync.Mutex
+	filter   *tokenbucket.Filter
+	interval time.Duration
+}
+
+// newRateBucket returns a bucket earning rate tokens per second and
+// holding up to burst of them, by default a tenth of rate.
+func newRateBucket(rate float64, burst uint64) *rateBucket {
+	if burst == 0 {
+		burst = uint64(math.Ceil(rate / 10))
+	}
+	// A filter of depth 1 caps its credit at the cost of a single
+	// operation, and only lets operations through above that.
+	if burst < 2 {
+		burst = 2
+	}
+	return &rateBucket{
+		filter:   tokenbucket.New(1, rate, burst),
+		interval: time.Duration(float64(time.Second) / rate),
+	}
+}
+
+func (b *rateBucket) take() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.filter.Touch(nil)
+}
+
+// wait takes a token, waiting until there is one or until ctx is done.
+func (b *rateBucket) wait(ctx context.Context) error {
+	for !b.take() {
+		t := time.NewTimer(b.interval)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return ctx.Err()
+		case <-t.C:
+		}
+	}
+	return nil
+}
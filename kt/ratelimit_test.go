@@ -0,0 +1,143 @@
+package kt
+
+import (
+	"context"
+	"math"
+	"testing"
+	"time"
+)
+
+func TestRateLimitFailFast(t *testing.T) {
+	ctx := context.Background()
+	db := newFakeKT().conn(t, WithRateLimit(RateLimit{
+		Op:       OpGetBytes,
+		Prefix:   "batch:",
+		QPS:      1,
+		Burst:    2,
+		FailFast: true,
+	}))
+	for i := 0; i < 2; i++ {
+		if _, err := db.GetBytes(ctx, "batch:a"); err != ErrNotFound {
+			t.Fatalf("GetBytes %d: %v", i, err)
+		}
+	}
+	if _, err := db.GetBytes(ctx, "batch:a"); err != ErrRateLimited {
+		t.Errorf("GetBytes over the limit: want ErrRateLimited, got %v", err)
+	}
+	// Other keys and other operations are not limited.
+	if _, err := db.GetBytes(ctx, "online:a"); err != ErrNotFound {
+		t.Errorf("GetBytes outside of the prefix: %v", err)
+	}
+	if err := db.Set(ctx, "batch:a", nil); err != nil {
+		t.Errorf("Set: %v", err)
+	}
+	keys := map[string][]byte{"online:b": nil, "batch:b": nil}
+	if err := db.GetBulkBytes(ctx, keys); err != nil {
+		t.Errorf("GetBulkBytes: %v", err)
+	}
+}
+
+func TestRateLimitBlocking(t *testing.T) {
+	ctx := context.Background()
+	db := newFakeKT().conn(t, WithRateLimit(RateLimit{QPS: 50, Burst: 2}))
+	start := time.Now()
+	for i := 0; i < 7; i++ {
+		if err := db.Set(ctx, "a", nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if d := time.Since(start); d < 90*time.Millisecond {
+		t.Errorf("7 operations at 50 per second took %v", d)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Millisecond)
+	defer cancel()
+	if _, err := db.Count(ctx); err != ErrTimeout {
+		t.Errorf("waiting past the deadline: want ErrTimeout, got %v", err)
+	}
+}
+
+func TestRateLimitWaitBounded(t *testing.T) {
+	db := newFakeKT().conn(t,
+		WithRateLimit(RateLimit{QPS: 1, Burst: 2}),
+		WithOpTimeouts(map[string]time.Duration{OpCount: 20 * time.Millisecond}))
+	ctx := context.Background()
+	for i := 0; i < 2; i++ {
+		if _, err := db.Count(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	start := time.Now()
+	if _, err := db.Count(ctx); err != ErrTimeout {
+		t.Errorf("waiting past the timeout: want ErrTimeout, got %v", err)
+	}
+	if d := time.Since(start); d > 500*time.Millisecond {
+		t.Errorf("waited %v past a timeout of 20ms", d)
+	}
+}
+
+func TestRateLimitFailFastFirst(t *testing.T) {
+	db := newFakeKT().conn(t, WithRateLimit(
+		RateLimit{QPS: 1, Burst: 3},
+		RateLimit{Op: OpGetBytes, QPS: 1, Burst: 2, FailFast: true},
+	))
+	ctx := context.Background()
+	for i := 0; i < 2; i++ {
+		if _, err := db.GetBytes(ctx, "a"); err != ErrNotFound {
+			t.Fatalf("GetBytes %d: %v", i, err)
+		}
+	}
+	if _, err := db.GetBytes(ctx, "a"); err != ErrRateLimited {
+		t.Fatalf("GetBytes over the limit: want ErrRateLimited, got %v", err)
+	}
+	// The rejected operation left the last token of the waiting limit.
+	short, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	if err := db.Set(short, "a", nil); err != nil {
+		t.Errorf("Set after a rejected GetBytes: %v", err)
+	}
+}
+
+func TestRateLimitInvalidQPS(t *testing.T) {
+	host, port := startFakeServer(t, newFakeKT())
+	for _, qps := range []float64{0, -1, math.NaN(), math.Inf(1)} {
+		if _, err := NewConn(host, port, 1, DEFAULT_TIMEOUT, WithRateLimit(RateLimit{QPS: qps})); err == nil {
+			t.Errorf("QPS %v: no error", qps)
+		}
+	}
+}
+
+func TestRateLimitWaitCanceled(t *testing.T) {
+	db := newFakeKT().conn(t, WithRateLimit(RateLimit{QPS: 1, Burst: 2}))
+	ctx, cancel := context.WithCancel(context.Background())
+	for i := 0; i < 2; i++ {
+		if _, err := db.Count(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	time.AfterFunc(10*time.Millisecond, cancel)
+	if _, err := db.Count(ctx); err != context.Canceled {
+		t.Errorf("cancelled while waiting: want context.Canceled, got %v", err)
+	}
+}
+
+func TestRateBucketBurst(t *testing.T) {
+	for _, c := range []struct {
+		rate  float64
+		burst uint64
+		want  int
+	}{
+		{5, 0, 2},
+		{100, 0, 10},
+		{1, 3, 3},
+	} {
+		b := newRateBucket(c.rate, c.burst)
+		n := 0
+		for b.take() {
+			n++
+		}
+		if n != c.want {
+			t.Errorf("rate %v, burst %d: want %d operations at once, got %d", c.rate, c.burst, c.want, n)
+		}
+	}
+}
@@ -0,0 +1,385 @@
+package kt
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Endpoint defines how to connect to a KT server, with the arguments of
+// NewConn and NewConnTLS. In the registry file, Timeout is a string such
+// as "500ms".
+type Endpoint struct {
+	Host string `json:"host"`
+	Port int    `json:"port"`
+	// PoolSize defaults to 1.
+	PoolSize int `json:"poolsize"`
+	// Timeout defaults to DEFAULT_TIMEOUT.
+	Timeout time.Duration `json:"-"`
+	// Creds is the directory of the TLS credentials, see NewConnTLS.
+	// The connection does not use TLS if it is empty.
+	Creds string `json:"creds,omitempty"`
+}
+
+func (e *Endpoint) UnmarshalJSON(b []byte) error {
+	type endpoint Endpoint
+	var v struct {
+		endpoint
+		Timeout string `json:"timeout"`
+	}
+	if err := json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+	*e = Endpoint(v.endpoint)
+	if v.Timeout != "" {
+		d, err := time.ParseDuration(v.Timeout)
+		if err != nil {
+			return err
+		}
+		e.Timeout = d
+	}
+	return nil
+}
+
+func (e Endpoint) MarshalJSON() ([]byte, error) {
+	type endpoint Endpoint
+	return json.Marshal(struct {
+		endpoint
+		Timeout string `json:"timeout"`
+	}{endpoint(e), e.Timeout.String()})
+}
+
+func (e *Endpoint) validate() error {
+	if e.Host == "" {
+		return &Error{Message: "missing host"}
+	}
+	if e.Port <= 0 || e.Port > 65535 {
+		return &Error{Message: "invalid port " + strconv.Itoa(e.Port)}
+	}
+	if e.PoolSize < 0 || e.Timeout < 0 {
+		return &Error{Message: "negative poolsize or timeout"}
+	}
+	if e.PoolSize == 0 {
+		e.PoolSize = 1
+	}
+	if e.Timeout == 0 {
+		e.Timeout = DEFAULT_TIMEOUT
+	}
+	return nil
+}
+
+// Dial connects to the endpoint.
+func (e Endpoint) Dial(opts ...Option) (*Conn, error) {
+	if err := e.validate(); err != nil {
+		return nil, err
+	}
+	return newConn(e.Host, e.Port, e.PoolSize, e.Timeout, e.Creds, opts)
+}
+
+// RegistryOptions configures a Registry.
+type RegistryOptions struct {
+	// Options are applied to every Conn of the registry.
+	Options []Option
+	// PollInterval between checks of the registry file for changes. A
+	// negative value disables them, leaving reloads to Reload. Defaults
+	// to 10s.
+	PollInterval time.Duration
+	// DrainTimeout is the time given to the operations in flight on a
+	// Conn replaced or removed by a reload before it is closed. Defaults
+	// to 30s.
+	DrainTimeout time.Duration
+	// OnReload, if not nil, is called after every reload triggered by a
+	// change of the file, with its error.
+	OnReload func(err error)
+}
+
+// Registry holds connections to named KT endpoints, defined in a JSON
+// file such as
+//
+//	{
+//		"endpoints": {
+//			"sessions": {"host": "kt1", "port": 1978, "poolsize": 8, "timeout": "500ms"},
+//			"cache": {"host": "kt2", "port": 1979, "creds": "/etc/kt/creds"}
+//		}
+//	}
+//
+// Each endpoint is dialed on its first lookup, and its Conn is then
+// reused. When the file changes, the registry reloads it: the Conns of
+// unchanged endpoints are kept, while those of changed or removed
+// endpoints are closed once their operations in flight are done, or
+// after DrainTimeout. Callers should therefore look Conns up for each
+// unit of work rather than keep them, so as to pick up changes.
+// Registry is safe for concurrent use.
+type Registry struct {
+	path string
+	opts RegistryOptions
+
+	mu      sync.RWMutex
+	entries map[string]*registryEntry
+	closed  bool
+	// reloadMu serializes reloads, and guards the file state below.
+	reloadMu sync.Mutex
+	modTime  time.Time
+	size     int64
+
+	stop   chan struct{}
+	done   chan struct{}
+	drains sync.WaitGroup
+}
+
+type registryFile struct {
+	Endpoints map[string]Endpoint `json:"endpoints"`
+}
+
+// registryEntry is the Conn of an endpoint, dialed lazily.
+type registryEntry struct {
+	ep      Endpoint
+	mu      sync.Mutex
+	conn    *Conn
+	retired bool
+}
+
+// NewRegistry loads the endpoints defined in the file at path. It does
+// not connect to them.
+func NewRegistry(path string, opts RegistryOptions) (*Registry, error) {
+	if opts.PollInterval == 0 {
+		opts.PollInterval = 10 * time.Second
+	}
+	if opts.DrainTimeout <= 0 {
+		opts.DrainTimeout = 30 * time.Second
+	}
+	r := &Registry{
+		path:    path,
+		opts:    opts,
+		entries: make(map[string]*registryEntry),
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+	if opts.PollInterval > 0 {
+		go r.poll()
+	} else {
+		close(r.done)
+	}
+	return r, nil
+}
+
+// Conn returns the Conn of the named endpoint, connecting to it if
+// needed.
+func (r *Registry) Conn(name string) (*Conn, error) {
+	for {
+		r.mu.RLock()
+		e, ok := r.entries[name]
+		closed := r.closed
+		r.mu.RUnlock()
+		if closed {
+			return nil, ErrClosed
+		}
+		if !ok {
+			return nil, &Error{Message: "unknown KT endpoint " + strconv.Quote(name)}
+		}
+		conn, err := e.get(r.opts.Options)
+		if err == errRetired {
+			// Replaced by a reload in the meantime.
+			continue
+		}
+		return conn, err
+	}
+}
+
+var errRetired = &Error{Message: "endpoint retired"}
+
+func (e *registryEntry) get(opts []Option) (*Conn, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.retired {
+		return nil, errRetired
+	}
+	if e.conn == nil {
+		conn, err := e.ep.Dial(opts...)
+		if err != nil {
+			return nil, err
+		}
+		e.conn = conn
+	}
+	return e.conn, nil
+}
+
+// retire stops the entry from handing out its Conn, and returns it.
+func (e *registryEntry) retire() *Conn {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.retired = true
+	conn := e.conn
+	e.conn = nil
+	return conn
+}
+
+// Names returns the names of the endpoints, sorted.
+func (r *Registry) Names() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	names := make([]string, 0, len(r.entries))
+	for name := range r.entries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Endpoint returns the definition of the named endpoint.
+func (r *Registry) Endpoint(name string) (Endpoint, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	e, ok := r.entries[name]
+	if !ok {
+		return Endpoint{}, false
+	}
+	return e.ep, true
+}
+
+// Reload reads the registry file again. If the file is invalid, the
+// endpoints are left unchanged and the error is returned.
+func (r *Registry) Reload() error {
+	r.reloadMu.Lock()
+	defer r.reloadMu.Unlock()
+	return r.reload()
+}
+
+func (r *Registry) reload() error {
+	f, err := os.Open(r.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	// Record the state of the file first, so that an invalid file is not
+	// reloaded until it changes again.
+	r.modTime, r.size = fi.ModTime(), fi.Size()
+	var rf registryFile
+	if err := json.NewDecoder(f).Decode(&rf); err != nil {
+		return &Error{Message: "invalid registry " + r.path + ": " + err.Error()}
+	}
+	for name, ep := range rf.Endpoints {
+		if err := ep.validate(); err != nil {
+			return &Error{Message: "endpoint " + strconv.Quote(name) + ": " + err.Error()}
+		}
+		rf.Endpoints[name] = ep
+	}
+
+	r.mu.Lock()
+	if r.closed {
+		r.mu.Unlock()
+		return ErrClosed
+	}
+	entries := make(map[string]*registryEntry, len(rf.Endpoints))
+	var retired []*registryEntry
+	for name, ep := range rf.Endpoints {
+		if e, ok := r.entries[name]; ok && e.ep == ep {
+			entries[name] = e
+		} else {
+			entries[name] = &registryEntry{ep: ep}
+		}
+	}
+	for name, e := range r.entries {
+		if entries[name] != e {
+			retired = append(retired, e)
+		}
+	}
+	r.entries = entries
+	r.mu.Unlock()
+
+	for _, e := range retired {
+		r.drain(e.retire())
+	}
+	return nil
+}
+
+// drain closes conn in the background, once its operations are done.
+func (r *Registry) drain(conn *Conn) {
+	if conn == nil {
+		return
+	}
+	r.drains.Add(1)
+	go func() {
+		defer r.drains.Done()
+		ctx, cancel := context.WithTimeout(context.Background(), r.opts.DrainTimeout)
+		defer cancel()
+		conn.Close(ctx)
+	}()
+}
+
+// poll reloads the file when its modification time or size change.
+func (r *Registry) poll() {
+	defer close(r.done)
+	t := time.NewTicker(r.opts.PollInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-r.stop:
+			return
+		case <-t.C:
+		}
+		fi, err := os.Stat(r.path)
+		if err != nil {
+			continue
+		}
+		r.reloadMu.Lock()
+		var changed bool
+		if !fi.ModTime().Equal(r.modTime) || fi.Size() != r.size {
+			changed = true
+			err = r.reload()
+		}
+		r.reloadMu.Unlock()
+		if changed && r.opts.OnReload != nil {
+			r.opts.OnReload(err)
+		}
+	}
+}
+
+// Close stops watching the registry file and closes all the Conns, as
+// Conn.Close does.
+func (r *Registry) Close(ctx context.Context) error {
+	r.mu.Lock()
+	if r.closed {
+		r.mu.Unlock()
+		return nil
+	}
+	r.closed = true
+	entries := r.entries
+	r.entries = nil
+	r.mu.Unlock()
+	close(r.stop)
+	<-r.done
+
+	var firstErr error
+	for _, e := range entries {
+		if conn := e.retire(); conn != nil {
+			if err := conn.Close(ctx); err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	done := make(chan struct{})
+	go func() {
+		r.drains.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		if firstErr == nil {
+			firstErr = ctx.Err()
+		}
+	}
+	return firstErr
+}
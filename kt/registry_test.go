@@ -0,0 +1,143 @@
+package kt
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writeRegistry(t *testing.T, path string, endpoints map[string]string) {
+	t.Helper()
+	s := `{"endpoints": {`
+	sep := ""
+	for name, ep := range endpoints {
+		s += fmt.Sprintf("%s%q: %s", sep, name, ep)
+		sep = ", "
+	}
+	if err := os.WriteFile(path, []byte(s+"}}"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRegistry(t *testing.T) {
+	ctx := context.Background()
+	host1, port1 := startFakeServer(t, newFakeKT())
+	host2, port2 := startFakeServer(t, newFakeKT())
+	ep1 := fmt.Sprintf(`{"host": %q, "port": %d, "poolsize": 2, "timeout": "1s"}`, host1, port1)
+	ep2 := fmt.Sprintf(`{"host": %q, "port": %d}`, host2, port2)
+	path := filepath.Join(t.TempDir(), "kt.json")
+	writeRegistry(t, path, map[string]string{"a": ep1, "b": ep1})
+
+	r, err := NewRegistry(path, RegistryOptions{PollInterval: -1, DrainTimeout: time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close(ctx)
+	if names := r.Names(); len(names) != 2 || names[0] != "a" || names[1] != "b" {
+		t.Errorf("Names: %q", names)
+	}
+	if ep, ok := r.Endpoint("a"); !ok || ep.PoolSize != 2 || ep.Timeout != time.Second {
+		t.Errorf("Endpoint: %+v, %v", ep, ok)
+	}
+	if ep, _ := r.Endpoint("b"); ep.Timeout != time.Second {
+		t.Errorf("Endpoint b: %+v", ep)
+	}
+	a, err := r.Conn("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again, _ := r.Conn("a"); again != a {
+		t.Error("Conn not reused")
+	}
+	b, err := r.Conn("b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkGetSet(t, b)
+	if _, err := r.Conn("c"); !IsError(err) {
+		t.Errorf("unknown endpoint: got %v", err)
+	}
+
+	// b moves to the second server and c appears, while a is left alone.
+	writeRegistry(t, path, map[string]string{"a": ep1, "b": ep2, "c": ep2})
+	if err := r.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if again, _ := r.Conn("a"); again != a {
+		t.Error("Conn of an unchanged endpoint replaced")
+	}
+	nb, err := r.Conn("b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if nb == b {
+		t.Fatal("Conn of a changed endpoint kept")
+	}
+	if _, err := nb.Get(ctx, "k"); err != ErrNotFound {
+		t.Errorf("new Conn of b reads the old server: %v", err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for _, err := b.Get(ctx, "k"); err != ErrClosed; _, err = b.Get(ctx, "k") {
+		if time.Now().After(deadline) {
+			t.Fatalf("replaced Conn not closed: %v", err)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if _, err := r.Conn("c"); err != nil {
+		t.Error(err)
+	}
+
+	// Invalid files leave the endpoints unchanged.
+	for _, bad := range []string{`{"endpoints": `, `{"endpoints": {"a": {"port": 1}}}`, `{"endpoints": {"a": {"host": "h", "port": 1, "timeout": "soon"}}}`} {
+		os.WriteFile(path, []byte(bad), 0o600)
+		if err := r.Reload(); err == nil {
+			t.Errorf("%s: no error", bad)
+		}
+	}
+	if again, _ := r.Conn("a"); again != a {
+		t.Error("failed reload replaced a Conn")
+	}
+
+	if err := r.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.Get(ctx, "k"); err != ErrClosed {
+		t.Errorf("Conn not closed with the registry: %v", err)
+	}
+	if _, err := r.Conn("a"); err != ErrClosed {
+		t.Errorf("Conn after Close: %v", err)
+	}
+}
+
+func TestRegistryPoll(t *testing.T) {
+	host, port := startFakeServer(t, newFakeKT())
+	ep := fmt.Sprintf(`{"host": %q, "port": %d}`, host, port)
+	path := filepath.Join(t.TempDir(), "kt.json")
+	writeRegistry(t, path, map[string]string{"a": ep})
+
+	reloads := make(chan error, 10)
+	r, err := NewRegistry(path, RegistryOptions{
+		PollInterval: 5 * time.Millisecond,
+		OnReload:     func(err error) { reloads <- err },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close(context.Background())
+
+	writeRegistry(t, path, map[string]string{"a": ep, "bb": ep})
+	select {
+	case err := <-reloads:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("change not picked up")
+	}
+	if _, ok := r.Endpoint("bb"); !ok {
+		t.Error("endpoint added to the file missing")
+	}
+}
@@ -0,0 +1,693 @@
+package kt
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// A spill log is an append-only file of the writes a SpillConn could not
+// send to KT. It starts with a header
+//
+//	"KTSPILL" <version>
+//
+// followed by records
+//
+//	<op> <uvarint seq> <uvarint key length> <key> <uvarint value length> <value> <crc32>
+//
+// where op is spillSet or spillRemove, seq increases by one with every
+// record, and the IEEE CRC-32 covers the preceding bytes of the record.
+// A record cut short or failing its checksum ends the log: it was being
+// written when the process died, so it is dropped along with anything
+// after it.
+//
+// The sequence number of the last record replayed is kept next to the
+// log, in a file named after it with an ".ack" suffix, so that replay
+// resumes where it stopped after a restart. The log is truncated when all
+// its records have been replayed.
+const (
+	spillVersion = 1
+
+	spillSet    = 1
+	spillRemove = 2
+)
+
+var spillMagic = []byte("KTSPILL")
+
+var spillHeaderLen = int64(len(spillMagic) + 1)
+
+// ErrSpillFull is returned by the writes of a SpillConn that could not be
+// sent to KT nor spilled, because the spill log reached its size cap.
+var ErrSpillFull error = &Error{Message: "spill log full"}
+
+// ErrCorruptSpill is returned when opening a spill log with an invalid
+// header or acknowledgement file.
+var ErrCorruptSpill error = &Error{Message: "corrupt spill log"}
+
+// SpillOptions configures a SpillConn.
+type SpillOptions struct {
+	// MaxBytes caps the size of the spill log. Records are only reclaimed
+	// once the whole log is replayed, so the cap counts replayed records
+	// until then. Defaults to 64MiB.
+	MaxBytes int64
+	// CheckInterval between health checks of the server while records
+	// are waiting in the spill log. Defaults to 5s.
+	CheckInterval time.Duration
+	// BatchSize is the maximum number of records replayed by a single
+	// bulk operation. Defaults to 1000.
+	BatchSize int
+	// NoSync skips the fsync after each spilled write. Spilled writes are
+	// then lost if the host crashes, rather than only the process.
+	NoSync bool
+	// Metrics, if not nil, is updated by the SpillConn.
+	Metrics *SpillMetrics
+	// OnDiscard, if not nil, is called with the records of a replayed
+	// batch rejected by the server with a KT error. They are dropped, as
+	// retrying them would block the log forever.
+	OnDiscard func(op string, keys []string, err error)
+}
+
+// SpillMetrics is the set of prometheus collectors updated by a
+// SpillConn. Any of the fields may be nil to disable that metric.
+type SpillMetrics struct {
+	// Pending is the number of records waiting in the spill log.
+	Pending prometheus.Gauge
+	// Bytes is the size of the spill log.
+	Bytes prometheus.Gauge
+	// Spilled, Replayed, Rejected and Discarded count the records
+	// written to the spill log, replayed to KT, refused because the log
+	// was full, and dropped because KT refused them during replay.
+	Spilled   prometheus.Counter
+	Replayed  prometheus.Counter
+	Rejected  prometheus.Counter
+	Discarded prometheus.Counter
+}
+
+// NewSpillMetrics creates the collectors for a SpillConn, named under the
+// given prometheus namespace and subsystem. They still have to be
+// registered, see Collectors.
+func NewSpillMetrics(namespace, subsystem string) *SpillMetrics {
+	counter := func(name, help string) prometheus.Counter {
+		return prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      name,
+			Help:      help,
+		})
+	}
+	return &SpillMetrics{
+		Pending: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "kt_spill_pending_records",
+			Help:      "Number of KT writes waiting in the spill log",
+		}),
+		Bytes: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "kt_spill_bytes",
+			Help:      "Size of the KT spill log in bytes",
+		}),
+		Spilled:   counter("kt_spill_spilled_total", "Number of KT writes written to the spill log"),
+		Replayed:  counter("kt_spill_replayed_total", "Number of spilled KT writes replayed"),
+		Rejected:  counter("kt_spill_rejected_total", "Number of KT writes lost because the spill log was full"),
+		Discarded: counter("kt_spill_discarded_total", "Number of spilled KT writes refused by the server on replay"),
+	}
+}
+
+// Collectors returns the non-nil collectors of m, for registration.
+func (m *SpillMetrics) Collectors() []prometheus.Collector {
+	var cs []prometheus.Collector
+	for _, c := range []prometheus.Collector{m.Pending, m.Bytes, m.Spilled, m.Replayed, m.Rejected, m.Discarded} {
+		if c != nil {
+			cs = append(cs, c)
+		}
+	}
+	return cs
+}
+
+// SpillConn keeps the writes of a Conn that fail because the server is
+// unreachable in a local spill log, and replays them in order through
+// bulk operations once the server answers health checks again.
+//
+// A write is spilled when it fails with an error other than a KT error,
+// such as a connection error, or with ErrTimeout. Writes cancelled by
+// their context are not spilled. While the log holds records, all writes
+// are spilled without being tried, so that they reach KT in order; reads
+// may then return stale values. Spilled writes succeed: Remove cannot
+// report ErrNotFound, and the bulk operations return the number of
+// records spilled.
+//
+// Replay is at least once: records replayed just before a crash may be
+// replayed again on restart, which is harmless as they come in order.
+// SpillConn is safe for concurrent use, but a spill log must only be
+// opened by one SpillConn at a time.
+type SpillConn struct {
+	conn *Conn
+	opts SpillOptions
+	path string
+
+	// mu guards the log and the counters below.
+	mu      sync.Mutex
+	f       *os.File
+	size    int64
+	readOff int64
+	seq     uint64
+	ack     uint64
+	pending int64
+	// torn is set when a failed append could not be truncated away.
+	torn bool
+
+	// replayMu serializes replays.
+	replayMu sync.Mutex
+	ctx      context.Context
+	cancel   context.CancelFunc
+	done     chan struct{}
+}
+
+var _ Client = (*SpillConn)(nil)
+
+// NewSpillConn returns a client writing to conn and spilling to the log
+// at path, which is created if needed. Records left in the log by a
+// previous process are replayed once the server is healthy. Close must be
+// called to stop the health checks.
+func NewSpillConn(conn *Conn, path string, opts SpillOptions) (*SpillConn, error) {
+	if opts.MaxBytes <= 0 {
+		opts.MaxBytes = 64 << 20
+	}
+	if opts.CheckInterval <= 0 {
+		opts.CheckInterval = 5 * time.Second
+	}
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = 1000
+	}
+	s := &SpillConn{conn: conn, opts: opts, path: path, done: make(chan struct{})}
+	if err := s.open(); err != nil {
+		return nil, err
+	}
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+	go s.run()
+	return s, nil
+}
+
+func (s *SpillConn) open() error {
+	if b, err := os.ReadFile(s.path + ".ack"); err == nil {
+		if len(b) != 12 || crc32.ChecksumIEEE(b[:8]) != binary.BigEndian.Uint32(b[8:]) {
+			return ErrCorruptSpill
+		}
+		s.ack = binary.BigEndian.Uint64(b)
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	f, err := os.OpenFile(s.path, os.O_RDWR|os.O_CREATE, 0o600)
+	if err != nil {
+		return err
+	}
+	s.f = f
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	if fi.Size() == 0 {
+		if err := s.reset(); err != nil {
+			f.Close()
+			return err
+		}
+	} else if err := s.recover(fi.Size()); err != nil {
+		f.Close()
+		return err
+	}
+	s.seq = max64(s.seq, s.ack)
+	s.updateGauges()
+	return nil
+}
+
+// recover scans an existing log, skipping the records already replayed
+// and truncating it after the last valid record.
+func (s *SpillConn) recover(size int64) error {
+	header := make([]byte, spillHeaderLen)
+	if _, err := s.f.ReadAt(header, 0); err != nil || string(header[:len(spillMagic)]) != string(spillMagic) {
+		return ErrCorruptSpill
+	}
+	if header[len(spillMagic)] != spillVersion {
+		return &Error{Message: "unsupported spill log version"}
+	}
+	r := newSpillReader(s.f, spillHeaderLen, size)
+	s.readOff = spillHeaderLen
+	end := spillHeaderLen
+	for {
+		rec, err := r.next()
+		if err != nil || (s.seq != 0 && rec.seq != s.seq+1) {
+			// End of the log, or a torn write.
+			break
+		}
+		s.seq = rec.seq
+		end = r.off
+		if rec.seq <= s.ack {
+			s.readOff = end
+		} else {
+			s.pending++
+		}
+	}
+	s.size = end
+	if end < size {
+		if err := s.f.Truncate(end); err != nil {
+			return err
+		}
+	}
+	if s.pending == 0 {
+		return s.reset()
+	}
+	return nil
+}
+
+// reset empties the log. s.mu must be held, or s not shared yet.
+func (s *SpillConn) reset() error {
+	if err := s.f.Truncate(0); err != nil {
+		return err
+	}
+	header := append(append([]byte(nil), spillMagic...), spillVersion)
+	if _, err := s.f.WriteAt(header, 0); err != nil {
+		return err
+	}
+	s.size, s.readOff, s.pending = spillHeaderLen, spillHeaderLen, 0
+	return nil
+}
+
+func max64(a, b uint64) uint64 {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+func (s *SpillConn) updateGauges() {
+	if m := s.opts.Metrics; m != nil {
+		if m.Pending != nil {
+			m.Pending.Set(float64(s.pending))
+		}
+		if m.Bytes != nil {
+			m.Bytes.Set(float64(s.size))
+		}
+	}
+}
+
+func (s *SpillConn) count(c prometheus.Counter, n int) {
+	if c != nil && n > 0 {
+		c.Add(float64(n))
+	}
+}
+
+// Pending returns the number of records waiting to be replayed.
+func (s *SpillConn) Pending() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.pending
+}
+
+// spill appends records to the log. values is nil for removals.
+func (s *SpillConn) spill(op byte, keys []string, values [][]byte) error {
+	var b []byte
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.f == nil {
+		return ErrClosed
+	}
+	if s.torn {
+		if err := s.f.Truncate(s.size); err != nil {
+			return err
+		}
+		s.torn = false
+	}
+	seq := s.seq
+	for i, k := range keys {
+		start := len(b)
+		seq++
+		b = append(b, op)
+		b = binary.AppendUvarint(b, seq)
+		b = binary.AppendUvarint(b, uint64(len(k)))
+		b = append(b, k...)
+		var v []byte
+		if values != nil {
+			v = values[i]
+		}
+		b = binary.AppendUvarint(b, uint64(len(v)))
+		b = append(b, v...)
+		b = binary.BigEndian.AppendUint32(b, crc32.ChecksumIEEE(b[start:]))
+	}
+	if s.size+int64(len(b)) > s.opts.MaxBytes {
+		if m := s.opts.Metrics; m != nil {
+			s.count(m.Rejected, len(keys))
+		}
+		return ErrSpillFull
+	}
+	if _, err := s.f.WriteAt(b, s.size); err != nil {
+		s.truncateTail()
+		return err
+	}
+	if !s.opts.NoSync {
+		if err := s.f.Sync(); err != nil {
+			s.truncateTail()
+			return err
+		}
+	}
+	s.size += int64(len(b))
+	s.seq = seq
+	s.pending += int64(len(keys))
+	if m := s.opts.Metrics; m != nil {
+		s.count(m.Spilled, len(keys))
+	}
+	s.updateGauges()
+	return nil
+}
+
+// truncateTail drops what a failed append left past the end of the log.
+// Whole records may have made it to the file with valid checksums, and
+// would otherwise be replayed if the next append is shorter. If
+// truncating fails too, it is retried before the next append.
+func (s *SpillConn) truncateTail() {
+	s.torn = s.f.Truncate(s.size) != nil
+}
+
+// shouldSpill tells whether a write failed because the server could not
+// be reached.
+func shouldSpill(ctx context.Context, err error) bool {
+	if err == nil || ctx.Err() != nil {
+		return false
+	}
+	return err == ErrTimeout || !IsError(err)
+}
+
+// Set stores the data at key, or spills it.
+func (s *SpillConn) Set(ctx context.Context, key string, value []byte) error {
+	if s.Pending() == 0 {
+		err := s.conn.Set(ctx, key, value)
+		if !shouldSpill(ctx, err) {
+			return err
+		}
+	}
+	return s.spill(spillSet, []string{key}, [][]byte{value})
+}
+
+// SetBulk stores the values in the map, or spills them.
+func (s *SpillConn) SetBulk(ctx context.Context, values map[string]string) (int64, error) {
+	if s.Pending() == 0 {
+		n, err := s.conn.SetBulk(ctx, values)
+		if !shouldSpill(ctx, err) {
+			return n, err
+		}
+	}
+	keys := make([]string, 0, len(values))
+	vals := make([][]byte, 0, len(values))
+	for k, v := range values {
+		keys = append(keys, k)
+		vals = append(vals, []byte(v))
+	}
+	if err := s.spill(spillSet, keys, vals); err != nil {
+		return 0, err
+	}
+	return int64(len(keys)), nil
+}
+
+// Remove deletes the data at key, or spills the removal.
+func (s *SpillConn) Remove(ctx context.Context, key string) error {
+	if s.Pending() == 0 {
+		err := s.conn.Remove(ctx, key)
+		if !shouldSpill(ctx, err) {
+			return err
+		}
+	}
+	return s.spill(spillRemove, []string{key}, nil)
+}
+
+// RemoveBulk deletes the given keys, or spills their removal.
+func (s *SpillConn) RemoveBulk(ctx context.Context, keys []string) (int64, error) {
+	if s.Pending() == 0 {
+		n, err := s.conn.RemoveBulk(ctx, keys)
+		if !shouldSpill(ctx, err) {
+			return n, err
+		}
+	}
+	if err := s.spill(spillRemove, keys, nil); err != nil {
+		return 0, err
+	}
+	return int64(len(keys)), nil
+}
+
+// Count returns the number of records in the database.
+func (s *SpillConn) Count(ctx context.Context) (int, error) {
+	return s.conn.Count(ctx)
+}
+
+// Get retrieves the data stored at key.
+func (s *SpillConn) Get(ctx context.Context, key string) (string, error) {
+	return s.conn.Get(ctx, key)
+}
+
+// GetBytes retrieves the data stored at key.
+func (s *SpillConn) GetBytes(ctx context.Context, key string) ([]byte, error) {
+	return s.conn.GetBytes(ctx, key)
+}
+
+// GetBulk retrieves the keys in the map.
+func (s *SpillConn) GetBulk(ctx context.Context, keysAndVals map[string]string) error {
+	return s.conn.GetBulk(ctx, keysAndVals)
+}
+
+// GetBulkBytes retrieves the keys in the map.
+func (s *SpillConn) GetBulkBytes(ctx context.Context, keys map[string][]byte) error {
+	return s.conn.GetBulkBytes(ctx, keys)
+}
+
+// MatchPrefix returns the keys starting with key.
+func (s *SpillConn) MatchPrefix(ctx context.Context, key string, maxrecords int64) ([]string, error) {
+	return s.conn.MatchPrefix(ctx, key, maxrecords)
+}
+
+// run checks the health of the server while records are pending, and
+// replays them once it answers.
+func (s *SpillConn) run() {
+	defer close(s.done)
+	t := time.NewTicker(s.opts.CheckInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-t.C:
+		}
+		if s.Pending() == 0 || s.conn.ping(s.ctx) != nil {
+			continue
+		}
+		s.Replay(s.ctx)
+	}
+}
+
+// Replay sends the pending records to the server, in order, without
+// waiting for the next health check. It stops at the first batch failing
+// to reach the server, and returns its error.
+func (s *SpillConn) Replay(ctx context.Context) error {
+	s.replayMu.Lock()
+	defer s.replayMu.Unlock()
+	for {
+		op, recs, end, err := s.nextBatch()
+		if err != nil || len(recs) == 0 {
+			return err
+		}
+		keys := make([]string, len(recs))
+		for i, rec := range recs {
+			keys[i] = rec.key
+		}
+		if op == spillSet {
+			kvs := make([]KV, len(recs))
+			for i, rec := range recs {
+				kvs[i] = KV{rec.key, rec.value}
+			}
+			_, err = s.conn.doSetBulk(ctx, kvs, 0)
+		} else {
+			_, err = s.conn.RemoveBulk(ctx, keys)
+		}
+		if err != nil && !IsError(err) || err == ErrTimeout || ctx.Err() != nil {
+			return err
+		}
+		if err != nil {
+			if m := s.opts.Metrics; m != nil {
+				s.count(m.Discarded, len(recs))
+			}
+			if s.opts.OnDiscard != nil {
+				name := OpSetBulk
+				if op == spillRemove {
+					name = OpRemoveBulk
+				}
+				s.opts.OnDiscard(name, keys, err)
+			}
+		} else if m := s.opts.Metrics; m != nil {
+			s.count(m.Replayed, len(recs))
+		}
+		if err := s.acknowledge(recs[len(recs)-1].seq, end, len(recs)); err != nil {
+			return err
+		}
+	}
+}
+
+// nextBatch reads the next records of the log with the same op, up to
+// BatchSize, and returns the offset following them.
+func (s *SpillConn) nextBatch() (byte, []spillRecord, int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.f == nil {
+		return 0, nil, 0, ErrClosed
+	}
+	r := newSpillReader(s.f, s.readOff, s.size)
+	var recs []spillRecord
+	end := s.readOff
+	for len(recs) < s.opts.BatchSize {
+		rec, err := r.next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return 0, nil, 0, err
+		}
+		if len(recs) > 0 && rec.op != recs[0].op {
+			break
+		}
+		recs = append(recs, rec)
+		end = r.off
+	}
+	if len(recs) == 0 {
+		return 0, nil, 0, nil
+	}
+	return recs[0].op, recs, end, nil
+}
+
+// acknowledge records that the records up to seq, ending at offset end,
+// were replayed.
+func (s *SpillConn) acknowledge(seq uint64, end int64, n int) error {
+	b := binary.BigEndian.AppendUint64(nil, seq)
+	b = binary.BigEndian.AppendUint32(b, crc32.ChecksumIEEE(b))
+	tmp := s.path + ".ack.tmp"
+	if err := os.WriteFile(tmp, b, 0o600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, s.path+".ack"); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.ack, s.readOff = seq, end
+	s.pending -= int64(n)
+	var err error
+	if s.pending == 0 && s.f != nil {
+		err = s.reset()
+	}
+	s.updateGauges()
+	return err
+}
+
+// Close stops the health checks and closes the spill log. Pending
+// records stay in the log, to be replayed by the next SpillConn opening
+// it. The Conn is not closed.
+func (s *SpillConn) Close() error {
+	s.cancel()
+	<-s.done
+	s.replayMu.Lock()
+	defer s.replayMu.Unlock()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.f == nil {
+		return nil
+	}
+	err := s.f.Close()
+	s.f = nil
+	return err
+}
+
+type spillRecord struct {
+	op    byte
+	seq   uint64
+	key   string
+	value []byte
+}
+
+// spillReader reads the records of a spill log between two offsets.
+type spillReader struct {
+	r   *bufio.Reader
+	off int64
+	buf []byte
+}
+
+func newSpillReader(f *os.File, off, end int64) *spillReader {
+	return &spillReader{r: bufio.NewReader(io.NewSectionReader(f, off, end-off)), off: off}
+}
+
+var errTornSpill = errors.New("torn spill record")
+
+// next returns the next record, io.EOF at the end of the log and
+// errTornSpill for an incomplete or corrupt record.
+func (r *spillReader) next() (spillRecord, error) {
+	var rec spillRecord
+	b := r.buf[:0]
+	op, err := r.r.ReadByte()
+	if err != nil {
+		return rec, err
+	}
+	if op != spillSet && op != spillRemove {
+		return rec, errTornSpill
+	}
+	b = append(b, op)
+	readUvarint := func() (uint64, bool) {
+		x, err := binary.ReadUvarint(r.r)
+		if err != nil {
+			return 0, false
+		}
+		b = binary.AppendUvarint(b, x)
+		return x, true
+	}
+	readBytes := func() ([]byte, bool) {
+		n, ok := readUvarint()
+		if !ok || n > 1<<31 {
+			return nil, false
+		}
+		start := len(b)
+		b = append(b, make([]byte, n)...)
+		if _, err := io.ReadFull(r.r, b[start:]); err != nil {
+			return nil, false
+		}
+		return b[start:], true
+	}
+	seq, ok := readUvarint()
+	if !ok {
+		return rec, errTornSpill
+	}
+	key, ok := readBytes()
+	if !ok {
+		return rec, errTornSpill
+	}
+	rec.key = string(key)
+	value, ok := readBytes()
+	if !ok {
+		return rec, errTornSpill
+	}
+	var sum [4]byte
+	if _, err := io.ReadFull(r.r, sum[:]); err != nil || crc32.ChecksumIEEE(b) != binary.BigEndian.Uint32(sum[:]) {
+		return rec, errTornSpill
+	}
+	rec.op, rec.seq = op, seq
+	if op == spillSet {
+		rec.value = append([]byte(nil), value...)
+	}
+	r.buf = b
+	r.off += int64(len(b)) + 4
+	return rec, nil
+}
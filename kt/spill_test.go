@@ -0,0 +1,193 @@
+package kt
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// flakyServer serves f, or drops every connection while down is set.
+type flakyServer struct {
+	f    *fakeKT
+	down atomic.Bool
+}
+
+func (s *flakyServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if s.down.Load() {
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err == nil {
+			conn.Close()
+		}
+		return
+	}
+	s.f.ServeHTTP(w, r)
+}
+
+func TestSpillConn(t *testing.T) {
+	ctx := context.Background()
+	srv := &flakyServer{f: newFakeKT()}
+	host, port := startFakeServer(t, srv)
+	db, err := NewConn(host, port, 1, DEFAULT_TIMEOUT)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close(ctx)
+	path := filepath.Join(t.TempDir(), "kt.spill")
+	opts := SpillOptions{CheckInterval: time.Hour, BatchSize: 2}
+	s, err := NewSpillConn(db, path, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.Set(ctx, "b", []byte("old")); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Remove(ctx, "missing"); err != ErrNotFound {
+		t.Errorf("Remove with the server up: got %v", err)
+	}
+
+	srv.down.Store(true)
+	if err := s.Set(ctx, "a", []byte("1")); err != nil {
+		t.Fatalf("Set with the server down: %v", err)
+	}
+	if err := s.Remove(ctx, "b"); err != nil {
+		t.Fatalf("Remove with the server down: %v", err)
+	}
+	if n, err := s.SetBulk(ctx, map[string]string{"c": "3", "d": "4"}); err != nil || n != 2 {
+		t.Fatalf("SetBulk with the server down: %d, %v", n, err)
+	}
+	if err := s.Replay(ctx); err == nil {
+		t.Error("Replay succeeded with the server down")
+	}
+
+	// Writes keep being spilled until the log is replayed.
+	srv.down.Store(false)
+	if err := s.Set(ctx, "a", []byte("2")); err != nil {
+		t.Fatal(err)
+	}
+	if n := s.Pending(); n != 5 {
+		t.Errorf("Pending: want 5, got %d", n)
+	}
+	if _, err := db.Get(ctx, "a"); err != ErrNotFound {
+		t.Errorf("spilled write reached the server: %v", err)
+	}
+
+	// Records survive a restart, even after a torn write.
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte{spillSet, 42, 3, 'x'})
+	f.Close()
+	s, err = NewSpillConn(db, path, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if n := s.Pending(); n != 5 {
+		t.Errorf("Pending after reopening: want 5, got %d", n)
+	}
+
+	if err := s.Replay(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if n := s.Pending(); n != 0 {
+		t.Errorf("Pending after Replay: %d", n)
+	}
+	for k, want := range map[string]string{"a": "2", "c": "3", "d": "4"} {
+		if v, err := db.Get(ctx, k); err != nil || v != want {
+			t.Errorf("Get(%q): want %q, got %q, %v", k, want, v, err)
+		}
+	}
+	if _, err := db.Get(ctx, "b"); err != ErrNotFound {
+		t.Errorf("spilled Remove not replayed: %v", err)
+	}
+	if fi, err := os.Stat(path); err != nil || fi.Size() != spillHeaderLen {
+		t.Errorf("log not truncated after replay: %v, %v", fi.Size(), err)
+	}
+
+	// Writes go to the server again, and replayed records are not
+	// replayed twice.
+	if err := s.Set(ctx, "e", []byte("5")); err != nil || s.Pending() != 0 {
+		t.Errorf("Set after replay: %v, %d pending", err, s.Pending())
+	}
+	s.Close()
+	s, err = NewSpillConn(db, path, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if n := s.Pending(); n != 0 {
+		t.Errorf("Pending after reopening a replayed log: %d", n)
+	}
+}
+
+func TestSpillConnFull(t *testing.T) {
+	ctx := context.Background()
+	srv := &flakyServer{f: newFakeKT()}
+	host, port := startFakeServer(t, srv)
+	db, err := NewConn(host, port, 1, DEFAULT_TIMEOUT)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close(ctx)
+	s, err := NewSpillConn(db, filepath.Join(t.TempDir(), "kt.spill"), SpillOptions{MaxBytes: 64, CheckInterval: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	srv.down.Store(true)
+	if err := s.Set(ctx, "a", make([]byte, 20)); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Set(ctx, "b", make([]byte, 40)); err != ErrSpillFull {
+		t.Errorf("Set over the cap: got %v", err)
+	}
+	if n := s.Pending(); n != 1 {
+		t.Errorf("Pending: want 1, got %d", n)
+	}
+}
+
+func TestSpillConnHealthCheck(t *testing.T) {
+	ctx := context.Background()
+	srv := &flakyServer{f: newFakeKT()}
+	host, port := startFakeServer(t, srv)
+	db, err := NewConn(host, port, 1, DEFAULT_TIMEOUT)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close(ctx)
+	s, err := NewSpillConn(db, filepath.Join(t.TempDir(), "kt.spill"), SpillOptions{CheckInterval: 5 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	srv.down.Store(true)
+	if err := s.Set(ctx, "a", []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(20 * time.Millisecond)
+	if s.Pending() != 1 {
+		t.Fatal("record replayed with the server down")
+	}
+	srv.down.Store(false)
+	deadline := time.Now().Add(5 * time.Second)
+	for s.Pending() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("record not replayed once the server was back")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if v, err := db.Get(ctx, "a"); err != nil || v != "1" {
+		t.Errorf("Get: got %q, %v", v, err)
+	}
+}
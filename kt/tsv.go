@@ -0,0 +1,332 @@
+package kt
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// KV uses an explicit structure here rather than a map[string][]byte
+// because we need ordered data.
+type KV struct {
+	Key   string
+	Value []byte
+}
+
+// Encoding is the field encoding of a TSV body, as given by the colenc
+// parameter of its Content-Type.
+type Encoding int
+
+const (
+	IdentityEnc Encoding = iota
+	Base64Enc
+	URLEnc
+)
+
+// ContentType returns the Content-Type header value for a TSV body
+// with encoding e.
+func (e Encoding) ContentType() string {
+	switch e {
+	case Base64Enc:
+		return "text/tab-separated-values; colenc=B"
+	case URLEnc:
+		return "text/tab-separated-values; colenc=U"
+	default:
+		return "text/tab-separated-values"
+	}
+}
+
+// ParseContentType returns the field encoding of a TSV body from its
+// Content-Type header.
+func ParseContentType(contenttype string) (Encoding, error) {
+	// mime.ParseMediaType is much more expensive than this, and
+	// KT only ever sends the one media type with an optional colenc.
+	mediatype, params, _ := strings.Cut(contenttype, ";")
+	if !strings.EqualFold(strings.TrimSpace(mediatype), "text/tab-separated-values") {
+		return 0, &Error{Message: fmt.Sprintf("responded with unknown Content-Type: %q", contenttype)}
+	}
+	enc := IdentityEnc
+	for params != "" {
+		var param string
+		param, params, _ = strings.Cut(params, ";")
+		name, value, _ := strings.Cut(strings.TrimSpace(param), "=")
+		if !strings.EqualFold(name, "colenc") {
+			continue
+		}
+		switch value {
+		case "B":
+			enc = Base64Enc
+		case "U":
+			enc = URLEnc
+		default:
+			return 0, &Error{Message: fmt.Sprintf("responded with unknown column encoding: %q", contenttype)}
+		}
+	}
+	return enc, nil
+}
+
+// chooseEncoding picks the encoding producing the smallest body for
+// values. Identity is only possible if no field contains control
+// characters or non-ASCII bytes. Otherwise URL encoding wins for mostly
+// textual data and base64 for binary data, where URL encoding would
+// triple the size of most bytes.
+func chooseEncoding(values []KV) (Encoding, int) {
+	var identity, urlsize, b64size int
+	binary := false
+	for _, kv := range values {
+		ke, ve := urlEscapes(kv.Key), urlEscapesSlice(kv.Value)
+		binary = binary || ke > 0 || ve > 0
+		identity += len(kv.Key) + len(kv.Value) + 2
+		urlsize += len(kv.Key) + 2*ke + len(kv.Value) + 2*ve + 2
+		b64size += base64.StdEncoding.EncodedLen(len(kv.Key)) + base64.StdEncoding.EncodedLen(len(kv.Value)) + 2
+	}
+	switch {
+	case !binary:
+		return IdentityEnc, identity
+	case urlsize <= b64size:
+		return URLEnc, urlsize
+	default:
+		return Base64Enc, b64size
+	}
+}
+
+// TSVEncode encodes the request body in TSV. The encoding is chosen
+// based on which one gives the smallest body for the key/values.
+func TSVEncode(values []KV) ([]byte, Encoding) {
+	enc, bufsize := chooseEncoding(values)
+	buf := make([]byte, 0, bufsize)
+	for _, kv := range values {
+		buf = appendRecord(buf, enc, kv)
+	}
+	return buf, enc
+}
+
+func appendRecord(buf []byte, enc Encoding, kv KV) []byte {
+	buf = appendField(buf, enc, kv.Key)
+	buf = append(buf, '\t')
+	buf = appendField(buf, enc, kv.Value)
+	return append(buf, '\n')
+}
+
+func appendField[T string | []byte](buf []byte, enc Encoding, field T) []byte {
+	switch enc {
+	case Base64Enc:
+		n := len(buf)
+		buf = append(buf, make([]byte, base64.StdEncoding.EncodedLen(len(field)))...)
+		base64.StdEncoding.Encode(buf[n:], []byte(field))
+		return buf
+	case URLEnc:
+		for i := 0; i < len(field); i++ {
+			c := field[i]
+			if urlShouldEscape(c) {
+				buf = append(buf, '%', hexdigits[c>>4], hexdigits[c&0xf])
+			} else {
+				buf = append(buf, c)
+			}
+		}
+		return buf
+	default:
+		return append(buf, field...)
+	}
+}
+
+const hexdigits = "0123456789ABCDEF"
+
+// urlShouldEscape reports whether c has to be escaped in a URL encoded
+// field. Anything outside printable ASCII is escaped, as well as % and +
+// which have a special meaning when decoding.
+func urlShouldEscape(c byte) bool {
+	return c < 0x20 || c > 0x7e || c == '%' || c == '+'
+}
+
+func urlEscapes(b string) int {
+	var n int
+	for i := 0; i < len(b); i++ {
+		if urlShouldEscape(b[i]) {
+			n++
+		}
+	}
+	return n
+}
+
+func urlEscapesSlice(b []byte) int {
+	var n int
+	for _, c := range b {
+		if urlShouldEscape(c) {
+			n++
+		}
+	}
+	return n
+}
+
+// TSVEncoder writes key/value records to a stream in TSV format.
+type TSVEncoder struct {
+	w   io.Writer
+	enc Encoding
+	buf []byte
+}
+
+// NewTSVEncoder returns an encoder writing records to w using
+// field encoding enc.
+func NewTSVEncoder(w io.Writer, enc Encoding) *TSVEncoder {
+	return &TSVEncoder{w: w, enc: enc}
+}
+
+// Encode writes a single record.
+func (e *TSVEncoder) Encode(kv KV) error {
+	e.buf = appendRecord(e.buf[:0], e.enc, kv)
+	_, err := e.w.Write(e.buf)
+	return err
+}
+
+// EncodeKey writes a record made of a single key field, as in a list of
+// keys.
+func (e *TSVEncoder) EncodeKey(key string) error {
+	e.buf = append(appendField(e.buf[:0], e.enc, key), '\n')
+	_, err := e.w.Write(e.buf)
+	return err
+}
+
+// TSVDecoder reads key/value records from a TSV stream.
+type TSVDecoder struct {
+	r   *bufio.Reader
+	enc Encoding
+	n   int
+}
+
+// NewTSVDecoder returns a decoder reading records from r that were
+// encoded with enc.
+func NewTSVDecoder(r io.Reader, enc Encoding) *TSVDecoder {
+	return &TSVDecoder{r: bufio.NewReader(r), enc: enc}
+}
+
+// Decode reads the next record. It returns io.EOF when there are no
+// more records, and an *Error if the input is malformed.
+func (d *TSVDecoder) Decode() (KV, error) {
+	line, err := d.r.ReadBytes('\n')
+	if len(line) == 0 {
+		if err == nil {
+			err = io.EOF
+		}
+		return KV{}, err
+	}
+	if err != nil && err != io.EOF {
+		return KV{}, err
+	}
+	d.n++
+	return decodeRecord(bytes.TrimSuffix(line, []byte{'\n'}), d.enc, d.n)
+}
+
+// DecodeValues takes a response from an KT RPC call decodes it into a list of key
+// value pairs.
+func DecodeValues(buf []byte, contenttype string) ([]KV, error) {
+	if len(buf) == 0 {
+		return nil, nil
+	}
+	// KT can return values in 3 different formats, Tab separated values (TSV) without any field encoding,
+	// TSV with fields base64 encoded or TSV with URL encoding.
+	// KT does not give you any option as to the format that it returns, so we have to implement all of them
+	enc, err := ParseContentType(contenttype)
+	if err != nil {
+		return nil, err
+	}
+
+	// Because of the encoding, we can tell how many records there
+	// are by scanning through the input and counting the \n's
+	result := make([]KV, 0, bytes.Count(buf, []byte{'\n'})+1)
+	for n := 1; len(buf) > 0; n++ {
+		var line []byte
+		if i := bytes.IndexByte(buf, '\n'); i >= 0 {
+			line, buf = buf[:i], buf[i+1:]
+		} else {
+			line, buf = buf, nil
+		}
+		kv, err := decodeRecord(line, enc, n)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, kv)
+	}
+	return result, nil
+}
+
+// decodeRecord decodes a single line, without its newline, in place.
+func decodeRecord(line []byte, enc Encoding, n int) (KV, error) {
+	i := bytes.IndexByte(line, '\t')
+	if i < 0 {
+		return KV{}, &Error{Message: fmt.Sprintf("malformed TSV record %d: missing tab", n)}
+	}
+	key, err := decodeField(line[:i], enc)
+	if err != nil {
+		return KV{}, &Error{Message: fmt.Sprintf("malformed TSV record %d key: %v", n, err)}
+	}
+	value, err := decodeField(line[i+1:], enc)
+	if err != nil {
+		return KV{}, &Error{Message: fmt.Sprintf("malformed TSV record %d value: %v", n, err)}
+	}
+	return KV{string(key), value}, nil
+}
+
+// decodeField takes a byte slice and decodes the value in place. It
+// returns a slice pointing into the original byte slice. It is used for
+// decoding the individual fields of the TSV that kt returns.
+func decodeField(b []byte, enc Encoding) ([]byte, error) {
+	switch enc {
+	case Base64Enc:
+		return base64Decode(b)
+	case URLEnc:
+		return urlDecode(b)
+	default:
+		return b, nil
+	}
+}
+
+// Base64 decode each of the field
+func base64Decode(b []byte) ([]byte, error) {
+	n, err := base64.StdEncoding.Decode(b, b)
+	if err != nil {
+		return nil, err
+	}
+	return b[:n], nil
+}
+
+// Decode % escaped URL format
+func urlDecode(b []byte) ([]byte, error) {
+	res := b
+	resi := 0
+	for i := 0; i < len(b); i++ {
+		if b[i] != '%' {
+			res[resi] = b[i]
+			resi++
+			continue
+		}
+		if i+2 >= len(b) {
+			return nil, fmt.Errorf("truncated escape at offset %d", i)
+		}
+		hi, ok1 := unhex(b[i+1])
+		lo, ok2 := unhex(b[i+2])
+		if !ok1 || !ok2 {
+			return nil, fmt.Errorf("invalid escape %q at offset %d", b[i:i+3], i)
+		}
+		res[resi] = hi<<4 | lo
+		resi++
+		i += 2
+	}
+	return res[:resi], nil
+}
+
+// copied from net/url
+func unhex(c byte) (byte, bool) {
+	switch {
+	case '0' <= c && c <= '9':
+		return c - '0', true
+	case 'a' <= c && c <= 'f':
+		return c - 'a' + 10, true
+	case 'A' <= c && c <= 'F':
+		return c - 'A' + 10, true
+	}
+	return 0, false
+}
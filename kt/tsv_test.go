@@ -0,0 +1,141 @@
+package kt
+
+import (
+	"bytes"
+	"io"
+	"reflect"
+	"testing"
+)
+
+func TestTSVEncodingChoice(t *testing.T) {
+	var tests = []struct {
+		values []KV
+		enc    Encoding
+	}{
+		{[]KV{{"key", []byte("value")}}, IdentityEnc},
+		{[]KV{{"key", []byte("mostly text\twith a tab")}}, URLEnc},
+		{[]KV{{"key", []byte{0, 1, 2, 3, 0xff, 0xfe, 0x80, 0x90}}}, Base64Enc},
+		{nil, IdentityEnc},
+	}
+	for _, tt := range tests {
+		body, enc := TSVEncode(tt.values)
+		if enc != tt.enc {
+			t.Errorf("TSVEncode(%q): want encoding %d, got %d", tt.values, tt.enc, enc)
+		}
+		got, err := DecodeValues(body, enc.ContentType())
+		if err != nil {
+			t.Fatalf("DecodeValues(%q): %v", body, err)
+		}
+		if len(tt.values) != 0 && !reflect.DeepEqual(got, tt.values) {
+			t.Errorf("round trip: want %q, got %q", tt.values, got)
+		}
+	}
+}
+
+func TestDecodeValuesMalformed(t *testing.T) {
+	var tests = []struct {
+		body        string
+		contenttype string
+	}{
+		{"a\tb\n", ""},
+		{"a\tb\n", "text/plain"},
+		{"a\tb\n", "text/tab-separated-values; colenc=X"},
+		{"a\t%4\n", "text/tab-separated-values; colenc=U"},
+		{"a\t%\n", "text/tab-separated-values; colenc=U"},
+		{"a\t%zz\n", "text/tab-separated-values; colenc=U"},
+		{"a\t!!!\n", "text/tab-separated-values; colenc=B"},
+		{"no tab here\n", "text/tab-separated-values"},
+	}
+	for _, tt := range tests {
+		if _, err := DecodeValues([]byte(tt.body), tt.contenttype); !IsError(err) {
+			t.Errorf("DecodeValues(%q, %q): want error, got %v", tt.body, tt.contenttype, err)
+		}
+	}
+
+	got, err := DecodeValues([]byte("a\t%41%2b\nb\tc"), "text/tab-separated-values; colenc=U")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []KV{{"a", []byte("A+")}, {"b", []byte("c")}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("DecodeValues: want %q, got %q", want, got)
+	}
+}
+
+func TestTSVStream(t *testing.T) {
+	values := []KV{{"a", []byte("1")}, {"b\n", []byte{0, 'x'}}, {"c", []byte{}}}
+	for _, enc := range []Encoding{Base64Enc, URLEnc} {
+		var buf bytes.Buffer
+		e := NewTSVEncoder(&buf, enc)
+		for _, kv := range values {
+			if err := e.Encode(kv); err != nil {
+				t.Fatal(err)
+			}
+		}
+		d := NewTSVDecoder(&buf, enc)
+		var got []KV
+		for {
+			kv, err := d.Decode()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatalf("encoding %d: %v", enc, err)
+			}
+			got = append(got, kv)
+		}
+		if !reflect.DeepEqual(got, values) {
+			t.Errorf("encoding %d: want %q, got %q", enc, values, got)
+		}
+	}
+}
+
+func TestTSVEncodeKey(t *testing.T) {
+	var buf bytes.Buffer
+	e := NewTSVEncoder(&buf, URLEnc)
+	for _, k := range []string{"a", "b\t%"} {
+		if err := e.EncodeKey(k); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got, want := buf.String(), "a\nb%09%25\n"; got != want {
+		t.Errorf("want %q, got %q", want, got)
+	}
+}
+
+func FuzzDecodeValues(f *testing.F) {
+	f.Add([]byte("a\tb\n"), "text/tab-separated-values")
+	f.Add([]byte("YQ==\tYg==\n"), "text/tab-separated-values; colenc=B")
+	f.Add([]byte("a\t%4"), "text/tab-separated-values; colenc=U")
+	f.Add([]byte("a"), "")
+	f.Fuzz(func(t *testing.T, body []byte, contenttype string) {
+		kvs, err := DecodeValues(body, contenttype)
+		if err != nil {
+			if !IsError(err) {
+				t.Fatalf("DecodeValues returned a foreign error: %v", err)
+			}
+			return
+		}
+		if len(kvs) > bytes.Count(body, []byte{'\n'})+1 {
+			t.Fatalf("decoded %d records from %d lines", len(kvs), bytes.Count(body, []byte{'\n'})+1)
+		}
+	})
+}
+
+func FuzzTSVRoundTrip(f *testing.F) {
+	f.Add("key", []byte("value"))
+	f.Add("k\te\ny", []byte{0, 0xff, '%', '+'})
+	f.Fuzz(func(t *testing.T, key string, value []byte) {
+		if value == nil {
+			value = []byte{}
+		}
+		values := []KV{{key, value}, {"second", value}}
+		body, enc := TSVEncode(values)
+		got, err := DecodeValues(body, enc.ContentType())
+		if err != nil {
+			t.Fatalf("DecodeValues(%q, %d): %v", body, enc, err)
+		}
+		if !reflect.DeepEqual(got, values) {
+			t.Fatalf("round trip with encoding %d: want %q, got %q", enc, values, got)
+		}
+	})
+}
@@ -0,0 +1,151 @@
+package kt
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"sort"
+)
+
+// Codec converts between Go values and the bytes stored in KT.
+type Codec interface {
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+// JSONCodec stores values as JSON documents.
+var JSONCodec Codec = jsonCodec{}
+
+// GobCodec stores values in the encoding/gob format. Every value is
+// encoded as a self-contained gob stream, so type information is
+// repeated in each record.
+var GobCodec Codec = gobCodec{}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+type gobCodec struct{}
+
+func (gobCodec) Marshal(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (gobCodec) Unmarshal(data []byte, v interface{}) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
+
+// CodecError is returned by Typed when a value could not be converted
+// to or from its stored representation. It is never returned for
+// failures talking to KT, so callers can tell a corrupt or foreign record
+// apart from an unavailable server.
+type CodecError struct {
+	// Keys that failed to encode or decode, sorted.
+	Keys []string
+	// Err is the first error returned by the codec.
+	Err error
+	// Encode is true if the failure happened while marshalling a value.
+	Encode bool
+}
+
+func (e *CodecError) Error() string {
+	op := "decode"
+	if e.Encode {
+		op = "encode"
+	}
+	if len(e.Keys) == 1 {
+		return fmt.Sprintf("kt: %s %q: %v", op, e.Keys[0], e.Err)
+	}
+	return fmt.Sprintf("kt: %s %d keys: %v", op, len(e.Keys), e.Err)
+}
+
+func (e *CodecError) Unwrap() error {
+	return e.Err
+}
+
+// IsCodecError returns true if the error was caused by the codec of a
+// Typed connection rather than by KT.
+func IsCodecError(err error) bool {
+	_, ok := err.(*CodecError)
+	return ok
+}
+
+// Typed stores values of type T in KT, converting them with a Codec.
+// Typed is safe for concurrent use if the codec is.
+type Typed[T any] struct {
+	conn  Client
+	codec Codec
+}
+
+// NewTyped returns a typed view of conn using codec to marshal values.
+func NewTyped[T any](conn Client, codec Codec) *Typed[T] {
+	return &Typed[T]{conn: conn, codec: codec}
+}
+
+// Get retrieves and decodes the value stored at key. ErrNotFound is
+// returned if no such data exists, and a *CodecError if the stored bytes
+// cannot be decoded into a T.
+func (t *Typed[T]) Get(ctx context.Context, key string) (T, error) {
+	var v T
+	b, err := t.conn.GetBytes(ctx, key)
+	if err != nil {
+		return v, err
+	}
+	if err := t.codec.Unmarshal(b, &v); err != nil {
+		return v, &CodecError{Keys: []string{key}, Err: err}
+	}
+	return v, nil
+}
+
+// Set encodes v and stores it at key.
+func (t *Typed[T]) Set(ctx context.Context, key string, v T) error {
+	b, err := t.codec.Marshal(v)
+	if err != nil {
+		return &CodecError{Keys: []string{key}, Err: err, Encode: true}
+	}
+	return t.conn.Set(ctx, key, b)
+}
+
+// GetBulk retrieves and decodes the given keys. Keys that were not found
+// in the database are absent from the result. If some values cannot be
+// decoded, the remaining ones are still returned together with a
+// *CodecError listing the offending keys.
+func (t *Typed[T]) GetBulk(ctx context.Context, keys []string) (map[string]T, error) {
+	m := make(map[string][]byte, len(keys))
+	for _, k := range keys {
+		m[k] = nil
+	}
+	if err := t.conn.GetBulkBytes(ctx, m); err != nil {
+		return nil, err
+	}
+	res := make(map[string]T, len(m))
+	var cerr *CodecError
+	for k, b := range m {
+		var v T
+		if err := t.codec.Unmarshal(b, &v); err != nil {
+			if cerr == nil {
+				cerr = &CodecError{Err: err}
+			}
+			cerr.Keys = append(cerr.Keys, k)
+			continue
+		}
+		res[k] = v
+	}
+	if cerr != nil {
+		sort.Strings(cerr.Keys)
+		return res, cerr
+	}
+	return res, nil
+}
@@ -0,0 +1,76 @@
+package kt
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+type typedRecord struct {
+	Name  string
+	Tags  []string
+	Count int
+}
+
+func TestCodecRoundTrip(t *testing.T) {
+	in := typedRecord{Name: "Steve Vai", Tags: []string{"guitar", "shred"}, Count: 7}
+	for name, codec := range map[string]Codec{"json": JSONCodec, "gob": GobCodec} {
+		b, err := codec.Marshal(in)
+		if err != nil {
+			t.Fatalf("%s: Marshal: %v", name, err)
+		}
+		var out typedRecord
+		if err := codec.Unmarshal(b, &out); err != nil {
+			t.Fatalf("%s: Unmarshal: %v", name, err)
+		}
+		if !reflect.DeepEqual(in, out) {
+			t.Errorf("%s: want %#v, got %#v", name, in, out)
+		}
+	}
+}
+
+func TestCodecError(t *testing.T) {
+	var err error = &CodecError{Keys: []string{"a"}, Err: ErrNotFound}
+	if !IsCodecError(err) {
+		t.Error("IsCodecError returns false")
+	}
+	if IsError(err) {
+		t.Error("codec errors must not be reported as KT errors")
+	}
+}
+
+func TestTypedGetSet(t *testing.T) {
+	ctx := context.Background()
+	cmd := startServer(t)
+	defer haltServer(cmd, t)
+
+	db, err := NewConn(KTHOST, KTPORT, 1, DEFAULT_TIMEOUT)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	typed := NewTyped[typedRecord](db, JSONCodec)
+
+	want := typedRecord{Name: "a", Count: 1}
+	if err := typed.Set(ctx, "rec/a", want); err != nil {
+		t.Fatal(err)
+	}
+	got, err := typed.Get(ctx, "rec/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(want, got) {
+		t.Errorf("Get: want %#v, got %#v", want, got)
+	}
+
+	db.set(ctx, "rec/bad", []byte("not json"))
+	res, err := typed.GetBulk(ctx, []string{"rec/a", "rec/bad", "rec/missing"})
+	if !IsCodecError(err) {
+		t.Fatalf("GetBulk: want codec error, got %v", err)
+	}
+	if keys := err.(*CodecError).Keys; !reflect.DeepEqual(keys, []string{"rec/bad"}) {
+		t.Errorf("GetBulk: want failing keys [rec/bad], got %v", keys)
+	}
+	if len(res) != 1 || !reflect.DeepEqual(res["rec/a"], want) {
+		t.Errorf("GetBulk: want only rec/a, got %#v", res)
+	}
+}
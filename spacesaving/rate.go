@@ -116,6 +116,13 @@ func (ss *Rate) Init(size uint32, halfLife time.Duration) *Rate {
 // The implementation assumes time is monotonic, the behaviour is undefined in
 // the case of time going back. This operation has logarithmic complexity.
 func (ss *Rate) Touch(key string, nowTs time.Time) {
+	ss.TouchWeighted(key, 1, nowTs)
+}
+
+// Mark an event of a given weight happening, using given timestamp. The
+// rate of a key is then measured in weight per second, for instance in
+// bytes per second if the weight is the size of the event.
+func (ss *Rate) TouchWeighted(key string, weight float64, nowTs time.Time) {
 	now := nowTs.UnixNano()
 
 	var bucket *bucket
@@ -133,7 +140,7 @@ func (ss *Rate) Touch(key string, nowTs time.Time) {
 	}
 
 	if bucket.lastTs != 0 {
-		bucket.rate = ss.count(bucket.rate, bucket.lastTs, now)
+		bucket.rate = ss.count(bucket.rate, weight, bucket.lastTs, now)
 	}
 	bucket.lastTs = now
 
@@ -141,12 +148,12 @@ func (ss *Rate) Touch(key string, nowTs time.Time) {
 	heap.Fix(&ss.sh, int(bucket.idx))
 }
 
-func (ss *Rate) count(rate float64, lastTs, now int64) float64 {
+func (ss *Rate) count(rate, n float64, lastTs, now int64) float64 {
 	deltaNs := float64(now - lastTs)
 	weight := math.Exp(deltaNs * ss.weightHelper)
 
 	if deltaNs != 0 {
-		return rate*weight + (1000000000./deltaNs)*(1-weight)
+		return rate*weight + (n*1000000000./deltaNs)*(1-weight)
 	}
 	return rate * weight
 }
@@ -231,3 +231,24 @@ func BenchmarkMathExp(bb *testing.B) {
 		math.Exp(x)
 	}
 }
+
+func TestRateTouchWeighted(t *testing.T) {
+	t.Parallel()
+
+	ts := time.Now()
+	ss := (&Rate{}).Init(2, 1*time.Second)
+	ss1 := (&Rate{}).Init(2, 1*time.Second)
+	for i := 0; i < 20; i++ {
+		ts = ts.Add(time.Second)
+		ss.TouchWeighted("a", 100, ts)
+		ss1.Touch("a", ts)
+	}
+	rate, _ := ss.GetSingle("a", ts)
+	rate1, _ := ss1.GetSingle("a", ts)
+	if math.Abs(rate-100*rate1) > 1e-9 {
+		t.Errorf("weighted rate expected=%v got=%v", 100*rate1, rate)
+	}
+	if math.Abs(rate-100) > 0.01 {
+		t.Errorf("weighted rate expected about 100, got=%v", rate)
+	}
+}